@@ -0,0 +1,238 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// 管理用エンドポイントを Authorization: Bearer <token> で保護する
+// tokenが空の場合は管理用エンドポイントを無効にする
+func adminOnly(token string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if token == "" {
+			http.NotFound(w, r)
+			return
+		}
+		given, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// 新しい接続の受け付けをやめ、接続中の全クライアントをwindowの間に少しずつ切断する
+// 切断時には再接続の案内(shutdown)を送る。プロセスは終了しない
+func (h *Hub) Drain(window time.Duration) {
+	if !h.draining.CompareAndSwap(false, true) {
+		return
+	}
+	h.disconnectAll(window)
+}
+
+// 接続中の全クライアントをwindowの間に少しずつ切断する。drainingを立てた後に呼ぶこと
+func (h *Hub) disconnectAll(window time.Duration) {
+	var clients []*Client
+	if !h.do(func() {
+		for client := range h.clients {
+			clients = append(clients, client)
+		}
+	}) {
+		return
+	}
+	if len(clients) == 0 {
+		return
+	}
+
+	// 全員が同時に再接続しないよう、切断の間隔を空ける
+	interval := window / time.Duration(len(clients))
+	go func() {
+		for i, client := range clients {
+			if i > 0 && interval > 0 {
+				select {
+				case <-time.After(interval):
+				case <-h.done:
+					return
+				}
+			}
+			h.unregisterClient(client, reasonShutdown)
+		}
+	}()
+}
+
+// ドレイン中であればtrueを返す
+func (h *Hub) Draining() bool {
+	return h.draining.Load()
+}
+
+// メッセージの配信を一時停止する。接続は切らずに、ブロードキャストを溜めておく
+// 接続中のクライアントには {"type":"paused"} を送る
+func (h *Hub) Pause() {
+	h.do(func() {
+		if h.paused.Swap(true) {
+			return
+		}
+		h.enqueueAll(pausedMessage)
+	})
+}
+
+// 一時停止を解除し、溜めておいたブロードキャストを順に配信する
+// 接続中のクライアントには {"type":"resumed"} を送る
+func (h *Hub) Resume() {
+	h.do(func() {
+		if !h.paused.Swap(false) {
+			return
+		}
+		h.enqueueAll(resumedMessage)
+		if h.fanoutLimiter != nil {
+			// ブロードキャストの頻度に上限がある場合は、溜めておいた分も通常のブロードキャストと同じく
+			// 上限に従って少しずつ配信する(溜まった分を一度に送って上限を超えないようにする)
+			// 配信し終えるまでは、runが新しいブロードキャストを受け取らずに順序を保つ
+			h.replay = append(h.replay, h.held...)
+			h.held = nil
+			h.heldCount.Store(int64(len(h.replay)))
+			return
+		}
+		for _, f := range h.held {
+			h.fanout(f.message, f.pred)
+		}
+		h.held = nil
+		h.heldCount.Store(0)
+	})
+}
+
+// 再開前に溜めておいた分を1件配信する。hubのゴルーチンからのみ呼ぶこと
+func (h *Hub) replayNext() {
+	f := h.replay[0]
+	h.replay = h.replay[1:]
+	h.heldCount.Store(int64(len(h.replay) + len(h.held)))
+	h.fanout(f.message, f.pred)
+}
+
+// サーバーからのお知らせを接続中の全クライアントに送る
+// ブロードキャストと違い、一時停止中や頻度の上限に関係なくすぐに送る
+func (h *Hub) notifyAll(message []byte) {
+	h.do(func() {
+		h.enqueueAll(message)
+	})
+}
+
+// 接続中の全クライアントの送信バッファにメッセージを入れる。hubのゴルーチンからのみ呼ぶこと
+func (h *Hub) enqueueAll(message []byte) {
+	for client := range h.clients {
+		h.enqueue(client, message)
+	}
+}
+
+// 全スペースのhubを一時停止/再開する
+func (r *hubRegistry) Pause() {
+	r.mu.Lock()
+	r.paused = true
+	r.mu.Unlock()
+	for _, hub := range r.all() {
+		hub.Pause()
+	}
+}
+
+func (r *hubRegistry) Resume() {
+	r.mu.Lock()
+	r.paused = false
+	r.mu.Unlock()
+	for _, hub := range r.all() {
+		hub.Resume()
+	}
+}
+
+// 全スペースのhubをドレインする
+// 停止の予告(ShutdownNotice)が設定されている場合は、予告が終わってから切断を始める
+// 新しい接続とスペースの作成、ヘルスチェックは、予告の間から止める
+func (r *hubRegistry) Drain(window time.Duration) {
+	r.mu.Lock()
+	if r.draining {
+		r.mu.Unlock()
+		return
+	}
+	r.draining = true
+	for _, hub := range r.hubs {
+		hub.draining.Store(true)
+	}
+	notice, interval := r.cfg.ShutdownNotice, r.cfg.ShutdownNoticeInterval
+	r.mu.Unlock()
+	go func() {
+		r.countdown(notice, interval)
+		for _, hub := range r.all() {
+			hub.disconnectAll(window)
+		}
+	}()
+}
+
+// ドレイン中であればtrueを返す
+func (r *hubRegistry) Draining() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.draining
+}
+
+// POST /admin/peak/reset: 全スペースの同時接続数の最大値(リセット以降の分)をリセットする
+func serveResetPeak(reg *hubRegistry, w http.ResponseWriter, r *http.Request) {
+	for _, hub := range reg.all() {
+		hub.ResetPeak()
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// POST /admin/pause, POST /admin/resume: メンテナンスのために配信を一時停止/再開する
+func servePause(reg *hubRegistry, w http.ResponseWriter, r *http.Request) {
+	reg.Pause()
+	log.Println("配信を一時停止しました")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func serveResume(reg *hubRegistry, w http.ResponseWriter, r *http.Request) {
+	reg.Resume()
+	log.Println("配信を再開しました")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// POST /admin/spaces/{space}: スペースを宣言する(space-creation=declared の場合に使う)
+// 作成した場合は201、既にあった場合は200を返す
+func serveDeclareSpace(reg *hubRegistry, w http.ResponseWriter, r *http.Request) {
+	space := r.PathValue("space")
+	created, err := reg.declare(space)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if created {
+		log.Printf("スペースを作成しました: %s", space)
+		w.WriteHeader(http.StatusCreated)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// POST /admin/delivery/{strategy}: ブロードキャストの配信方法を切り替える
+// 実行中のブロードキャストには影響せず、次のブロードキャストから使われる
+func serveSetDelivery(reg *hubRegistry, w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("strategy")
+	if err := reg.SetDeliveryStrategy(name); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	log.Printf("配信方法を切り替えました: %s", name)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// POST /admin/drain: ローリングデプロイのためにこのインスタンスからクライアントを移す
+func serveDrain(reg *hubRegistry, window time.Duration, w http.ResponseWriter, r *http.Request) {
+	clients := reg.ClientCount()
+	reg.Drain(window)
+	log.Printf("ドレインを開始しました: クライアント=%d 期間=%v", clients, window)
+	w.WriteHeader(http.StatusAccepted)
+	fmt.Fprintf(w, "draining %d clients over %v\n", clients, window)
+}
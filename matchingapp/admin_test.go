@@ -0,0 +1,218 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"app/wstest"
+)
+
+// 管理用のトークンを付けてリクエストを送る
+func adminRequest(t *testing.T, method, url, token string) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp
+}
+
+// ws://... のURLをhttp://... にする
+func httpURL(wsURL string) string {
+	return "http" + strings.TrimPrefix(wsURL, "ws")
+}
+
+func TestDrainRefusesNewUpgradesAndClosesClients(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.AdminToken = "secret"
+	cfg.DrainWindow = 100 * time.Millisecond
+	_, url := startServer(t, cfg)
+	var clients []*wstest.Client
+	for i := 0; i < 2; i++ {
+		c := wstest.Dial(t, url+"/ws")
+		defer c.Close()
+		c.Expect("welcome")
+		clients = append(clients, c)
+	}
+
+	if resp := adminRequest(t, "POST", httpURL(url)+"/admin/drain", ""); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("トークンなしのドレイン: status = %d, want 401", resp.StatusCode)
+	}
+	if resp := adminRequest(t, "POST", httpURL(url)+"/admin/drain", "secret"); resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("ドレイン: status = %d, want 202", resp.StatusCode)
+	}
+	if _, resp, err := wstest.DialErr(t, url+"/ws"); err == nil || resp == nil || resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("ドレイン中の接続: err=%v resp=%v, want 503", err, resp)
+	}
+	for _, c := range clients {
+		if m := c.Expect("disconnect"); m["reason"] != reasonShutdown || m["reconnect"] != true {
+			t.Errorf("切断前の案内 = %v", m)
+		}
+	}
+
+	resp, err := http.Get(httpURL(url) + "/healthz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable || !strings.HasPrefix(string(body), "draining") {
+		t.Errorf("ドレイン中のヘルスチェック = %d %q, want 503 draining", resp.StatusCode, body)
+	}
+}
+
+func TestRegisterRejectedWhileDraining(t *testing.T) {
+	h := startHub(t, defaultConfig())
+	// serveWsでドレイン中かを確かめた後にドレインが始まった場合と同じ状態にする
+	h.Drain(0)
+	c, _ := newFakeClient(h)
+	if h.registerClient(c) {
+		t.Error("ドレイン中のhubにクライアントを登録できました")
+	}
+	if n := h.ClientCount(); n != 0 {
+		t.Errorf("ClientCount = %d, want 0", n)
+	}
+}
+
+func TestResumeReplaysHeldBroadcastsWithinBroadcastRate(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.BroadcastRate = 20
+	h := startHub(t, cfg)
+	c, _ := addFakeClient(t, h)
+
+	h.Pause()
+	for i := 0; i < 30; i++ {
+		h.publish([]byte(`{"type":"presence"}`))
+	}
+	// 最後のブロードキャストを溜め終えるまで待つ
+	h.do(func() {})
+	if st := h.Stats(); st.Broadcasts != 0 || st.Held != 30 {
+		t.Fatalf("一時停止中: broadcasts=%d held=%d, want 0, 30", st.Broadcasts, st.Held)
+	}
+
+	start := time.Now()
+	h.Resume()
+	time.Sleep(100 * time.Millisecond)
+	if n := h.broadcasts.Load(); n < 20 || n > 23 {
+		t.Errorf("再開後の100msで配信した数 = %d, want 20〜23", n)
+	}
+	eventually(t, "溜めておいた分の配信", func() bool { return h.broadcasts.Load() == 30 })
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Errorf("溜めておいた30件の配信にかかった時間 = %v, want 約500ms以上", elapsed)
+	}
+	h.do(func() {
+		// paused, resumed, 溜めておいた30件
+		if n := len(c.send); n != 32 {
+			t.Errorf("送信バッファの件数 = %d, want 32", n)
+		}
+	})
+}
+
+func TestPeakClientsIsTrackedAndReset(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.AdminToken = "secret"
+	reg, url := startServer(t, cfg)
+	h := reg.all()[defaultSpace]
+	var clients []*Client
+	for i := 0; i < 3; i++ {
+		c, _ := addFakeClient(t, h)
+		clients = append(clients, c)
+	}
+	h.unregisterClient(clients[0], reasonClientClose)
+	h.unregisterClient(clients[1], reasonClientClose)
+	addFakeClient(t, h)
+	if st := h.Stats(); st.Clients != 2 || st.PeakClients != 3 || st.PeakClientsSinceReset != 3 {
+		t.Fatalf("統計 = clients %d, peak %d, peak_since_reset %d, want 2, 3, 3", st.Clients, st.PeakClients, st.PeakClientsSinceReset)
+	}
+
+	if resp := adminRequest(t, "POST", httpURL(url)+"/admin/peak/reset", "secret"); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("リセット: status = %d, want 204", resp.StatusCode)
+	}
+	// リセット後の最大値は現在の接続数から数え直し、起動以降の最大値は残す
+	if st := h.Stats(); st.PeakClients != 3 || st.PeakClientsSinceReset != 2 {
+		t.Errorf("リセット後の統計 = peak %d, peak_since_reset %d, want 3, 2", st.PeakClients, st.PeakClientsSinceReset)
+	}
+	for i := 0; i < 2; i++ {
+		addFakeClient(t, h)
+	}
+	if st := h.Stats(); st.PeakClients != 4 || st.PeakClientsSinceReset != 4 {
+		t.Errorf("リセット後に増えたときの統計 = peak %d, peak_since_reset %d, want 4, 4", st.PeakClients, st.PeakClientsSinceReset)
+	}
+}
+
+func TestPauseHoldsBroadcastsAndDropsOverflow(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.PauseQueueLimit = 3
+	h := startHub(t, cfg)
+	_, conn := connectFake(t, h)
+
+	h.Pause()
+	for i := 1; i <= 5; i++ {
+		h.publish([]byte(fmt.Sprintf(`{"type":"chat","n":%d}`, i)))
+	}
+	h.do(func() {})
+	eventually(t, "一時停止のお知らせ", func() bool { return len(conn.messages()) > 0 })
+	// 一時停止中は切断せず、お知らせ以外は送らない
+	time.Sleep(20 * time.Millisecond)
+	if got := conn.messages(); !slices.Equal(got, []string{string(pausedMessage)}) {
+		t.Errorf("一時停止中に届いたメッセージ = %q, want pausedだけ", got)
+	}
+	if st := h.Stats(); st.Held != 3 || st.PauseDrops != 2 || st.Clients != 1 {
+		t.Errorf("一時停止中の統計 = held %d, pause_drops %d, clients %d, want 3, 2, 1", st.Held, st.PauseDrops, st.Clients)
+	}
+
+	h.Resume()
+	want := []string{string(pausedMessage), string(resumedMessage), `{"type":"chat","n":1}`, `{"type":"chat","n":2}`, `{"type":"chat","n":3}`}
+	eventually(t, "溜めておいた分の配信", func() bool { return len(conn.messages()) == len(want) })
+	if got := conn.messages(); !slices.Equal(got, want) {
+		t.Errorf("再開後に届いたメッセージ = %q, want %q", got, want)
+	}
+	if st := h.Stats(); st.Held != 0 || st.Broadcasts != 3 {
+		t.Errorf("再開後の統計 = held %d, broadcasts %d, want 0, 3", st.Held, st.Broadcasts)
+	}
+}
+
+func TestResumeReplaysHeldBroadcastsBeforeNewOnes(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.BroadcastRate = 50
+	h := startHub(t, cfg)
+	_, conn := connectFake(t, h)
+
+	h.Pause()
+	var want []string
+	for i := 1; i <= 10; i++ {
+		h.publish([]byte(fmt.Sprintf(`{"type":"chat","n":%d}`, i)))
+	}
+	h.Resume()
+	// 再開の直後に届いた新しいブロードキャストは、溜めておいた分より後に配信する
+	go func() {
+		for i := 11; i <= 13; i++ {
+			h.publish([]byte(fmt.Sprintf(`{"type":"chat","n":%d}`, i)))
+		}
+	}()
+
+	want = append(want, string(pausedMessage), string(resumedMessage))
+	for i := 1; i <= 13; i++ {
+		want = append(want, fmt.Sprintf(`{"type":"chat","n":%d}`, i))
+	}
+	eventually(t, "全てのブロードキャストの配信", func() bool { return len(conn.messages()) == len(want) })
+	if got := conn.messages(); !slices.Equal(got, want) {
+		t.Errorf("届いた順序 = %q, want %q", got, want)
+	}
+	if st := h.Stats(); st.Held != 0 || st.Broadcasts != 13 {
+		t.Errorf("統計 = held %d, broadcasts %d, want 0, 13", st.Held, st.Broadcasts)
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// 一時的に接続を禁止したIPアドレスを保持する
+// 既定ではメモリ上に持つが、再起動後も残したい場合は別の実装に差し替えられる
+type banStore interface {
+	// ipをuntilまで禁止する
+	Ban(ip string, until time.Time)
+	// ipが禁止中であれば解除される時刻を返す
+	BannedUntil(ip string, now time.Time) (time.Time, bool)
+}
+
+// メモリ上のbanStore
+type memoryBanStore struct {
+	mu sync.Mutex
+	bans map[string]time.Time
+}
+
+func newMemoryBanStore() *memoryBanStore {
+	return &memoryBanStore{bans: make(map[string]time.Time)}
+}
+
+func (s *memoryBanStore) Ban(ip string, until time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// 期限切れのものはここでまとめて消す(禁止は頻繁には起きない)
+	now := time.Now()
+	for k, t := range s.bans {
+		if !now.Before(t) {
+			delete(s.bans, k)
+		}
+	}
+	s.bans[ip] = until
+}
+
+func (s *memoryBanStore) BannedUntil(ip string, now time.Time) (time.Time, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	until, ok := s.bans[ip]
+	if !ok {
+		return time.Time{}, false
+	}
+	if !now.Before(until) {
+		delete(s.bans, ip)
+		return time.Time{}, false
+	}
+	return until, true
+}
+
+// 違反(レート上限の超過、受信サイズの超過)を繰り返すIPアドレスを一時的に禁止する
+// window内にthreshold回違反したら、cooldownの間そのIPアドレスからの接続を拒否する
+// 全スペースで共有する
+type banPolicy struct {
+	threshold int
+	window time.Duration
+	cooldown time.Duration
+	store banStore
+
+	mu sync.Mutex
+	// IPアドレスごとの、現在の期間の開始時刻と違反回数
+	counts map[string]*violationCount
+}
+
+type violationCount struct {
+	start time.Time
+	n int
+}
+
+// 設定から禁止のポリシーを作る。threshold が0の場合はnil(禁止しない)を返す
+func newBanPolicy(cfg Config) *banPolicy {
+	if cfg.BanThreshold <= 0 {
+		return nil
+	}
+	return &banPolicy{
+		threshold: cfg.BanThreshold,
+		window: cfg.BanWindow,
+		cooldown: cfg.BanCooldown,
+		store: newMemoryBanStore(),
+		counts: make(map[string]*violationCount),
+	}
+}
+
+// ipの違反を1回記録し、上限に達して禁止した場合はtrueを返す
+// IPアドレスが分からない接続(Unixドメインソケットなど)は記録しない
+func (p *banPolicy) violation(ip string, now time.Time) bool {
+	if ip == "" {
+		return false
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	v, ok := p.counts[ip]
+	if !ok || now.Sub(v.start) > p.window {
+		// 期間が過ぎたものは数え直す。ついでに古いものを消しておく
+		for k, old := range p.counts {
+			if now.Sub(old.start) > p.window {
+				delete(p.counts, k)
+			}
+		}
+		v = &violationCount{start: now}
+		p.counts[ip] = v
+	}
+	v.n++
+	if v.n < p.threshold {
+		return false
+	}
+	delete(p.counts, ip)
+	p.store.Ban(ip, now.Add(p.cooldown))
+	return true
+}
+
+// ipが禁止中であれば解除される時刻を返す
+func (p *banPolicy) bannedUntil(ip string, now time.Time) (time.Time, bool) {
+	if ip == "" {
+		return time.Time{}, false
+	}
+	return p.store.BannedUntil(ip, now)
+}
+
+// 接続元のIPアドレスを返す。分からない場合は空文字を返す
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil || net.ParseIP(host) == nil {
+		return ""
+	}
+	return host
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"app/wstest"
+
+	"github.com/gorilla/websocket"
+)
+
+// 違反を2回で禁止する設定
+func banConfig() Config {
+	cfg := defaultConfig()
+	cfg.BanThreshold = 2
+	cfg.BanWindow = time.Minute
+	cfg.BanCooldown = 300 * time.Millisecond
+	cfg.ReconnectPolicy[reasonBanned] = cfg.BanCooldown
+	return cfg
+}
+
+func TestOversizedMessagesEscalateToBanUntilCooldown(t *testing.T) {
+	cfg := banConfig()
+	cfg.ReadLimit = 64
+	reg, url := startServer(t, cfg)
+	hub := reg.all()[defaultSpace]
+
+	oversized := map[string]any{"type": "chat", "text": strings.Repeat("x", 100)}
+	for i, want := range []struct {
+		reason string
+		code int
+	}{
+		{reasonTooLarge, websocket.CloseMessageTooBig},
+		{reasonBanned, websocket.ClosePolicyViolation},
+	} {
+		c := wstest.Dial(t, url+"/ws")
+		c.Expect("welcome")
+		c.SendJSON(oversized)
+		// 禁止した場合は、切断の前に理由と再接続までの待ち時間を知らせる
+		if want.reason == reasonBanned {
+			if m := c.Expect("disconnect"); m["reason"] != reasonBanned || m["reconnect_after_ms"] != float64(cfg.BanCooldown.Milliseconds()) {
+				t.Errorf("禁止したときの案内 = %v", m)
+			}
+		}
+		if _, err := c.ReadMessage(); !websocket.IsCloseError(err, want.code) {
+			t.Errorf("%sによる切断のクローズ = %v, want クローズコード%d", want.reason, err, want.code)
+		}
+		eventually(t, want.reason+"による切断", func() bool { return hub.Disconnects()[want.reason] == 1 })
+		c.Close()
+		if i == 0 {
+			// 1回目の違反ではまだ禁止しない
+			if _, ok := hub.bans.bannedUntil("127.0.0.1", time.Now()); ok {
+				t.Fatal("1回目の違反で禁止されました")
+			}
+		}
+	}
+
+	_, resp, err := wstest.DialErr(t, url+"/ws")
+	if err == nil || resp == nil || resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("禁止中の接続: err=%v resp=%v, want 403", err, resp)
+	}
+	if resp.Header.Get("Retry-After") == "" {
+		t.Error("禁止中の応答にRetry-Afterがありません")
+	}
+	if n := hub.Stats().BanRejects; n != 1 {
+		t.Errorf("BanRejects = %d, want 1", n)
+	}
+
+	// 禁止の期間が過ぎれば接続できる
+	time.Sleep(cfg.BanCooldown)
+	c := wstest.Dial(t, url+"/ws")
+	defer c.Close()
+	c.Expect("welcome")
+}
+
+func TestRateLimitViolationsEscalateToBan(t *testing.T) {
+	cfg := banConfig()
+	cfg.RateLimits = map[string]float64{"chat": 2}
+	_, url := startServer(t, cfg)
+	c := wstest.Dial(t, url+"/ws")
+	defer c.Close()
+	c.Expect("welcome")
+
+	chat := map[string]any{"type": "chat"}
+	for i := 0; i < 3; i++ {
+		c.SendJSON(chat)
+	}
+	c.Expect("chat")
+	c.Expect("chat")
+	if m := c.Expect("error"); m["code"] != codeRateLimited {
+		t.Fatalf("1回目の違反 = %v, want %s", m, codeRateLimited)
+	}
+
+	// 送れるようになってから再び上限を超えると、2回目の違反として禁止される
+	time.Sleep(600 * time.Millisecond)
+	c.SendJSON(chat)
+	c.SendJSON(chat)
+	c.Expect("chat")
+	if m := c.Expect("disconnect"); m["reason"] != reasonBanned || m["reconnect_after_ms"] != float64(cfg.BanCooldown.Milliseconds()) {
+		t.Errorf("禁止したときの案内 = %v", m)
+	}
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"math/rand/v2"
+	"net/http"
+)
+
+// 新しい接続をカナリアにするかを決める
+// ヘッダーで指定された接続は必ずカナリアにし、それ以外は設定した割合で無作為に選ぶ
+func (h *Hub) isCanary(r *http.Request) bool {
+	return (h.canaryHeader != "" && r.Header.Get(h.canaryHeader) != "") || rand.Float64() < h.canaryFraction
+}
+
+// 登録できた接続を、カナリアかどうかで分けて数える
+// 登録前に断った接続(ドレイン中や停止済みのhubなど)は数えない
+func (h *Hub) countCohort(c *Client) {
+	if c.canary {
+		h.canaryConnections.Add(1)
+	} else {
+		h.normalConnections.Add(1)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"app/wstest"
+)
+
+func TestCanaryTagsRoughlyTheConfiguredFraction(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.CanaryFraction = 0.2
+	cfg.CanaryHeader = "X-Canary"
+	h := newHub(cfg)
+
+	const n = 5000
+	tagged := 0
+	for i := 0; i < n; i++ {
+		c := &Client{canary: h.isCanary(httptest.NewRequest("GET", "/ws", nil))}
+		if c.canary {
+			tagged++
+		}
+		h.countCohort(c)
+	}
+	// 二項分布の標準偏差は約28件のため、±5σで判定する
+	if got := float64(tagged) / n; got < 0.17 || got > 0.23 {
+		t.Errorf("カナリアにした割合 = %.3f (%d/%d), want 約%v", got, tagged, n, cfg.CanaryFraction)
+	}
+	if c, normal := h.canaryConnections.Load(), h.normalConnections.Load(); c != uint64(tagged) || normal != uint64(n-tagged) {
+		t.Errorf("接続数 = canary %d, normal %d, want %d, %d", c, normal, tagged, n-tagged)
+	}
+
+	// ヘッダーで指定された接続は必ずカナリアにする
+	for i := 0; i < 100; i++ {
+		r := httptest.NewRequest("GET", "/ws", nil)
+		r.Header.Set("X-Canary", "1")
+		if !h.isCanary(r) {
+			t.Fatal("ヘッダーで指定された接続がカナリアになりません")
+		}
+	}
+
+	// 割合が0の場合はヘッダーで指定された接続だけ
+	cfg.CanaryFraction = 0
+	h = newHub(cfg)
+	for i := 0; i < 1000; i++ {
+		if h.isCanary(httptest.NewRequest("GET", "/ws", nil)) {
+			t.Fatal("割合が0でもカナリアになりました")
+		}
+	}
+}
+
+func TestRejectedConnectionsAreNotCountedInCohorts(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.CanaryHeader = "X-Canary"
+	h := newHub(cfg)
+	go h.run()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serveWs(h, w, r)
+	}))
+	defer srv.Close()
+	url := "ws" + strings.TrimPrefix(srv.URL, "http")
+
+	c := wstest.Dial(t, url, wstest.WithHeader("X-Canary", "1"))
+	c.Expect("welcome")
+	c.Close()
+	n := wstest.Dial(t, url)
+	n.Expect("welcome")
+	n.Close()
+	if canary, normal := h.canaryConnections.Load(), h.normalConnections.Load(); canary != 1 || normal != 1 {
+		t.Fatalf("登録できた接続の数 = canary %d, normal %d, want 1, 1", canary, normal)
+	}
+
+	// 停止済みのhubには、アップグレードした後でも登録できずに切断される
+	h.Close()
+	for _, opts := range [][]wstest.Option{{wstest.WithHeader("X-Canary", "1")}, nil} {
+		c, _, err := wstest.DialErr(t, url, opts...)
+		if err == nil {
+			if _, err := c.ReadMessage(); err == nil {
+				t.Error("停止済みのhubに登録されました")
+			}
+			c.Close()
+		}
+	}
+	if canary, normal := h.canaryConnections.Load(), h.normalConnections.Load(); canary != 1 || normal != 1 {
+		t.Errorf("登録できなかった接続も数えられました: canary %d, normal %d, want 1, 1", canary, normal)
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// クライアントが選べるメッセージの形式(接続時のクエリパラメータ format=<形式>)
+// hubの中ではJSONのまま扱い、MessagePackのクライアントとの間でだけ変換する
+const (
+	formatJSON = "json"
+	formatMsgpack = "msgpack"
+)
+
+// MessagePackで受け取ったメッセージをJSONに変換する
+func msgpackToJSON(b []byte) ([]byte, error) {
+	var v any
+	if err := msgpack.Unmarshal(b, &v); err != nil {
+		return nil, err
+	}
+	return json.Marshal(v)
+}
+
+// JSONのメッセージをMessagePackに変換する
+// JSONでないメッセージ(passthroughで中継されたテキストなど)は文字列として変換する
+func jsonToMsgpack(b []byte) []byte {
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	var v any
+	if err := d.Decode(&v); err != nil || d.More() {
+		v = string(b)
+	}
+	out, err := msgpack.Marshal(jsonNumbers(v))
+	if err != nil {
+		out, _ = msgpack.Marshal(string(b))
+	}
+	return out
+}
+
+// 数値を、整数は整数のまま、それ以外は浮動小数点数としてMessagePackにできるようにする
+func jsonNumbers(v any) any {
+	switch v := v.(type) {
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return n
+		}
+		f, _ := v.Float64()
+		return f
+	case map[string]any:
+		for k, e := range v {
+			v[k] = jsonNumbers(e)
+		}
+	case []any:
+		for i, e := range v {
+			v[i] = jsonNumbers(e)
+		}
+	}
+	return v
+}
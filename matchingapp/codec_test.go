@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+
+	"app/wstest"
+
+	"github.com/gorilla/websocket"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// MessagePackのクライアントとして次のメッセージを読み込む
+func readMsgpack(t *testing.T, c *wstest.Client) map[string]any {
+	t.Helper()
+	typ, frame, err := c.Conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if typ != websocket.BinaryMessage {
+		t.Fatalf("フレームの種類 = %d, want バイナリフレーム: %s", typ, frame)
+	}
+	var m map[string]any
+	if err := msgpack.Unmarshal(frame, &m); err != nil {
+		t.Fatalf("MessagePackとして読めません: %v", err)
+	}
+	return m
+}
+
+func TestJSONAndMsgpackClientsExchangeMessages(t *testing.T) {
+	_, url := startServer(t, defaultConfig())
+	j := wstest.Dial(t, url+"/ws")
+	defer j.Close()
+	mp := wstest.Dial(t, url+"/ws", wstest.WithQuery("format", formatMsgpack))
+	defer mp.Close()
+	j.Expect("welcome")
+	if m := readMsgpack(t, mp); m["type"] != "welcome" {
+		t.Fatalf("MessagePackのクライアントへの最初のメッセージ = %v, want welcome", m)
+	}
+
+	// JSONのクライアントから → MessagePackのクライアントへ
+	j.SendJSON(map[string]any{"type": "chat", "text": "こんにちは", "n": 3, "tags": []string{"a"}})
+	j.Expect("chat")
+	m := readMsgpack(t, mp)
+	if m["type"] != "chat" || m["text"] != "こんにちは" || fmt.Sprint(m["n"]) != "3" || len(m["tags"].([]any)) != 1 {
+		t.Errorf("MessagePackのクライアントが受信したメッセージ = %#v", m)
+	}
+	// JSONの整数は浮動小数点数にせず、整数のまま送る
+	if _, ok := m["n"].(float64); ok {
+		t.Errorf("整数が浮動小数点数として送られました: %#v", m["n"])
+	}
+
+	// MessagePackのクライアントから → JSONのクライアントへ
+	b, _ := msgpack.Marshal(map[string]any{"type": "chat", "text": "hello", "score": 1.5})
+	if err := mp.Conn.WriteMessage(websocket.BinaryMessage, b); err != nil {
+		t.Fatal(err)
+	}
+	if m := j.Expect("chat"); m["text"] != "hello" || m["score"] != 1.5 {
+		t.Errorf("JSONのクライアントが受信したメッセージ = %v", m)
+	}
+	readMsgpack(t, mp)
+
+	// MessagePackとして読めないメッセージはエラーを返して捨てる
+	if err := mp.Conn.WriteMessage(websocket.BinaryMessage, []byte{0xc1}); err != nil {
+		t.Fatal(err)
+	}
+	if m := readMsgpack(t, mp); m["type"] != "error" || m["code"] != codeInvalidFormat {
+		t.Errorf("読めないメッセージへの応答 = %v, want code %s", m, codeInvalidFormat)
+	}
+}
+
+func TestUnknownFormatIsRejected(t *testing.T) {
+	_, url := startServer(t, defaultConfig())
+	_, resp, err := wstest.DialErr(t, url+"/ws", wstest.WithQuery("format", "xml"))
+	if err == nil || resp == nil || resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("format=xml: err=%v resp=%v, want 400", err, resp)
+	}
+}
+
+func TestJSONToMsgpackKeepsNonJSONAsString(t *testing.T) {
+	var s string
+	if err := msgpack.Unmarshal(jsonToMsgpack([]byte("plain text")), &s); err != nil || s != "plain text" {
+		t.Errorf("JSONでないメッセージの変換 = %q (%v), want 文字列のまま", s, err)
+	}
+}
@@ -0,0 +1,605 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// サーバー全体の設定
+type Config struct {
+	// TCPで待ち受けるアドレス
+	Addr string
+
+	// Unixドメインソケットのパス。指定した場合はAddrの代わりにこちらで待ち受ける
+	SocketPath string
+
+	// ソケットファイルの権限
+	SocketMode os.FileMode
+
+	// upgraderの読み込み/書き込みバッファサイズ(バイト)
+	ReadBufferSize int
+	WriteBufferSize int
+
+	// 接続のTCPキープアライブの間隔。正の値で有効にし、負の値で無効にする
+	// 0の場合はnet/httpの既定のまま変更しない。WebSocketのpingとは別に、OSが死んだ相手を検知する
+	TCPKeepAlive time.Duration
+
+	// カナリアとして扱う新しい接続の割合(0〜1)
+	// カナリアの接続ではClient.Canaryがtrueになり、新しい動作を一部の接続だけで試せる
+	CanaryFraction float64
+
+	// このヘッダーが付いた接続は割合にかかわらずカナリアにする(空の場合は見ない)
+	CanaryHeader string
+
+	// 1つの接続を使い続けられる最大の時間。通信の有無にかかわらず、超えたら再接続を案内して切断する(0で無制限)
+	// 漏れたトークンで接続され続ける期間を限るためのもの
+	MaxLifetime time.Duration
+
+	// 接続後、最初のメッセージが届くまで待つ時間。届かなければ切断する(0で無効)
+	// 無通信による切断(pongの待ち時間)とは別に、接続しただけのクライアントを早めに切る
+	// 受信専用(mode=readonly)のクライアントには適用しない
+	FirstMessageTimeout time.Duration
+
+	// クライアントから受け取るメッセージの最大サイズ(バイト)
+	// 分割(フラグメント)して送られたメッセージは、組み立て後の合計サイズに対して適用される
+	ReadLimit int64
+
+	// 同じ種類のエラーログをまとめて出力する間隔(0で集約しない)
+	LogWindow time.Duration
+
+	// 全スペースの全クライアントの送信バッファに溜まった未配信メッセージの上限
+	// 超えている間はbroadcastの受け取りを止めて送信側を待たせる(0で無制限)
+	MaxInFlight int
+
+	// hubへの登録を待っている接続の上限。超えた接続はアップグレード前に503で断る(0で無制限)
+	// 接続が一斉に押し寄せたときに、待たされるゴルーチンが際限なく増えないようにする
+	MaxPendingRegistrations int
+
+	// 一時停止中に溜めておけるブロードキャストの上限(1以上)。超えた分は捨てる
+	// 再開時にまとめて配信するため、送信バッファの大きさ(256)より十分小さくしておく
+	PauseQueueLimit int
+
+	// permessage-deflateによる圧縮を有効にするか
+	Compression bool
+
+	// 圧縮する送信フレームの最小サイズ(バイト)。これより小さいフレームは圧縮しない
+	CompressionThreshold int
+
+	// 1回の書き込みでsendからまとめて取り出すメッセージ数の上限(0で無制限)
+	// 無制限だと大量のメッセージが溜まったクライアントでpingの送信が遅れ、
+	// 相手側のタイムアウトで切断されることがある
+	MaxDrainPerWrite int
+
+	// 全クライアントの送信バッファに溜められるメッセージの合計バイト数(0で無制限)
+	// 超えた場合は、溜まっている量の多いクライアントから切断してメモリを空ける
+	MaxBufferedBytes int64
+
+	// ブロードキャストの配信方法(disconnect-slow, serial, worker-pool, drop-oldest)
+	// 再起動せずに POST /admin/delivery/{strategy} で切り替えられる
+	DeliveryStrategy string
+
+	// worker-poolで配信に使うゴルーチンの数
+	DeliveryWorkers int
+
+	// 起動時に作成するスペース名(/ws/{space})
+	// 空の場合は接続時に必要に応じて作成する
+	Spaces []string
+
+	// 宣言されていないスペースへの接続時の扱い(auto: 作成する, declared: 404を返す)
+	// 空の場合は、Spacesが空ならauto、そうでなければdeclaredとして扱う
+	// declaredの場合も、/admin/spaces/{space} でスペースを追加できる
+	SpaceCreation string
+
+	// 接続時に自動で作成したスペースを、誰も接続していない状態がこの時間続いたら取り除く(0で取り除かない)
+	// 試合ごとにスペースを作る使い方で、スペースが増え続けて自動作成の上限に達するのを防ぐ
+	SpaceIdleTimeout time.Duration
+
+	// 接続確認用の /ws/echo を有効にするか(本番では無効にしておく)
+	// 有効にした場合、"echo" という名前のスペースには接続できなくなる
+	EchoEndpoint bool
+
+	// 統計情報を定期的にログ出力する間隔(0で出力しない)
+	StatsInterval time.Duration
+
+	// 切断理由ごとに、クライアントへ案内する再接続までの待ち時間
+	// 負の値は再接続しないように案内する。含まれない理由では案内を送らない
+	ReconnectPolicy map[string]time.Duration
+
+	// 接続に必要なプロトコルバージョンの下限(0で確認しない)
+	MinProtocolVersion int
+
+	// メッセージの種類("type"フィールド)ごとの受信レート上限(1秒あたりの件数)
+	RateLimits map[string]float64
+
+	// RateLimitsにない種類(種類なしを含む)に共通で適用する上限(0で無制限)
+	DefaultRateLimit float64
+
+	// 全スペースの接続中のクライアント数がこれ以上になったら負荷をyellow/redとしてクライアントに知らせる(0で使わない)
+	LoadYellow int
+	LoadRed int
+
+	// 負荷の段階の変化を知らせる最小の間隔
+	LoadUpdateInterval time.Duration
+
+	// 1クライアントが直近のByteQuotaWindowの間に送れる合計バイト数(0で無制限)
+	// 件数のレート上限とは別に、大きなメッセージで帯域を使い切られるのを防ぐ
+	ByteQuota int64
+	ByteQuotaWindow time.Duration
+
+	// 接続元(Originヘッダー)ごとの受信レート上限。含まれない接続元には
+	// RateLimitsとDefaultRateLimitを使う(信頼できる連携先だけ上限を緩めるなど)
+	OriginRateLimits map[string]RateProfile
+
+	// クライアントの送信バッファがこの件数に達したら警告する(0で警告しない)
+	SlowClientWatermark int
+
+	// 送信バッファが警告水位をこの回数超えたクライアントには、ブロードキャストを送らず
+	// 宛先を指定したメッセージだけを送るように切り替える(0で切り替えない)
+	// 切断する代わりに、混雑したスペースの遅い端末との接続を保つためのもの
+	DemoteAfter int
+
+	// メッセージが送信バッファで待てる時間の上限。超えたものは送らずに捨てる(0で無制限)
+	// 書き込みタイムアウトとは別に、詰まった後で古いメッセージが届くのを防ぐ
+	MaxQueueAge time.Duration
+
+	// 全クライアントで最も古い未配信メッセージがこの時間を超えたらログで警告する(0で警告しない)
+	QueueAgeAlarm time.Duration
+
+	// hubが1秒あたりにブロードキャストできる回数の上限(0で無制限)
+	// 超えた分は少しの間待たせて、イベントが集中したときの配信を平準化する
+	BroadcastRate float64
+
+	// 送信バッファが警告水位に達したクライアントの割合がこれを超えたら、
+	// LowPriorityTypesの配信を全体で止めてクライアントの切断を減らす(0で止めない)
+	ShedThreshold float64
+
+	// 過負荷時に配信を止める優先度の低いメッセージの種類
+	LowPriorityTypes []string
+
+	// 中継する既知のメッセージの種類
+	MessageTypes []string
+
+	// メッセージの種類ごとの、受け取るのに必要なプロトコルバージョン
+	// これより古いバージョンのクライアントにはその種類のブロードキャストを配信しない
+	TypeVersions map[string]int
+
+	// 既知でない種類(種類なしを含む)のメッセージの扱い(passthrough, drop, reject)
+	UnknownTypePolicy string
+
+	// メッセージのHMAC署名に使う共有鍵(空の場合は署名しない)
+	// 設定した場合、署名のない/一致しないクライアントからのメッセージは捨て、
+	// サーバーから送るメッセージには署名を付ける
+	SigningKey string
+
+	// 署名のアルゴリズム(hmac-sha256, hmac-sha512)
+	SigningAlgorithm string
+
+	// BanWindowの間にこの回数違反(レート上限の超過、受信サイズの超過)したIPアドレスを切断し、
+	// BanCooldownの間接続を禁止する(0で禁止しない)
+	BanThreshold int
+	BanWindow time.Duration
+	BanCooldown time.Duration
+
+	// 再起動せずに変更できる設定(read-limit, rate-limits, rate-limit-default, origin-rate-limits)を
+	// 書いたファイル。起動時とSIGHUP受信時に読み込む(空の場合は読み込まない)
+	ReloadFile string
+
+	// 接続を許可/拒否するIPアドレスの範囲を書いたファイル(ipfilter.go)
+	// 起動時とSIGHUP受信時に読み込む(空の場合は全てのIPアドレスから接続できる)
+	IPFilterFile string
+
+	// IPFilterFileから読み込んだ範囲(nilで制限しない)
+	IPFilter *ipFilter
+
+	// 管理用エンドポイント(/admin/...)の認証トークン(空の場合は無効)
+	AdminToken string
+
+	// ドレイン時に全クライアントを切断し終えるまでの期間
+	DrainWindow time.Duration
+
+	// ドレイン(終了シグナルまたは /admin/drain)の前に、停止を予告する期間(0で予告しない)
+	// この間、ShutdownNoticeIntervalごとに残り時間をクライアントへ知らせる
+	ShutdownNotice time.Duration
+	ShutdownNoticeInterval time.Duration
+}
+
+// read-limitに指定できる上限
+// メッセージは組み立て終わるまでメモリに保持されるため、接続数×この値まで確保されうる
+const maxReadLimit = 16 << 20
+
+// 既定値で初期化した設定を返す
+func defaultConfig() Config {
+	return Config{
+		Addr: ":8080",
+		SocketMode: 0660,
+		ReadBufferSize: 1024,
+		WriteBufferSize: 1024,
+		ReadLimit: 512,
+		LogWindow: 10 * time.Second,
+		CompressionThreshold: 256,
+		DeliveryStrategy: deliveryDisconnectSlow,
+		DeliveryWorkers: runtime.NumCPU(),
+		ByteQuotaWindow: time.Minute,
+		LoadUpdateInterval: 10 * time.Second,
+		PauseQueueLimit: sendBufferSize / 2,
+		SlowClientWatermark: sendBufferSize * 3 / 4,
+		UnknownTypePolicy: unknownTypePassthrough,
+		SigningAlgorithm: "hmac-sha256",
+		BanWindow: time.Minute,
+		BanCooldown: 10 * time.Minute,
+		DrainWindow: 30 * time.Second,
+		ShutdownNoticeInterval: 10 * time.Second,
+		ReconnectPolicy: map[string]time.Duration{
+			reasonShutdown: 5 * time.Second,
+			reasonOverload: 30 * time.Second,
+			reasonIdle: 0,
+			reasonMaxLifetime: 0,
+		},
+	}
+}
+
+// コマンドラインフラグから設定を読み込む
+func loadConfig() Config {
+	cfg := defaultConfig()
+	flag.StringVar(&cfg.Addr, "addr", cfg.Addr, "TCPで待ち受けるアドレス")
+	flag.StringVar(&cfg.SocketPath, "socket", cfg.SocketPath, "Unixドメインソケットのパス(指定時は -addr の代わりに使う)")
+	flag.Func("socket-mode", "ソケットファイルの権限(8進数、既定 0660)", func(s string) error {
+		mode, err := strconv.ParseUint(s, 8, 32)
+		if err != nil || mode > 0777 {
+			return fmt.Errorf("8進数の権限を指定してください: %q", s)
+		}
+		cfg.SocketMode = os.FileMode(mode)
+		return nil
+	})
+	flag.IntVar(&cfg.ReadBufferSize, "read-buffer", cfg.ReadBufferSize, "upgraderの読み込みバッファサイズ(バイト)")
+	flag.IntVar(&cfg.WriteBufferSize, "write-buffer", cfg.WriteBufferSize, "upgraderの書き込みバッファサイズ(バイト)")
+	flag.DurationVar(&cfg.TCPKeepAlive, "tcp-keepalive", cfg.TCPKeepAlive, "TCPキープアライブの間隔(0で既定のまま、負の値で無効)")
+	flag.Float64Var(&cfg.CanaryFraction, "canary-fraction", cfg.CanaryFraction, "カナリアとして扱う新しい接続の割合(0〜1)")
+	flag.StringVar(&cfg.CanaryHeader, "canary-header", cfg.CanaryHeader, "このヘッダーが付いた接続は必ずカナリアにする(空の場合は見ない)")
+	flag.DurationVar(&cfg.MaxLifetime, "max-lifetime", cfg.MaxLifetime, "1つの接続を使い続けられる最大の時間(0で無制限)")
+	flag.DurationVar(&cfg.FirstMessageTimeout, "first-message-timeout", cfg.FirstMessageTimeout, "接続後、最初のメッセージが届くまで待つ時間(0で無効)")
+	defineReloadableFlags(flag.CommandLine, &cfg)
+	flag.StringVar(&cfg.ReloadFile, "reload-file", cfg.ReloadFile, "起動時とSIGHUP受信時に読み込む、再起動せずに変更できる設定のファイル")
+	flag.StringVar(&cfg.IPFilterFile, "ip-filter-file", cfg.IPFilterFile, "接続を許可/拒否するIPアドレスの範囲のファイル(1行に allow <CIDR> か deny <CIDR>。SIGHUPで読み込み直す)")
+	flag.DurationVar(&cfg.LogWindow, "log-window", cfg.LogWindow, "同じ種類のエラーログを集約する間隔(0で集約しない)")
+	flag.IntVar(&cfg.MaxPendingRegistrations, "max-pending-registrations", cfg.MaxPendingRegistrations, "hubへの登録を待っている接続の上限(0で無制限)")
+	flag.IntVar(&cfg.PauseQueueLimit, "pause-queue-limit", cfg.PauseQueueLimit, "一時停止中に溜めておけるブロードキャストの上限")
+	flag.IntVar(&cfg.MaxInFlight, "max-inflight", cfg.MaxInFlight, "全クライアント合計の未配信メッセージ数の上限(0で無制限)")
+	flag.BoolVar(&cfg.Compression, "compress", cfg.Compression, "permessage-deflateによる圧縮を有効にする")
+	flag.IntVar(&cfg.CompressionThreshold, "compress-threshold", cfg.CompressionThreshold, "圧縮する送信フレームの最小サイズ(バイト)")
+	flag.IntVar(&cfg.LoadYellow, "load-yellow", cfg.LoadYellow, "接続数がこれ以上になったら負荷をyellowとして知らせる(0で使わない)")
+	flag.IntVar(&cfg.LoadRed, "load-red", cfg.LoadRed, "接続数がこれ以上になったら負荷をredとして知らせる(0で使わない)")
+	flag.DurationVar(&cfg.LoadUpdateInterval, "load-update-interval", cfg.LoadUpdateInterval, "負荷の段階の変化を知らせる最小の間隔")
+	flag.Int64Var(&cfg.ByteQuota, "byte-quota", cfg.ByteQuota, "1クライアントが直近の -byte-quota-window の間に送れる合計バイト数(0で無制限)")
+	flag.DurationVar(&cfg.ByteQuotaWindow, "byte-quota-window", cfg.ByteQuotaWindow, "受信バイト数の上限を数える直近の期間")
+	flag.Int64Var(&cfg.MaxBufferedBytes, "max-buffered-bytes", cfg.MaxBufferedBytes, "全クライアントの送信バッファに溜められる合計バイト数(0で無制限)")
+	flag.StringVar(&cfg.DeliveryStrategy, "delivery", cfg.DeliveryStrategy, "ブロードキャストの配信方法(disconnect-slow, serial, worker-pool, drop-oldest)")
+	flag.IntVar(&cfg.DeliveryWorkers, "delivery-workers", cfg.DeliveryWorkers, "worker-poolで配信に使うゴルーチンの数")
+	flag.IntVar(&cfg.MaxDrainPerWrite, "max-drain", cfg.MaxDrainPerWrite, "1回の書き込みでまとめて送るメッセージ数の上限(0で無制限。無制限だと滞留時にpingが遅れることがある)")
+	flag.DurationVar(&cfg.SpaceIdleTimeout, "space-idle-timeout", cfg.SpaceIdleTimeout, "自動で作成したスペースを、接続がない状態がこの時間続いたら取り除く(0で取り除かない)")
+	flag.StringVar(&cfg.SpaceCreation, "space-creation", cfg.SpaceCreation, "宣言されていないスペースへの接続時の扱い(auto, declared。省略時は -spaces の有無で決める)")
+	flag.Func("spaces", "起動時に作成するスペース名(カンマ区切り)。省略時は接続時に作成する", func(s string) error {
+		cfg.Spaces = splitList(s)
+		return nil
+	})
+	flag.BoolVar(&cfg.EchoEndpoint, "echo", cfg.EchoEndpoint, "接続確認用の /ws/echo を有効にする")
+	flag.DurationVar(&cfg.StatsInterval, "stats-interval", cfg.StatsInterval, "統計情報をログ出力する間隔(0で出力しない)")
+	flag.Func("reconnect-policy", "切断理由ごとの再接続までの待ち時間(例: shutdown=5s,overload=30s,idle_timeout=never)", func(s string) error {
+		policy, err := parseReconnectPolicy(s)
+		if err != nil {
+			return err
+		}
+		cfg.ReconnectPolicy = policy
+		return nil
+	})
+	flag.IntVar(&cfg.MinProtocolVersion, "min-protocol-version", cfg.MinProtocolVersion, "接続に必要なプロトコルバージョンの下限(0で確認しない)")
+	flag.IntVar(&cfg.SlowClientWatermark, "slow-watermark", cfg.SlowClientWatermark, "送信バッファがこの件数に達したクライアントを警告する(0で警告しない)")
+	flag.IntVar(&cfg.DemoteAfter, "demote-after", cfg.DemoteAfter, "警告水位をこの回数超えたクライアントにはブロードキャストを送らない(0で切り替えない)")
+	flag.Func("message-types", "中継する既知のメッセージの種類(カンマ区切り)", func(s string) error {
+		cfg.MessageTypes = splitList(s)
+		return nil
+	})
+	flag.Func("type-versions", "種類ごとの受け取るのに必要なプロトコルバージョン(例: reaction=1)", func(s string) error {
+		versions, err := parseTypeVersions(s)
+		if err != nil {
+			return err
+		}
+		cfg.TypeVersions = versions
+		return nil
+	})
+	flag.StringVar(&cfg.UnknownTypePolicy, "unknown-type-policy", cfg.UnknownTypePolicy, "既知でない種類のメッセージの扱い(passthrough, drop, reject)")
+	flag.StringVar(&cfg.SigningKey, "signing-key", cfg.SigningKey, "メッセージのHMAC署名に使う共有鍵(空の場合は署名しない)")
+	flag.StringVar(&cfg.SigningAlgorithm, "signing-alg", cfg.SigningAlgorithm, "署名のアルゴリズム(hmac-sha256, hmac-sha512)")
+	flag.IntVar(&cfg.BanThreshold, "ban-threshold", cfg.BanThreshold, "-ban-window の間にこの回数違反したIPアドレスの接続を禁止する(0で禁止しない)")
+	flag.DurationVar(&cfg.BanWindow, "ban-window", cfg.BanWindow, "違反を数える期間")
+	flag.DurationVar(&cfg.BanCooldown, "ban-cooldown", cfg.BanCooldown, "違反を繰り返したIPアドレスの接続を禁止する期間")
+	flag.StringVar(&cfg.AdminToken, "admin-token", cfg.AdminToken, "管理用エンドポイントの認証トークン(空の場合は無効)")
+	flag.DurationVar(&cfg.DrainWindow, "drain-window", cfg.DrainWindow, "ドレイン時に全クライアントを切断し終えるまでの期間")
+	flag.DurationVar(&cfg.ShutdownNotice, "shutdown-notice", cfg.ShutdownNotice, "ドレインの前に停止を予告する期間(0で予告しない)")
+	flag.DurationVar(&cfg.ShutdownNoticeInterval, "shutdown-notice-interval", cfg.ShutdownNoticeInterval, "停止の予告を送る間隔")
+	flag.DurationVar(&cfg.MaxQueueAge, "max-queue-age", cfg.MaxQueueAge, "メッセージが送信バッファで待てる時間の上限(0で無制限)")
+	flag.DurationVar(&cfg.QueueAgeAlarm, "queue-age-alarm", cfg.QueueAgeAlarm, "最も古い未配信メッセージの待ち時間がこれを超えたら警告する(0で警告しない)")
+	flag.Float64Var(&cfg.BroadcastRate, "broadcast-rate", cfg.BroadcastRate, "hubが1秒あたりにブロードキャストできる回数の上限(0で無制限)")
+	flag.Float64Var(&cfg.ShedThreshold, "shed-threshold", cfg.ShedThreshold, "送信が詰まったクライアントの割合がこれを超えたら優先度の低いメッセージを間引く(0〜1、0で間引かない)")
+	flag.Func("low-priority-types", "過負荷時に間引く優先度の低いメッセージの種類(カンマ区切り)", func(s string) error {
+		cfg.LowPriorityTypes = splitList(s)
+		return nil
+	})
+	flag.Parse()
+	reloaded, err := reloadAll(cfg)
+	if err != nil {
+		log.Fatal("設定ファイルの読み込みエラー: ", err)
+	}
+	cfg = reloaded
+	// 禁止した理由は、再接続できるようになるまでの時間とともに案内する
+	if _, ok := cfg.ReconnectPolicy[reasonBanned]; !ok && cfg.BanThreshold > 0 {
+		cfg.ReconnectPolicy[reasonBanned] = cfg.BanCooldown
+	}
+	return cfg
+}
+
+// カンマ区切りの文字列を分割する。空の要素は除く
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// "理由=待ち時間" をカンマ区切りで並べた文字列を解析する
+// 待ち時間に never を指定すると再接続しないように案内する
+func parseReconnectPolicy(s string) (map[string]time.Duration, error) {
+	policy := make(map[string]time.Duration)
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		reason, value, ok := strings.Cut(item, "=")
+		if !ok {
+			return nil, fmt.Errorf("理由=待ち時間 の形式で指定してください: %q", item)
+		}
+		if value == "never" {
+			policy[reason] = -1
+			continue
+		}
+		d, err := time.ParseDuration(value)
+		if err != nil || d < 0 {
+			return nil, fmt.Errorf("待ち時間が不正です: %q", item)
+		}
+		policy[reason] = d
+	}
+	return policy, nil
+}
+
+// "種類=1秒あたりの件数" をカンマ区切りで並べた文字列を解析する
+func parseRateLimits(s string) (map[string]float64, error) {
+	limits := make(map[string]float64)
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		typ, value, ok := strings.Cut(item, "=")
+		if !ok {
+			return nil, fmt.Errorf("種類=件数 の形式で指定してください: %q", item)
+		}
+		if typ = strings.TrimSpace(typ); typ == "" {
+			return nil, fmt.Errorf("種類を指定してください: %q", item)
+		}
+		rate, err := strconv.ParseFloat(value, 64)
+		if err != nil || rate <= 0 {
+			return nil, fmt.Errorf("件数には正の数を指定してください: %q", item)
+		}
+		limits[typ] = rate
+	}
+	return limits, nil
+}
+
+// "種類=プロトコルバージョン" をカンマ区切りで並べた文字列を解析する
+func parseTypeVersions(s string) (map[string]int, error) {
+	versions := make(map[string]int)
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		typ, value, ok := strings.Cut(item, "=")
+		if !ok {
+			return nil, fmt.Errorf("種類=バージョン の形式で指定してください: %q", item)
+		}
+		v, err := strconv.Atoi(value)
+		if err != nil || v < 1 || v > protocolVersion {
+			return nil, fmt.Errorf("バージョンは1〜%dの範囲で指定してください: %q", protocolVersion, item)
+		}
+		versions[typ] = v
+	}
+	return versions, nil
+}
+
+// 再起動せずに変更できる設定のフラグをfsに定義する
+// コマンドラインと、SIGHUP受信時に読み込むファイル(reload.go)の両方で使う
+func defineReloadableFlags(fs *flag.FlagSet, cfg *Config) {
+	fs.Int64Var(&cfg.ReadLimit, "read-limit", cfg.ReadLimit, "受信メッセージの最大サイズ(バイト)")
+	fs.Func("rate-limits", "メッセージの種類ごとの受信レート上限(例: chat=5,typing=20,move=10)", func(s string) error {
+		limits, err := parseRateLimits(s)
+		if err != nil {
+			return err
+		}
+		cfg.RateLimits = limits
+		return nil
+	})
+	fs.Func("origin-rate-limits", "接続元ごとの受信レート上限(例: \"https://partner.example.com chat=20,*=10\"、*はそれ以外の種類。複数回指定可)", func(s string) error {
+		origin, profile, err := parseRateProfile(s)
+		if err != nil {
+			return err
+		}
+		if cfg.OriginRateLimits == nil {
+			cfg.OriginRateLimits = make(map[string]RateProfile)
+		}
+		cfg.OriginRateLimits[origin] = profile
+		return nil
+	})
+	fs.Float64Var(&cfg.DefaultRateLimit, "rate-limit-default", cfg.DefaultRateLimit, "rate-limits にない種類の受信レート上限(1秒あたり、0で無制限)")
+}
+
+// "<接続元> 種類=件数,..." の形式の接続元ごとの受信レート上限を解釈する
+// 種類 * はそれ以外の種類に共通の上限になる
+func parseRateProfile(s string) (string, RateProfile, error) {
+	origin, limits, ok := strings.Cut(strings.TrimSpace(s), " ")
+	if !ok || origin == "" {
+		return "", RateProfile{}, fmt.Errorf("接続元 種類=件数,... の形式で指定してください: %q", s)
+	}
+	parsed, err := parseRateLimits(limits)
+	if err != nil {
+		return "", RateProfile{}, err
+	}
+	profile := RateProfile{Limits: parsed, Default: parsed["*"]}
+	delete(profile.Limits, "*")
+	return origin, profile, nil
+}
+
+// 設定値を検証する
+// 0や負の値をgorilla/websocketに渡すと黙って既定値が使われるため、起動時にエラーにする
+func (c Config) validate() error {
+	if c.ReadBufferSize <= 0 {
+		return fmt.Errorf("read-buffer は正の値を指定してください: %d", c.ReadBufferSize)
+	}
+	if c.WriteBufferSize <= 0 {
+		return fmt.Errorf("write-buffer は正の値を指定してください: %d", c.WriteBufferSize)
+	}
+	if c.ReadLimit <= 0 || c.ReadLimit > maxReadLimit {
+		return fmt.Errorf("read-limit は1〜%dの範囲で指定してください: %d", maxReadLimit, c.ReadLimit)
+	}
+	if c.LogWindow < 0 {
+		return fmt.Errorf("log-window に負の値は指定できません: %v", c.LogWindow)
+	}
+	if c.StatsInterval < 0 {
+		return fmt.Errorf("stats-interval に負の値は指定できません: %v", c.StatsInterval)
+	}
+	if c.BroadcastRate < 0 {
+		return fmt.Errorf("broadcast-rate に負の値は指定できません: %v", c.BroadcastRate)
+	}
+	if c.ShedThreshold < 0 || c.ShedThreshold >= 1 {
+		return fmt.Errorf("shed-threshold は0以上1未満で指定してください: %v", c.ShedThreshold)
+	}
+	if c.MaxQueueAge < 0 {
+		return fmt.Errorf("max-queue-age に負の値は指定できません: %v", c.MaxQueueAge)
+	}
+	if c.CanaryFraction < 0 || c.CanaryFraction > 1 {
+		return fmt.Errorf("canary-fraction は0〜1の範囲で指定してください: %v", c.CanaryFraction)
+	}
+	if c.MaxLifetime < 0 {
+		return fmt.Errorf("max-lifetime に負の値は指定できません: %v", c.MaxLifetime)
+	}
+	if c.FirstMessageTimeout < 0 {
+		return fmt.Errorf("first-message-timeout に負の値は指定できません: %v", c.FirstMessageTimeout)
+	}
+	if c.QueueAgeAlarm < 0 {
+		return fmt.Errorf("queue-age-alarm に負の値は指定できません: %v", c.QueueAgeAlarm)
+	}
+	if c.BanThreshold < 0 {
+		return fmt.Errorf("ban-threshold に負の値は指定できません: %d", c.BanThreshold)
+	}
+	if c.BanThreshold > 0 && (c.BanWindow <= 0 || c.BanCooldown <= 0) {
+		return fmt.Errorf("ban-threshold を指定する場合は ban-window と ban-cooldown に正の値を指定してください")
+	}
+	if c.ShutdownNotice < 0 {
+		return fmt.Errorf("shutdown-notice に負の値は指定できません: %v", c.ShutdownNotice)
+	}
+	if c.ShutdownNotice > 0 && c.ShutdownNoticeInterval <= 0 {
+		return fmt.Errorf("shutdown-notice-interval には正の値を指定してください: %v", c.ShutdownNoticeInterval)
+	}
+	if c.DrainWindow < 0 {
+		return fmt.Errorf("drain-window に負の値は指定できません: %v", c.DrainWindow)
+	}
+	if c.MaxPendingRegistrations < 0 {
+		return fmt.Errorf("max-pending-registrations に負の値は指定できません: %d", c.MaxPendingRegistrations)
+	}
+	if c.PauseQueueLimit < 1 {
+		// 0では一時停止中のブロードキャストを全て黙って捨ててしまうため、1以上を求める
+		return fmt.Errorf("pause-queue-limit には1以上を指定してください: %d", c.PauseQueueLimit)
+	}
+	if c.MaxInFlight < 0 {
+		return fmt.Errorf("max-inflight に負の値は指定できません: %d", c.MaxInFlight)
+	}
+	if c.CompressionThreshold < 0 {
+		return fmt.Errorf("compress-threshold に負の値は指定できません: %d", c.CompressionThreshold)
+	}
+	if _, err := newDeliveryStrategy(nil, c.DeliveryStrategy, c.DeliveryWorkers); err != nil {
+		return err
+	}
+	if c.DeliveryWorkers < 1 {
+		return fmt.Errorf("delivery-workers には1以上を指定してください: %d", c.DeliveryWorkers)
+	}
+	if c.LoadYellow < 0 || c.LoadRed < 0 {
+		return fmt.Errorf("load-yellow と load-red に負の値は指定できません: %d, %d", c.LoadYellow, c.LoadRed)
+	}
+	if c.LoadYellow > 0 && c.LoadRed > 0 && c.LoadRed < c.LoadYellow {
+		return fmt.Errorf("load-red には load-yellow(%d)以上を指定してください: %d", c.LoadYellow, c.LoadRed)
+	}
+	if c.ByteQuota < 0 {
+		return fmt.Errorf("byte-quota に負の値は指定できません: %d", c.ByteQuota)
+	}
+	if c.ByteQuota > 0 && c.ByteQuotaWindow <= 0 {
+		return fmt.Errorf("byte-quota-window には正の期間を指定してください: %v", c.ByteQuotaWindow)
+	}
+	if c.MaxBufferedBytes < 0 {
+		return fmt.Errorf("max-buffered-bytes に負の値は指定できません: %d", c.MaxBufferedBytes)
+	}
+	if c.MaxDrainPerWrite < 0 {
+		return fmt.Errorf("max-drain に負の値は指定できません: %d", c.MaxDrainPerWrite)
+	}
+
+	if c.SlowClientWatermark < 0 || c.SlowClientWatermark > sendBufferSize {
+		return fmt.Errorf("slow-watermark は0〜%dの範囲で指定してください: %d", sendBufferSize, c.SlowClientWatermark)
+	}
+	if c.DemoteAfter < 0 {
+		return fmt.Errorf("demote-after に負の値は指定できません: %d", c.DemoteAfter)
+	}
+	if c.DemoteAfter > 0 && c.SlowClientWatermark == 0 {
+		return fmt.Errorf("demote-after には slow-watermark の指定が必要です")
+	}
+	if c.DefaultRateLimit < 0 {
+		return fmt.Errorf("rate-limit-default に負の値は指定できません: %v", c.DefaultRateLimit)
+	}
+	if _, ok := signingAlgorithms[c.SigningAlgorithm]; !ok {
+		return fmt.Errorf("signing-alg には hmac-sha256, hmac-sha512 のいずれかを指定してください: %q", c.SigningAlgorithm)
+	}
+	switch c.UnknownTypePolicy {
+	case unknownTypePassthrough:
+	case unknownTypeDrop, unknownTypeReject:
+		if len(c.MessageTypes) == 0 {
+			return fmt.Errorf("unknown-type-policy=%s には message-types の指定が必要です", c.UnknownTypePolicy)
+		}
+	default:
+		return fmt.Errorf("unknown-type-policy には passthrough, drop, reject のいずれかを指定してください: %q", c.UnknownTypePolicy)
+	}
+	if c.MinProtocolVersion < 0 || c.MinProtocolVersion > protocolVersion {
+		return fmt.Errorf("min-protocol-version は0〜%dの範囲で指定してください: %d", protocolVersion, c.MinProtocolVersion)
+	}
+	if c.SpaceIdleTimeout < 0 {
+		return fmt.Errorf("space-idle-timeout に負の値は指定できません: %v", c.SpaceIdleTimeout)
+	}
+	switch c.SpaceCreation {
+	case "", spaceCreationAuto, spaceCreationDeclared:
+	default:
+		return fmt.Errorf("space-creation には auto, declared のいずれかを指定してください: %q", c.SpaceCreation)
+	}
+	for _, space := range c.Spaces {
+		if !spaceNamePattern.MatchString(space) {
+			return fmt.Errorf("spaces に使えないスペース名が含まれています: %q", space)
+		}
+	}
+
+	if int64(c.ReadBufferSize) < c.ReadLimit {
+		log.Printf("警告: read-buffer(%d)が read-limit(%d)より小さいため、大きなメッセージは複数回に分けて読み込まれます", c.ReadBufferSize, c.ReadLimit)
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseRateLimits(t *testing.T) {
+	limits, err := parseRateLimits("chat=5, typing=20,move=10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]float64{"chat": 5, "typing": 20, "move": 10}
+	if len(limits) != len(want) {
+		t.Fatalf("parseRateLimits = %v, want %v", limits, want)
+	}
+	for typ, rate := range want {
+		if limits[typ] != rate {
+			t.Errorf("%s = %v, want %v", typ, limits[typ], rate)
+		}
+	}
+
+	for _, s := range []string{"=5", " =5", "chat", "chat=0", "chat=-1", "chat=fast"} {
+		if _, err := parseRateLimits(s); err == nil {
+			t.Errorf("parseRateLimits(%q) がエラーになりません", s)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	if err := defaultConfig().validate(); err != nil {
+		t.Fatalf("既定の設定がエラーになります: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		modify func(*Config)
+		// エラーメッセージに含まれるはずのフラグ名
+		flag string
+	}{
+		{"read-bufferが0", func(c *Config) { c.ReadBufferSize = 0 }, "read-buffer"},
+		{"read-bufferが負", func(c *Config) { c.ReadBufferSize = -1 }, "read-buffer"},
+		{"write-bufferが0", func(c *Config) { c.WriteBufferSize = 0 }, "write-buffer"},
+		{"read-limitが0", func(c *Config) { c.ReadLimit = 0 }, "read-limit"},
+		{"read-limitが上限超え", func(c *Config) { c.ReadLimit = maxReadLimit + 1 }, "read-limit"},
+		{"log-windowが負", func(c *Config) { c.LogWindow = -time.Second }, "log-window"},
+		{"shed-thresholdが1", func(c *Config) { c.ShedThreshold = 1 }, "shed-threshold"},
+		{"canary-fractionが1超え", func(c *Config) { c.CanaryFraction = 1.5 }, "canary-fraction"},
+		{"ban-windowなしのban-threshold", func(c *Config) { c.BanThreshold = 3; c.BanWindow = 0 }, "ban-threshold"},
+		{"delivery-workersが0", func(c *Config) { c.DeliveryWorkers = 0 }, "delivery-workers"},
+		{"pause-queue-limitが0", func(c *Config) { c.PauseQueueLimit = 0 }, "pause-queue-limit"},
+		{"load-redがload-yellow未満", func(c *Config) { c.LoadYellow = 10; c.LoadRed = 5 }, "load-red"},
+		{"slow-watermarkが送信バッファ超え", func(c *Config) { c.SlowClientWatermark = sendBufferSize + 1 }, "slow-watermark"},
+		{"slow-watermarkなしのdemote-after", func(c *Config) { c.SlowClientWatermark = 0; c.DemoteAfter = 2 }, "demote-after"},
+		{"不明な署名方式", func(c *Config) { c.SigningAlgorithm = "md5" }, "signing-alg"},
+		{"message-typesなしのreject", func(c *Config) { c.UnknownTypePolicy = unknownTypeReject }, "unknown-type-policy"},
+		{"不明なスペースの作り方", func(c *Config) { c.SpaceCreation = "manual" }, "space-creation"},
+		{"使えないスペース名", func(c *Config) { c.Spaces = []string{"a/b"} }, "spaces"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := defaultConfig()
+			tt.modify(&cfg)
+			err := cfg.validate()
+			if err == nil {
+				t.Fatal("エラーになりません")
+			}
+			if !strings.Contains(err.Error(), tt.flag) {
+				t.Errorf("エラー %q に %s が含まれていません", err, tt.flag)
+			}
+		})
+	}
+}
+
+func TestValidateWarnsWhenReadBufferIsSmallerThanReadLimit(t *testing.T) {
+	logs := captureLog(t)
+	cfg := defaultConfig()
+	cfg.ReadBufferSize = 128
+	cfg.ReadLimit = 512
+	if err := cfg.validate(); err != nil {
+		t.Fatalf("read-bufferがread-limitより小さいだけでエラーになります: %v", err)
+	}
+	if !strings.Contains(logs.String(), "警告: read-buffer(128)が read-limit(512)より小さい") {
+		t.Errorf("警告が出力されません: %q", logs.String())
+	}
+}
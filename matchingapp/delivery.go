@@ -0,0 +1,216 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ブロードキャストを宛先のクライアントへ配る方法
+// 送信バッファがあふれたクライアントをどう扱うかなど、配信の挙動を切り替えるためのもの
+type DeliveryStrategy interface {
+	// clientsの送信バッファへmessageを入れ、入れられた数と切断した数を返す
+	// OutboundFiltersで送らないことになった宛先は、どちらにも数えない
+	// hubのゴルーチンからブロードキャストごとに呼ばれる
+	Deliver(clients []*Client, message []byte) (delivered, evicted int)
+}
+
+// 配信方法の名前(Config.DeliveryStrategy)
+const (
+	// 1人ずつ送信バッファに入れ、あふれたクライアントは切断する(既定)
+	deliveryDisconnectSlow = "disconnect-slow"
+	// 1人ずつ送信バッファに入れ、あふれたクライアントは少しだけ空くのを待ってから切断する
+	deliverySerial = "serial"
+	// 複数のゴルーチンで手分けして送信バッファに入れる。あふれたクライアントは切断する
+	deliveryWorkerPool = "worker-pool"
+	// あふれたクライアントは切断せず、送信バッファで最も古いメッセージを捨てて入れる
+	deliveryDropOldest = "drop-oldest"
+)
+
+// serialで、送信バッファが空くまで1人あたり待つ時間
+// 待つ間はhubが止まるため、短くしておく
+const serialDeliveryWait = 10 * time.Millisecond
+
+// worker-poolで手分けする最小の宛先数。これより少ない場合はゴルーチンを使わない
+const workerPoolMinClients = 256
+
+// 名前を付けた配信方法(Statsとログで名前を出すため)
+type delivery struct {
+	name string
+	strategy DeliveryStrategy
+}
+
+// 名前から配信方法を作る
+// workersはworker-poolで使うゴルーチンの数
+func newDeliveryStrategy(h *Hub, name string, workers int) (DeliveryStrategy, error) {
+	switch name {
+	case deliveryDisconnectSlow:
+		return disconnectSlowDelivery{hub: h}, nil
+	case deliverySerial:
+		return serialDelivery{hub: h}, nil
+	case deliveryWorkerPool:
+		return workerPoolDelivery{hub: h, workers: max(1, workers)}, nil
+	case deliveryDropOldest:
+		return dropOldestDelivery{hub: h}, nil
+	}
+	return nil, fmt.Errorf("配信方法には %s, %s, %s, %s のいずれかを指定してください: %q",
+		deliveryDisconnectSlow, deliverySerial, deliveryWorkerPool, deliveryDropOldest, name)
+}
+
+// 配信方法を差し替える。次のブロードキャストから使われる(どのゴルーチンからでも呼べる)
+// nameはStatsに出す名前
+func (h *Hub) SetDeliveryStrategy(name string, s DeliveryStrategy) {
+	h.delivery.Store(&delivery{name: name, strategy: s})
+}
+
+type disconnectSlowDelivery struct {
+	hub *Hub
+}
+
+func (d disconnectSlowDelivery) Deliver(clients []*Client, message []byte) (delivered, evicted int) {
+	h := d.hub
+	for _, client := range clients {
+		data, ok := h.outboundFor(client, message)
+		if !ok {
+			continue
+		}
+		if h.push(client, data) {
+			delivered++
+		} else {
+			evicted++
+		}
+	}
+	return delivered, evicted
+}
+
+type serialDelivery struct {
+	hub *Hub
+}
+
+func (d serialDelivery) Deliver(clients []*Client, message []byte) (delivered, evicted int) {
+	h := d.hub
+	for _, client := range clients {
+		data, ok := h.outboundFor(client, message)
+		if !ok {
+			continue
+		}
+		if !client.offer(data) {
+			timer := time.NewTimer(serialDeliveryWait)
+			select {
+			case client.send <- outbound{data: data, queuedAt: time.Now()}:
+				client.buffer(1, len(data))
+				timer.Stop()
+			case <-timer.C:
+				h.evict(client)
+				evicted++
+				continue
+			}
+		}
+		h.checkSlow(client)
+		delivered++
+	}
+	return delivered, evicted
+}
+
+type workerPoolDelivery struct {
+	hub *Hub
+	workers int
+}
+
+func (d workerPoolDelivery) Deliver(clients []*Client, message []byte) (delivered, evicted int) {
+	h := d.hub
+	if len(clients) < workerPoolMinClients || d.workers == 1 {
+		return disconnectSlowDelivery{hub: h}.Deliver(clients, message)
+	}
+
+	// OutboundFiltersは利用者の処理のため、ほかのhubの処理と同じくこのゴルーチンで順に実行する
+	// 宛先ごとの内容は、送らない宛先を除いてtargetsと同じ位置に入れる
+	targets, data := clients, [][]byte(nil)
+	if len(h.OutboundFilters) > 0 {
+		targets, data = make([]*Client, 0, len(clients)), make([][]byte, 0, len(clients))
+		for _, client := range clients {
+			if m, ok := h.applyOutboundFilters(client, message); ok {
+				targets = append(targets, client)
+				data = append(data, m)
+			}
+		}
+	}
+
+	// 送信バッファに入れるところだけを手分けし、切断などhubの状態を変える処理は後でまとめて行う
+	full := make([][]*Client, d.workers)
+	chunk := (len(targets) + d.workers - 1) / d.workers
+	var wg sync.WaitGroup
+	for i := 0; i < d.workers; i++ {
+		start, end := i*chunk, min((i+1)*chunk, len(targets))
+		if start >= end {
+			break
+		}
+		wg.Add(1)
+		go func(i, start, end int) {
+			defer wg.Done()
+			for j := start; j < end; j++ {
+				m := message
+				if data != nil {
+					m = data[j]
+				}
+				if !targets[j].offer(m) {
+					full[i] = append(full[i], targets[j])
+				}
+			}
+		}(i, start, end)
+	}
+	wg.Wait()
+
+	for _, part := range full {
+		for _, client := range part {
+			h.evict(client)
+			evicted++
+		}
+	}
+	for _, client := range targets {
+		if h.clients[client] {
+			h.checkSlow(client)
+		}
+	}
+	return len(targets) - evicted, evicted
+}
+
+type dropOldestDelivery struct {
+	hub *Hub
+}
+
+func (d dropOldestDelivery) Deliver(clients []*Client, message []byte) (delivered, evicted int) {
+	h := d.hub
+	for _, client := range clients {
+		data, ok := h.outboundFor(client, message)
+		if !ok {
+			continue
+		}
+		// 送信バッファに入れるのはhubだけのため、1件捨てれば入れられる
+		// (writePumpが先に取り出した場合は捨てずに入る)
+		for !client.offer(data) {
+			if m, ok := client.take(); ok {
+				client.buffer(-1, -len(m.data))
+				h.oldestDrops.Add(1)
+			}
+		}
+		h.checkSlow(client)
+		delivered++
+	}
+	return delivered, 0
+}
+
+// 全スペースのhubの配信方法を差し替える。以降に作るスペースにも使う
+func (r *hubRegistry) SetDeliveryStrategy(name string) error {
+	if _, err := newDeliveryStrategy(nil, name, 0); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cfg.DeliveryStrategy = name
+	for _, hub := range r.hubs {
+		s, _ := newDeliveryStrategy(hub, name, r.cfg.DeliveryWorkers)
+		hub.SetDeliveryStrategy(name, s)
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"testing"
+)
+
+// 配信結果
+type broadcastResult struct {
+	delivered, evicted int
+}
+
+// OnBroadcastで配信結果を受け取るhubを起動する
+func startHubWithResults(t *testing.T, cfg Config, setup func(*Hub)) (*Hub, chan broadcastResult) {
+	t.Helper()
+	results := make(chan broadcastResult, 16)
+	h := startHubWith(t, cfg, func(h *Hub) {
+		h.OnBroadcast = func(seq uint64, delivered, evicted int) {
+			results <- broadcastResult{delivered, evicted}
+		}
+		if setup != nil {
+			setup(h)
+		}
+	})
+	return h, results
+}
+
+func TestDeliveryStrategySwapTakesEffectOnNextBroadcast(t *testing.T) {
+	h, results := startHubWithResults(t, defaultConfig(), nil)
+	c, _ := addFakeClient(t, h)
+	// writePumpを動かさずに送信バッファを満杯にしておく
+	h.do(func() {
+		for c.offer([]byte(`{"type":"old"}`)) {
+		}
+	})
+
+	s, _ := newDeliveryStrategy(h, deliveryDropOldest, 1)
+	h.SetDeliveryStrategy(deliveryDropOldest, s)
+	h.publish([]byte(`{"type":"chat"}`))
+	if r := <-results; r != (broadcastResult{1, 0}) {
+		t.Errorf("drop-oldestでの配信結果 = %+v, want {1 0}", r)
+	}
+	if st := h.Stats(); st.DeliveryStrategy != deliveryDropOldest || st.OldestDrops != 1 || st.Clients != 1 {
+		t.Errorf("drop-oldestに切り替えた後の統計 = strategy %s, oldest_drops %d, clients %d", st.DeliveryStrategy, st.OldestDrops, st.Clients)
+	}
+
+	s, _ = newDeliveryStrategy(h, deliveryDisconnectSlow, 1)
+	h.SetDeliveryStrategy(deliveryDisconnectSlow, s)
+	h.publish([]byte(`{"type":"chat"}`))
+	if r := <-results; r != (broadcastResult{0, 1}) {
+		t.Errorf("disconnect-slowでの配信結果 = %+v, want {0 1}", r)
+	}
+	if st := h.Stats(); st.DeliveryStrategy != deliveryDisconnectSlow || st.Clients != 0 {
+		t.Errorf("disconnect-slowに切り替えた後の統計 = strategy %s, clients %d", st.DeliveryStrategy, st.Clients)
+	}
+}
+
+func TestRegistryDeliveryStrategySwap(t *testing.T) {
+	reg := newHubRegistry(defaultConfig())
+	defer reg.Close()
+	if err := reg.SetDeliveryStrategy("fastest"); err == nil {
+		t.Error("不明な配信方法がエラーになりません")
+	}
+	if err := reg.SetDeliveryStrategy(deliverySerial); err != nil {
+		t.Fatal(err)
+	}
+	hub, _ := reg.get("room1")
+	for space, h := range map[string]*Hub{defaultSpace: reg.all()[defaultSpace], "room1": hub} {
+		if name := h.Stats().DeliveryStrategy; name != deliverySerial {
+			t.Errorf("スペース %s の配信方法 = %s, want %s", space, name, deliverySerial)
+		}
+	}
+}
+
+func TestSuppressedRecipientsAreNotCountedAsDelivered(t *testing.T) {
+	for _, name := range []string{deliveryDisconnectSlow, deliverySerial, deliveryWorkerPool, deliveryDropOldest} {
+		t.Run(name, func(t *testing.T) {
+			cfg := defaultConfig()
+			cfg.DeliveryStrategy = name
+			cfg.DeliveryWorkers = 4
+			// 排他制御なしで数えるため、フィルターが並行して呼ばれると-raceで検出される
+			calls := 0
+			h, results := startHubWithResults(t, cfg, func(h *Hub) {
+				h.OutboundFilters = []OutboundFilter{func(c *Client, m *Message) (*Message, bool) {
+					calls++
+					return m, c.Session() != "muted"
+				}}
+			})
+			// worker-poolが手分けする数まで接続させる
+			n := workerPoolMinClients + 10
+			var muted []*Client
+			for i := 0; i < n; i++ {
+				c, _ := addFakeClient(t, h)
+				if i%3 == 0 {
+					c.SetSession("muted")
+					muted = append(muted, c)
+				}
+			}
+
+			h.publish([]byte(`{"type":"chat"}`))
+			if r := <-results; r != (broadcastResult{n - len(muted), 0}) {
+				t.Errorf("配信結果 = %+v, want {%d 0}", r, n-len(muted))
+			}
+			h.do(func() {
+				if calls != n {
+					t.Errorf("フィルターの呼び出し = %d, want %d", calls, n)
+				}
+				for _, c := range muted {
+					if len(c.send) != 0 {
+						t.Errorf("送らないことにした宛先に %d 件入っています", len(c.send))
+						return
+					}
+				}
+			})
+		})
+	}
+}
+
+func TestBroadcastReportsDeliveredAndEvicted(t *testing.T) {
+	h, results := startHubWithResults(t, defaultConfig(), nil)
+	for i := 0; i < 3; i++ {
+		addFakeClient(t, h)
+	}
+	var full []*Client
+	for i := 0; i < 2; i++ {
+		c, _ := addFakeClient(t, h)
+		full = append(full, c)
+	}
+	// writePumpを動かさずに送信バッファを満杯にしておく
+	h.do(func() {
+		for _, c := range full {
+			for c.offer([]byte(`{"type":"old"}`)) {
+			}
+		}
+	})
+
+	h.publish([]byte(`{"type":"chat"}`))
+	if r := <-results; r != (broadcastResult{3, 2}) {
+		t.Errorf("配信結果 = %+v, want {3 2}", r)
+	}
+	if n := h.ClientCount(); n != 3 {
+		t.Errorf("ClientCount = %d, want 3", n)
+	}
+	// 満杯のクライアントがいなくなれば、全員に届く
+	h.publish([]byte(`{"type":"chat"}`))
+	if r := <-results; r != (broadcastResult{3, 0}) {
+		t.Errorf("2回目の配信結果 = %+v, want {3 0}", r)
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// 受け取ったメッセージをそのまま送り返す(hubを通さない)
+// クライアントやプロキシ、TLSの設定を確認するための診断用
+func serveEcho(readLimit int64, w http.ResponseWriter, r *http.Request) {
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Println("upgradeエラー:", err)
+		return
+	}
+	defer conn.Close()
+
+	// hubのクライアントと同じ制限とタイムアウトを使う
+	conn.SetReadLimit(readLimit)
+	conn.SetReadDeadline(time.Now().Add(pongWait))
+	conn.SetPongHandler(func(string) error {
+		conn.SetReadDeadline(time.Now().Add(pongWait))
+		return nil
+	})
+
+	// pingはWriteControlで送る(WriteControlは他の書き込みと並行して呼べる)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(pingPeriod)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeWait)); err != nil {
+					return
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	for {
+		mt, message, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		conn.SetWriteDeadline(time.Now().Add(writeWait))
+		if err := conn.WriteMessage(mt, message); err != nil {
+			return
+		}
+	}
+}
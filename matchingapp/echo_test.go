@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"app/wstest"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestEchoEndpointRoundTripsData(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.EchoEndpoint = true
+	reg, url := startServer(t, cfg)
+	c := wstest.Dial(t, url+"/ws/echo")
+	defer c.Close()
+
+	// JSONでなくても、改行を含んでいても、受け取ったとおりに返す
+	for _, m := range []struct {
+		typ int
+		data []byte
+	}{
+		{websocket.TextMessage, []byte("hello\nworld")},
+		{websocket.TextMessage, []byte(`{"type":"chat"}`)},
+		{websocket.BinaryMessage, []byte{0x00, 0xff, 0x10}},
+	} {
+		if err := c.Conn.WriteMessage(m.typ, m.data); err != nil {
+			t.Fatal(err)
+		}
+		typ, data, err := c.Conn.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if typ != m.typ || !bytes.Equal(data, m.data) {
+			t.Errorf("送り返されたメッセージ = %d %q, want %d %q", typ, data, m.typ, m.data)
+		}
+	}
+	// hubを通さない
+	if n := reg.ClientCount(); n != 0 {
+		t.Errorf("ClientCount = %d, want 0", n)
+	}
+}
+
+func TestEchoEndpointIsDisabledByDefault(t *testing.T) {
+	_, url := startServer(t, defaultConfig())
+	// 無効の場合は echo という名前のスペースに接続する
+	c := wstest.Dial(t, url+"/ws/echo")
+	defer c.Close()
+	c.Expect("welcome")
+}
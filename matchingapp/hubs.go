@@ -0,0 +1,208 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// /ws に接続したクライアントが入るスペース名
+const defaultSpace = "default"
+
+// 設定で宣言していない場合に自動作成できるスペースの上限
+const maxLazySpaces = 100
+
+// 宣言されていないスペースへの接続時の扱い(Config.SpaceCreation)
+const (
+	// 接続時に作成する
+	spaceCreationAuto = "auto"
+	// 設定か管理用エンドポイントで宣言したスペースにだけ接続できる
+	spaceCreationDeclared = "declared"
+)
+
+// スペース名として使える文字
+var spaceNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// スペース名ごとに独立したhubを管理する
+// 異なるスペースのクライアント同士にはメッセージが届かない
+type hubRegistry struct {
+	mu sync.Mutex
+	cfg Config
+	hubs map[string]*Hub
+
+	// trueの場合、未作成のスペースへの接続時にhubを作成する
+	lazy bool
+
+	// ドレイン中は新しいスペースを作らない
+	draining bool
+
+	// 一時停止中に作成したスペースは一時停止した状態で始める
+	paused bool
+
+	// 全スペースで共有する、接続を禁止するポリシー(nilで禁止しない)
+	bans *banPolicy
+
+	// 接続時に自動で作成したスペース(接続がない状態が続いたら取り除く対象)
+	autoCreated map[string]bool
+
+	// 全スペースのhubで共有する合計
+	totals *hubTotals
+
+	// Closeで閉じる
+	done chan struct{}
+	closeOnce sync.Once
+}
+
+// 設定で宣言されたスペース(と既定のスペース)のhubを作成して起動する
+// スペースが宣言されていない場合は接続時に必要に応じて作成する
+func newHubRegistry(cfg Config) *hubRegistry {
+	r := &hubRegistry{
+		cfg: cfg,
+		hubs: make(map[string]*Hub),
+		autoCreated: make(map[string]bool),
+		lazy: cfg.SpaceCreation == spaceCreationAuto || (cfg.SpaceCreation == "" && len(cfg.Spaces) == 0),
+		bans: newBanPolicy(cfg),
+		totals: newHubTotals(cfg),
+		done: make(chan struct{}),
+	}
+	r.start(defaultSpace)
+	for _, space := range cfg.Spaces {
+		r.start(space)
+	}
+	if cfg.MaxBufferedBytes > 0 {
+		go r.watchMemory()
+	}
+	return r
+}
+
+// hubを作成して起動する。mu を保持した状態か初期化中に呼ぶこと
+func (r *hubRegistry) start(space string) *Hub {
+	if hub, ok := r.hubs[space]; ok {
+		return hub
+	}
+	hub := newHub(r.cfg)
+	hub.paused.Store(r.paused)
+	hub.bans = r.bans
+	hub.totals = r.totals
+	r.hubs[space] = hub
+	go hub.run()
+	return hub
+}
+
+// スペース名に対応するhubを返す
+// 見つからず自動作成もできない場合はfalseを返す
+func (r *hubRegistry) get(space string) (*Hub, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.find(space)
+}
+
+// スペース名に対応するhubを返し、そのhubへの登録待ちの接続として数える(数えた後の数も返す)
+// 接続のないスペースを取り除く処理(reapIdle)と入れ違いにならないよう、見つけてから数えるまでをmuの中で行う
+// 見つからず自動作成もできない場合はfalseを返す
+func (r *hubRegistry) reserve(space string) (*Hub, int64, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	hub, ok := r.find(space)
+	if !ok {
+		return nil, 0, false
+	}
+	return hub, hub.pendingRegistrations.Add(1), true
+}
+
+// スペース名に対応するhubを返す。必要であれば作成する。mu を保持した状態で呼ぶこと
+func (r *hubRegistry) find(space string) (*Hub, bool) {
+	if hub, ok := r.hubs[space]; ok {
+		return hub, true
+	}
+	if !r.lazy || r.draining || len(r.hubs) >= maxLazySpaces || !spaceNamePattern.MatchString(space) {
+		return nil, false
+	}
+	r.autoCreated[space] = true
+	return r.start(space), true
+}
+
+// スペースを宣言してhubを作成する。作成した場合はtrue、既にあった場合はfalseを返す
+// 自動作成の上限は適用しない
+func (r *hubRegistry) declare(space string) (bool, error) {
+	if !spaceNamePattern.MatchString(space) {
+		return false, fmt.Errorf("使えないスペース名です: %q", space)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.hubs[space]; ok {
+		// 宣言したスペースは、接続がなくても取り除かない
+		delete(r.autoCreated, space)
+		return false, nil
+	}
+	if r.draining {
+		return false, errors.New("ドレイン中はスペースを作成できません")
+	}
+	r.start(space)
+	return true, nil
+}
+
+// 全てのhubのスナップショットを返す
+func (r *hubRegistry) all() map[string]*Hub {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	hubs := make(map[string]*Hub, len(r.hubs))
+	for space, hub := range r.hubs {
+		hubs[space] = hub
+	}
+	return hubs
+}
+
+// 接続時に自動で作成したスペースのうち、接続がない状態がtimeoutより長く続いたものを定期的に取り除く
+// 取り除いた後に同じ名前で接続があった場合は、新しく作成する
+func (r *hubRegistry) reapIdleSpaces(timeout time.Duration) {
+	ticker := time.NewTicker(max(timeout/2, time.Second))
+	defer ticker.Stop()
+	for now := range ticker.C {
+		r.reapIdle(now, timeout)
+	}
+}
+
+// 接続時に自動で作成したスペースのうち、nowの時点で接続がない状態がtimeoutより長く続いたものを取り除く
+func (r *hubRegistry) reapIdle(now time.Time, timeout time.Duration) {
+	r.mu.Lock()
+	var idle []*Hub
+	for space := range r.autoCreated {
+		hub := r.hubs[space]
+		// 接続がなくなった時刻は定期的にしか記録しないため、直前に登録したクライアントがいないかも確かめる
+		// 登録待ちの接続はreserveがmuの中で数えるため、ここで0であれば取り除いた後に振り分けられることはない
+		if hub.emptyFor(now) < timeout || hub.ClientCount() > 0 || hub.pendingRegistrations.Load() > 0 {
+			continue
+		}
+		delete(r.hubs, space)
+		delete(r.autoCreated, space)
+		idle = append(idle, hub)
+		log.Printf("接続がない状態が%vより長く続いたため、スペースを取り除きました: %s", timeout, space)
+	}
+	r.mu.Unlock()
+	for _, hub := range idle {
+		hub.Close()
+	}
+}
+
+// 全てのhubを停止する
+func (r *hubRegistry) Close() {
+	r.closeOnce.Do(func() { close(r.done) })
+	for _, hub := range r.all() {
+		hub.Close()
+	}
+}
+
+// URLのスペース名に対応するhubにWebSocket接続を振り分ける
+func serveSpace(reg *hubRegistry, w http.ResponseWriter, r *http.Request) {
+	hub, pending, ok := reg.reserve(r.PathValue("space"))
+	if !ok {
+		http.Error(w, "space not found", http.StatusNotFound)
+		return
+	}
+	serveReserved(hub, pending, w, r)
+}
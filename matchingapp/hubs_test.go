@@ -0,0 +1,152 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"app/wstest"
+)
+
+func TestIdleSpaceIsReapedAndRecreatedOnRejoin(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.SpaceIdleTimeout = time.Minute
+	reg, url := startServer(t, cfg)
+
+	c := wstest.Dial(t, url+"/ws/match1")
+	c.Expect("welcome")
+	first := reg.all()["match1"]
+	// 接続中のスペースは、接続がなくなった時刻が古いままでも取り除かない
+	reg.reapIdle(time.Now().Add(time.Hour), cfg.SpaceIdleTimeout)
+	if reg.all()["match1"] != first {
+		t.Fatal("接続中のスペースが取り除かれました")
+	}
+
+	c.Close()
+	eventually(t, "切断", func() bool { return first.ClientCount() == 0 })
+	first.do(func() { first.markEmpty(time.Now()) })
+	reg.reapIdle(time.Now(), cfg.SpaceIdleTimeout)
+	if reg.all()["match1"] != first {
+		t.Fatal("タイムアウト前にスペースが取り除かれました")
+	}
+	reg.reapIdle(time.Now().Add(2*time.Minute), cfg.SpaceIdleTimeout)
+	if _, ok := reg.all()["match1"]; ok {
+		t.Fatal("接続のないスペースが取り除かれていません")
+	}
+	if first.do(func() {}) {
+		t.Error("取り除いたスペースのhubが停止していません")
+	}
+
+	// 同じ名前で接続し直すと、新しいhubで作り直される
+	again := wstest.Dial(t, url+"/ws/match1")
+	defer again.Close()
+	again.Expect("welcome")
+	second := reg.all()["match1"]
+	if second == nil || second == first {
+		t.Fatalf("接続し直したスペースのhub = %p, 取り除いたhub = %p", second, first)
+	}
+	reg.reapIdle(time.Now().Add(time.Hour), cfg.SpaceIdleTimeout)
+	if reg.all()["match1"] != second {
+		t.Error("接続し直したスペースが取り除かれました")
+	}
+}
+
+func TestReservedSpaceIsNotReaped(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.SpaceIdleTimeout = time.Minute
+	reg := newHubRegistry(cfg)
+	defer reg.Close()
+
+	hub, pending, ok := reg.reserve("match1")
+	if !ok || pending != 1 {
+		t.Fatalf("reserve = %v, %d, want true, 1", ok, pending)
+	}
+	hub.do(func() { hub.markEmpty(time.Now()) })
+	// 振り分けた接続がまだ登録されていない間は取り除かない
+	reg.reapIdle(time.Now().Add(time.Hour), cfg.SpaceIdleTimeout)
+	if reg.all()["match1"] != hub {
+		t.Fatal("登録待ちの接続があるスペースが取り除かれました")
+	}
+	hub.pendingRegistrations.Add(-1)
+	reg.reapIdle(time.Now().Add(time.Hour), cfg.SpaceIdleTimeout)
+	if _, ok := reg.all()["match1"]; ok {
+		t.Fatal("登録待ちがなくなった後もスペースが取り除かれていません")
+	}
+}
+
+func TestSpacesAreIsolated(t *testing.T) {
+	reg, url := startServer(t, defaultConfig())
+	alice := wstest.Dial(t, url+"/ws/room1")
+	defer alice.Close()
+	bob := wstest.Dial(t, url+"/ws/room1")
+	defer bob.Close()
+	carol := wstest.Dial(t, url+"/ws/room2")
+	defer carol.Close()
+	for _, c := range []*wstest.Client{alice, bob, carol} {
+		c.Expect("welcome")
+	}
+	if reg.all()["room1"] == reg.all()["room2"] {
+		t.Fatal("別のスペースが同じhubを使っています")
+	}
+
+	alice.SendJSON(map[string]any{"type": "chat", "text": "room1だけ"})
+	if m := bob.Expect("chat"); m["text"] != "room1だけ" {
+		t.Errorf("同じスペースで受信したメッセージ = %v", m)
+	}
+	carol.SendJSON(map[string]any{"type": "chat", "text": "room2だけ"})
+	if m := carol.Expect("chat"); m["text"] != "room2だけ" {
+		t.Errorf("room2の送信者が受信したメッセージ = %v", m)
+	}
+	// room2のメッセージはroom1に届かない(room1の次のメッセージは自分の送信分)
+	if m := alice.Expect("chat"); m["text"] != "room1だけ" {
+		t.Errorf("room1で受信したメッセージ = %v", m)
+	}
+	for _, c := range []*wstest.Client{alice, bob} {
+		c.Timeout = 200 * time.Millisecond
+		c.ExpectNothing()
+	}
+}
+
+func TestSpaceCreationPolicies(t *testing.T) {
+	t.Run(spaceCreationAuto, func(t *testing.T) {
+		reg, url := startServer(t, defaultConfig())
+		c := wstest.Dial(t, url+"/ws/anything")
+		defer c.Close()
+		c.Expect("welcome")
+		if _, ok := reg.all()["anything"]; !ok {
+			t.Error("接続したスペースが作成されていません")
+		}
+		if _, resp, err := wstest.DialErr(t, url+"/ws/bad.name"); err == nil || resp == nil || resp.StatusCode != http.StatusNotFound {
+			t.Errorf("使えないスペース名への接続: err=%v resp=%v, want 404", err, resp)
+		}
+	})
+
+	t.Run(spaceCreationDeclared, func(t *testing.T) {
+		cfg := defaultConfig()
+		cfg.AdminToken = "secret"
+		cfg.SpaceCreation = spaceCreationDeclared
+		cfg.Spaces = []string{"lobby"}
+		reg, url := startServer(t, cfg)
+		c := wstest.Dial(t, url+"/ws/lobby")
+		defer c.Close()
+		c.Expect("welcome")
+		// 宣言していないスペースには接続できず、作成もされない
+		if _, resp, err := wstest.DialErr(t, url+"/ws/match1"); err == nil || resp == nil || resp.StatusCode != http.StatusNotFound {
+			t.Errorf("宣言していないスペースへの接続: err=%v resp=%v, want 404", err, resp)
+		}
+		if _, ok := reg.all()["match1"]; ok {
+			t.Error("宣言していないスペースが作成されました")
+		}
+
+		// 管理用のエンドポイントで宣言すると接続できる
+		if resp := adminRequest(t, "POST", httpURL(url)+"/admin/spaces/match1", "secret"); resp.StatusCode != http.StatusCreated {
+			t.Fatalf("スペースの宣言: status = %d, want 201", resp.StatusCode)
+		}
+		if resp := adminRequest(t, "POST", httpURL(url)+"/admin/spaces/match1", "secret"); resp.StatusCode != http.StatusOK {
+			t.Errorf("宣言済みのスペースの宣言: status = %d, want 200", resp.StatusCode)
+		}
+		again := wstest.Dial(t, url+"/ws/match1")
+		defer again.Close()
+		again.Expect("welcome")
+	})
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"net/netip"
+	"os"
+	"strings"
+)
+
+// 接続を許可/拒否するIPアドレスの範囲
+// 拒否の範囲に含まれるアドレスは常に拒否し、許可の範囲がある場合はそのどれかに含まれるアドレスだけを許可する
+type ipFilter struct {
+	allow []netip.Prefix
+	deny []netip.Prefix
+}
+
+// pathのファイルから接続を許可/拒否する範囲を読み込む
+// ファイルには1行に1つ "allow <CIDR>" か "deny <CIDR>" を書く(空行と#で始まる行は無視する)
+// CIDRの代わりにIPアドレスだけを書いた場合は、そのアドレスだけを指す
+func loadIPFilter(path string) (*ipFilter, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	f := &ipFilter{}
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		action, value, _ := strings.Cut(line, " ")
+		prefix, err := parsePrefix(strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, i+1, err)
+		}
+		switch action {
+		case "allow":
+			f.allow = append(f.allow, prefix)
+		case "deny":
+			f.deny = append(f.deny, prefix)
+		default:
+			return nil, fmt.Errorf("%s:%d: allow <CIDR> か deny <CIDR> の形式で指定してください: %q", path, i+1, line)
+		}
+	}
+	return f, nil
+}
+
+// CIDRかIPアドレスを解析する
+func parsePrefix(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			return netip.Prefix{}, fmt.Errorf("CIDRが不正です: %q", s)
+		}
+		return prefix.Masked(), nil
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("IPアドレスが不正です: %q", s)
+	}
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// ipからの接続を許可するかを返す
+// IPアドレスが分からない接続(Unixドメインソケットなど)には適用しない
+func (f *ipFilter) allowed(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if f == nil || err != nil {
+		return true
+	}
+	addr = addr.Unmap()
+	for _, p := range f.deny {
+		if p.Contains(addr) {
+			return false
+		}
+	}
+	if len(f.allow) == 0 {
+		return true
+	}
+	for _, p := range f.allow {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"app/wstest"
+)
+
+func writeIPFilter(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "ipfilter")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestIPFilterAllowsAndDenies(t *testing.T) {
+	f, err := loadIPFilter(writeIPFilter(t, `
+# 社内ネットワークだけを許可する
+allow 10.0.0.0/8
+allow 2001:db8::/32
+deny 10.0.5.0/24
+deny 10.1.2.3
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for ip, want := range map[string]bool{
+		"10.0.0.1": true,
+		"2001:db8::1": true,
+		// IPv4射影アドレスもIPv4として扱う
+		"::ffff:10.0.0.1": true,
+		// 拒否の範囲は許可の範囲より優先する
+		"10.0.5.9": false,
+		"10.1.2.3": false,
+		"10.1.2.4": true,
+		// 許可の範囲に含まれない
+		"192.168.0.1": false,
+		"2001:db9::1": false,
+		// IPアドレスが分からない接続には適用しない
+		"": true,
+	} {
+		if got := f.allowed(ip); got != want {
+			t.Errorf("allowed(%q) = %v, want %v", ip, got, want)
+		}
+	}
+
+	// 拒否の範囲だけの場合は、それ以外を許可する
+	f, err = loadIPFilter(writeIPFilter(t, "deny 192.168.0.0/16\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !f.allowed("10.0.0.1") || f.allowed("192.168.1.1") {
+		t.Error("拒否の範囲だけの場合に、範囲外を許可し範囲内を拒否するはずです")
+	}
+}
+
+func TestLoadIPFilterRejectsInvalidLines(t *testing.T) {
+	for _, content := range []string{
+		"allow 10.0.0.0/33\n",
+		"deny not-an-ip\n",
+		"permit 10.0.0.1\n",
+	} {
+		if _, err := loadIPFilter(writeIPFilter(t, content)); err == nil {
+			t.Errorf("%q がエラーになりません", content)
+		}
+	}
+}
+
+func TestConnectionFromFilteredIPIsRejected(t *testing.T) {
+	for _, tc := range []struct {
+		content string
+		status int
+	}{
+		{"allow 127.0.0.0/8\n", http.StatusSwitchingProtocols},
+		{"allow 10.0.0.0/8\n", http.StatusForbidden},
+		{"deny 127.0.0.1\n", http.StatusForbidden},
+	} {
+		f, err := loadIPFilter(writeIPFilter(t, tc.content))
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg := defaultConfig()
+		cfg.IPFilter = f
+		reg, url := startServer(t, cfg)
+		c, resp, err := wstest.DialErr(t, url+"/ws")
+		if resp == nil || resp.StatusCode != tc.status {
+			t.Errorf("%q での接続: err=%v resp=%v, want %d", tc.content, err, resp, tc.status)
+		}
+		if c != nil {
+			c.Close()
+			continue
+		}
+		if n := reg.all()[defaultSpace].Stats().IPRejects; n != 1 {
+			t.Errorf("%q での IPRejects = %d, want 1", tc.content, n)
+		}
+	}
+}
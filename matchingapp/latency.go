@@ -0,0 +1,68 @@
+package main
+
+import (
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// 往復時間のヒストグラムの区切り(各区切り以下の件数を数え、最後の区切りを超えたものは+Infに数える)
+var latencyBuckets = [...]time.Duration{
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2500 * time.Millisecond,
+}
+
+// pingからpongまでの往復時間のヒストグラム(どのゴルーチンからでも使える)
+type latencyHistogram struct {
+	counts [len(latencyBuckets) + 1]atomic.Uint64
+}
+
+func (l *latencyHistogram) observe(d time.Duration) {
+	i := 0
+	for i < len(latencyBuckets) && d > latencyBuckets[i] {
+		i++
+	}
+	l.counts[i].Add(1)
+}
+
+// 区切りごとの件数を返す(累積ではない)
+func (l *latencyHistogram) snapshot() map[string]uint64 {
+	s := make(map[string]uint64, len(l.counts))
+	for i, b := range latencyBuckets {
+		s[b.String()] = l.counts[i].Load()
+	}
+	s["+Inf"] = l.counts[len(latencyBuckets)].Load()
+	return s
+}
+
+// pingのペイロードに送信時刻を入れておき、pongで返ってきた値から往復時間を計る
+func pingPayload(now time.Time) []byte {
+	return strconv.AppendInt(nil, now.UnixNano(), 10)
+}
+
+// pongのペイロードから往復時間を計って記録する
+// こちらから送ったpingへの応答でないpong(ペイロードが時刻でないもの)や、
+// ありえない値(負、またはpongWaitより長い)は無視する
+func (c *Client) recordRTT(appData string, now time.Time) {
+	sent, err := strconv.ParseInt(appData, 10, 64)
+	if err != nil {
+		return
+	}
+	rtt := now.Sub(time.Unix(0, sent))
+	if rtt < 0 || rtt > pongWait {
+		return
+	}
+	c.rtt.Store(int64(rtt))
+	c.hub.latency.observe(rtt)
+}
+
+// 最後に計った往復時間を返す。まだ計っていない場合は0
+func (c *Client) RTT() time.Duration {
+	return time.Duration(c.rtt.Load())
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRecordRTTFromPingPayload(t *testing.T) {
+	h := newHub(defaultConfig())
+	c, _ := newFakeClient(h)
+	sent := time.Now()
+
+	tests := []struct {
+		delay time.Duration
+		bucket string
+	}{
+		{5 * time.Millisecond, "10ms"},
+		{80 * time.Millisecond, "100ms"},
+		{3 * time.Second, "+Inf"},
+	}
+	for _, tt := range tests {
+		c.recordRTT(string(pingPayload(sent)), sent.Add(tt.delay))
+		if rtt := c.RTT(); rtt != tt.delay {
+			t.Errorf("RTT = %v, want %v", rtt, tt.delay)
+		}
+	}
+	want := map[string]uint64{"10ms": 1, "100ms": 1, "+Inf": 1}
+	for bucket, n := range h.latency.snapshot() {
+		if n != want[bucket] {
+			t.Errorf("ヒストグラムの %s = %d, want %d", bucket, n, want[bucket])
+		}
+	}
+
+	// こちらから送ったpingへの応答でないpongや、ありえない往復時間は記録しない
+	last := c.RTT()
+	for name, pong := range map[string]struct {
+		payload string
+		at time.Time
+	}{
+		"ペイロードなし": {"", sent},
+		"時刻でないペイロード": {"keepalive", sent},
+		"送信より前": {string(pingPayload(sent)), sent.Add(-time.Second)},
+		"pongWaitより後": {string(pingPayload(sent)), sent.Add(pongWait + time.Second)},
+	} {
+		c.recordRTT(pong.payload, pong.at)
+		if c.RTT() != last {
+			t.Errorf("%s: RTT = %v, want %vのまま", name, c.RTT(), last)
+		}
+	}
+	total := uint64(0)
+	for _, n := range h.latency.snapshot() {
+		total += n
+	}
+	if total != 3 {
+		t.Errorf("ヒストグラムの合計 = %d, want 3", total)
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"time"
+)
+
+// Unixドメインソケットで待ち受ける
+// 前回の起動で残ったソケットファイルがあれば削除し、作成したソケットの権限をmodeにする
+func listenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s はソケットファイルではないため削除できません", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
+
+// キープアライブを設定できる接続(*net.TCPConn)
+type keepAliveConn interface {
+	SetKeepAlive(keepalive bool) error
+	SetKeepAlivePeriod(d time.Duration) error
+}
+
+// TCP接続のキープアライブを設定する
+// periodが正の値の場合は有効にしてその間隔で送り、負の値の場合は無効にする
+// 0の場合やTCP以外の接続(Unixドメインソケットなど)では何もしない
+func setKeepAlive(c net.Conn, period time.Duration) error {
+	tc, ok := c.(keepAliveConn)
+	if !ok || period == 0 {
+		return nil
+	}
+	if period < 0 {
+		return tc.SetKeepAlive(false)
+	}
+	if err := tc.SetKeepAlive(true); err != nil {
+		return err
+	}
+	return tc.SetKeepAlivePeriod(period)
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestServeOverUnixSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ws.sock")
+	// 前回の起動で残ったソケットファイル
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	ln, err := listenUnix(path, 0o660)
+	if err != nil {
+		t.Fatalf("残ったソケットファイルがあると待ち受けられません: %v", err)
+	}
+	if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != 0o660 {
+		t.Errorf("ソケットファイルの権限 = %v (%v), want 0660", fi.Mode().Perm(), err)
+	}
+	cfg := defaultConfig()
+	reg := newHubRegistry(cfg)
+	srv := &http.Server{Handler: newMux(cfg, reg)}
+	go srv.Serve(ln)
+	t.Cleanup(func() {
+		srv.Close()
+		reg.Close()
+	})
+
+	dialer := websocket.Dialer{NetDial: func(network, addr string) (net.Conn, error) {
+		return net.Dial("unix", path)
+	}}
+	conn, _, err := dialer.Dial("ws://localhost/ws", nil)
+	if err != nil {
+		t.Fatalf("Unixドメインソケット経由で接続できません: %v", err)
+	}
+	defer conn.Close()
+	var m map[string]any
+	if err := conn.ReadJSON(&m); err != nil || m["type"] != "welcome" {
+		t.Fatalf("最初のメッセージ = %v (%v), want welcome", m, err)
+	}
+	conn.WriteMessage(websocket.TextMessage, []byte(`{"type":"chat","text":"unix"}`))
+	_, data, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(data, &m); err != nil || m["text"] != "unix" {
+		t.Errorf("受信したメッセージ = %s, want 送信したchat", data)
+	}
+}
+
+func TestListenUnixKeepsNonSocketFiles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ws.sock")
+	if err := os.WriteFile(path, []byte("data"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := listenUnix(path, 0o660); err == nil {
+		t.Fatal("ソケットファイルではないファイルがあるのに待ち受けました")
+	}
+	if b, err := os.ReadFile(path); err != nil || string(b) != "data" {
+		t.Errorf("ソケットファイルではないファイルが削除されました: %v", err)
+	}
+}
+
+// キープアライブの設定を記録する接続
+type keepAliveRecorder struct {
+	net.Conn
+	calls []string
+}
+
+func (c *keepAliveRecorder) SetKeepAlive(keepalive bool) error {
+	c.calls = append(c.calls, fmt.Sprintf("SetKeepAlive(%v)", keepalive))
+	return nil
+}
+
+func (c *keepAliveRecorder) SetKeepAlivePeriod(d time.Duration) error {
+	c.calls = append(c.calls, fmt.Sprintf("SetKeepAlivePeriod(%v)", d))
+	return nil
+}
+
+func TestSetKeepAliveAppliesConfiguredPeriod(t *testing.T) {
+	tests := []struct {
+		name string
+		period time.Duration
+		want []string
+	}{
+		{"有効", 15 * time.Second, []string{"SetKeepAlive(true)", "SetKeepAlivePeriod(15s)"}},
+		{"無効", -1, []string{"SetKeepAlive(false)"}},
+		{"既定のまま", 0, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &keepAliveRecorder{}
+			if err := setKeepAlive(c, tt.period); err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(c.calls, tt.want) {
+				t.Errorf("設定 = %v, want %v", c.calls, tt.want)
+			}
+		})
+	}
+
+	// キープアライブを設定できない接続では何もしない
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+	if err := setKeepAlive(server, time.Second); err != nil {
+		t.Errorf("net.Pipeの接続でエラーになりました: %v", err)
+	}
+}
+
+func TestSetKeepAliveOnTCPConn(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		if c, err := ln.Accept(); err == nil {
+			c.Close()
+		}
+	}()
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, ok := c.(keepAliveConn); !ok {
+		t.Fatal("*net.TCPConnにキープアライブを設定できません")
+	}
+	if err := setKeepAlive(c, 15*time.Second); err != nil {
+		t.Errorf("TCP接続にキープアライブを設定できません: %v", err)
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// サーバーの負荷の段階
+// クライアントはこれを見て、再接続を遅らせたり送信を減らしたりできる
+const (
+	loadGreen = "green"
+	loadYellow = "yellow"
+	loadRed = "red"
+)
+
+// 負荷の変化を知らせるフレーム
+type loadFrame struct {
+	Type string `json:"type"`
+	Level string `json:"level"`
+	// 全スペースの接続中のクライアント数
+	Clients int64 `json:"clients"`
+}
+
+func loadMessage(level string, clients int64) []byte {
+	b, _ := json.Marshal(loadFrame{Type: "load", Level: level, Clients: clients})
+	return b
+}
+
+// 全スペースの接続中のクライアント数としきい値から、現在の負荷の段階を返す
+// スペースごとに数えると、スペースが多い場合にサーバー全体が混んでいても低く見えるため、全体で数える
+// しきい値が設定されていない場合は空文字を返す
+func (h *Hub) loadLevel() string {
+	if h.loadYellow <= 0 && h.loadRed <= 0 {
+		return ""
+	}
+	n := int(h.totals.clients.Load())
+	switch {
+	case h.loadRed > 0 && n >= h.loadRed:
+		return loadRed
+	case h.loadYellow > 0 && n >= h.loadYellow:
+		return loadYellow
+	}
+	return loadGreen
+}
+
+// 負荷の段階が変わっていれば接続中の全クライアントに知らせる。hubのゴルーチンからのみ呼ぶこと
+// 段階がしきい値の前後で行き来しても騒がしくならないよう、知らせる間隔をloadIntervalより空ける
+func (h *Hub) updateLoad(now time.Time) {
+	level := h.loadLevel()
+	if level == "" || level == h.announcedLoad || now.Sub(h.loadAnnouncedAt) < h.loadInterval {
+		return
+	}
+	h.announcedLoad, h.loadAnnouncedAt = level, now
+	h.enqueueAll(loadMessage(level, h.totals.clients.Load()))
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"app/wstest"
+)
+
+func TestLoadLevelReflectsThresholds(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.LoadYellow = 2
+	cfg.LoadRed = 4
+	h := startHub(t, cfg)
+	for i, want := range []string{loadGreen, loadGreen, loadYellow, loadYellow, loadRed} {
+		if i > 0 {
+			addFakeClient(t, h)
+		}
+		if got := h.Stats().Load; got != want {
+			t.Errorf("接続数 %d の負荷 = %q, want %q", i, got, want)
+		}
+	}
+
+	// しきい値を設定しなければ負荷は知らせない
+	if got := startHub(t, defaultConfig()).loadLevel(); got != "" {
+		t.Errorf("しきい値なしの負荷 = %q, want 空", got)
+	}
+}
+
+func TestLoadLevelCountsClientsInAllSpaces(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.LoadYellow = 2
+	cfg.LoadUpdateInterval = 0
+	reg := newHubRegistry(cfg)
+	defer reg.Close()
+	room1 := reg.all()[defaultSpace]
+	room2, _ := reg.get("room2")
+	c, _ := addFakeClient(t, room1)
+	addFakeClient(t, room2)
+
+	// どちらのスペースも1クライアントだが、全体では2クライアントなのでyellowになる
+	for space, h := range map[string]*Hub{defaultSpace: room1, "room2": room2} {
+		if got := h.Stats().Load; got != loadYellow {
+			t.Errorf("スペース %s の負荷 = %q, want %q", space, got, loadYellow)
+		}
+	}
+	room1.do(func() {
+		for len(c.send) > 0 {
+			<-c.send
+		}
+		room1.announcedLoad = ""
+		room1.updateLoad(time.Now())
+		m, ok := c.take()
+		if got, want := string(m.data), string(loadMessage(loadYellow, 2)); !ok || got != want {
+			t.Errorf("負荷のお知らせ = %s, want %s", got, want)
+		}
+	})
+}
+
+func TestLoadUpdatesAreThrottled(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.LoadYellow = 2
+	cfg.LoadUpdateInterval = time.Minute
+	h := startHub(t, cfg)
+	c, _ := addFakeClient(t, h)
+	now := time.Now()
+	h.do(func() {
+		// 定期的な確認で知らせた分は数えないよう、まだ知らせていない状態から始める
+		for len(c.send) > 0 {
+			<-c.send
+		}
+		h.announcedLoad, h.loadAnnouncedAt = "", time.Time{}
+		h.updateLoad(now)
+		if n := len(c.send); n != 1 {
+			t.Errorf("最初の負荷のお知らせ = %d 件, want 1", n)
+		}
+		// 段階が変わらなければ知らせない
+		h.updateLoad(now.Add(2 * time.Minute))
+		if n := len(c.send); n != 1 {
+			t.Errorf("段階が変わらないのに知らせました: %d 件", n)
+		}
+	})
+	addFakeClient(t, h)
+	h.do(func() {
+		// 段階が変わっても、間隔を空けるまでは知らせない
+		h.updateLoad(now.Add(time.Second))
+		if n := len(c.send); n != 1 {
+			t.Errorf("間隔を空けずに知らせました: %d 件", n)
+		}
+		h.updateLoad(now.Add(time.Minute))
+		if n := len(c.send); n != 2 {
+			t.Errorf("間隔を空けた後の負荷のお知らせ = %d 件, want 2", n)
+		}
+	})
+}
+
+func TestWelcomeIncludesLoad(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.LoadYellow = 1
+	_, url := startServer(t, cfg)
+	first := wstest.Dial(t, url+"/ws")
+	defer first.Close()
+	if m := first.Expect("welcome"); m["load"] != loadGreen {
+		t.Errorf("最初のクライアントへのwelcomeの負荷 = %v, want %s", m["load"], loadGreen)
+	}
+	// welcomeの負荷は、接続してきたクライアントを数える前の接続数から決まる
+	c := wstest.Dial(t, url+"/ws")
+	defer c.Close()
+	if m := c.Expect("welcome"); m["load"] != loadYellow {
+		t.Errorf("welcomeの負荷 = %v, want %s", m["load"], loadYellow)
+	}
+}
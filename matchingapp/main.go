@@ -1,8 +1,17 @@
 package main
 
 import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
 	"log"
+	"net"
 	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -18,12 +27,176 @@ var upgrader = websocket.Upgrader{
 	},
 }
 
+// 接続のタイムアウト設定
+const (
+	// pongを待つ時間。これを過ぎても何も届かなければ切断する
+	pongWait = 60 * time.Second
+	// pingを送る間隔(pongWaitより短くする)
+	pingPeriod = 54 * time.Second
+	// 1回の書き込みにかけられる時間
+	writeWait = 10 * time.Second
+)
+
+// クライアントごとの送信バッファの大きさ
+const sendBufferSize = 256
+
+// クライアントからクローズされた後、送信バッファに残ったメッセージを送り切るまでの猶予
+const closeFlushTimeout = 2 * time.Second
+
+// Clientが使うWebSocket接続の操作
+// 本番では*websocket.Connをそのまま使う。pumpを実際のソケットなしで動かしたい場合は、
+// 書き込みエラーなどを起こせる偽物を差し替えられる
+type wsConn interface {
+	ReadMessage() (messageType int, p []byte, err error)
+	NextWriter(messageType int) (io.WriteCloser, error)
+	WriteMessage(messageType int, data []byte) error
+	SetReadLimit(limit int64)
+	SetReadDeadline(t time.Time) error
+	SetWriteDeadline(t time.Time) error
+	SetPongHandler(h func(appData string) error)
+	SetCloseHandler(h func(code int, text string) error)
+	EnableWriteCompression(enable bool)
+	Close() error
+}
+
+var _ wsConn = (*websocket.Conn)(nil)
+
 // 各接続ユーザーを表す
 type Client struct {
 	hub *Hub
-	conn *websocket.Conn
+
+	// 接続ごとに割り当てるID
+	id string
+
+	// gorilla/websocketは同じ接続への並行書き込みを許さないため、
+	// connへの書き込みは必ずwritePumpのゴルーチンから行う
+	// 他のゴルーチンからクライアントへ送りたい場合は、sendチャネル(hub経由のsendTo等)を使うこと
+	conn wsConn
+
+	// connへ書き込み中か。上記の約束が破られたことを検出するために使う(beginWrite)
+	writing atomic.Bool
+
 	//　送信用チャネル
-	send chan []byte
+	send chan outbound
+
+	// trueの場合は受信専用(表示端末など)。ブロードキャストは届くが送信はできない
+	readonly bool
+
+	// クライアントが申告したプロトコルバージョン(申告がなければ0)
+	version int
+
+	// クライアントが接続時に申告した、受け取れるメッセージの種類(types=a,b)
+	// nilの場合は申告なしとして、プロトコルバージョンだけで判断する
+	types map[string]bool
+
+	// 接続元のIPアドレス(分からない場合は空文字)
+	ip string
+
+	// 接続した時刻
+	connectedAt time.Time
+
+	// 最後に計ったpingの往復時間(RTTで読める)
+	rtt atomic.Int64
+
+	// 新しい動作を一部の接続だけで試すための目印(Canaryで読める)
+	canary bool
+
+	// 接続元(Originヘッダー)と、この接続に適用する受信レート上限(接続元によって変わる)
+	// ratesはreadPumpのゴルーチンのみが更新する
+	origin string
+	rates RateProfile
+
+	// 送信バッファが警告水位を超えていることを通知済みか(hubのゴルーチンのみが触る)
+	slow bool
+
+	// 送信バッファに溜まっているメッセージの件数とバイト数と、
+	// hubからの登録解除とwritePumpの終了のうち済んだ数(settleで使う)
+	queued atomic.Int64
+	buffered atomic.Int64
+	settled atomic.Int32
+
+	// 送信バッファが警告水位を超えた回数と、ブロードキャストを送らないことにしたか
+	// (hubのゴルーチンのみが触る)
+	slowHits int
+	unicastOnly bool
+
+	// クライアントからクローズフレームが届いた場合の、送信バッファを送り切る期限(UnixNano、0は未設定)
+	flushUntil atomic.Int64
+
+	// 書き込み中のバッチの先頭(最も古い)メッセージが送信バッファに入った時刻(UnixNano、0は書き込み中でない)
+	// バッチを組むときにバッファを空にするため、これがクライアントの未配信メッセージで最も古いものになる
+	writingSince atomic.Int64
+
+	// trueの場合はメッセージをMessagePackのバイナリフレームでやり取りする(format=msgpack)
+	msgpack bool
+
+	// この接続でpermessage-deflateがネゴシエートされたか
+	// サーバー側で圧縮を有効にしていても、対応していないクライアントには圧縮しない
+	compress bool
+
+	// コールバック等の利用者が接続ごとに持たせる任意のデータ(SetSession/Sessionで読み書きする)
+	// 中身は利用者のもので、hubは読み書きしない
+	sessionMu sync.Mutex
+	session any
+
+	// 切断理由。hubがsendを閉じる直前に設定し、
+	// writePumpはsendが閉じられたのを確認してから読む
+	closeReason string
+}
+
+// 接続ごとの任意のデータを設定する(どのゴルーチンからでも呼べる)
+// ゲームの状態など、クライアントをキーにした別のmapを持たずに済むようにするためのもの
+// 保持したデータ自体の排他制御は利用者が行うこと
+func (c *Client) SetSession(v any) {
+	c.sessionMu.Lock()
+	c.session = v
+	c.sessionMu.Unlock()
+}
+
+// カナリアとして選ばれた接続であればtrueを返す
+// MiddlewareやOutboundFiltersで、新しい動作をこの接続だけで有効にするのに使う
+func (c *Client) Canary() bool {
+	return c.canary
+}
+
+// SetSessionで設定したデータを返す。未設定の場合はnil
+func (c *Client) Session() any {
+	c.sessionMu.Lock()
+	defer c.sessionMu.Unlock()
+	return c.session
+}
+
+// 条件に合うクライアントにだけ送るメッセージ
+type filteredMessage struct {
+	pred func(*Client) bool
+	message []byte
+}
+
+// 登録の要求
+type registerRequest struct {
+	client *Client
+	// 登録したかを返すチャネル(hubが待たされないよう、容量を1にしておく)
+	accepted chan bool
+}
+
+// 登録解除の要求
+type unregisterRequest struct {
+	client *Client
+	// 切断理由
+	reason string
+}
+
+// 送信バッファに入れるメッセージ
+type outbound struct {
+	data []byte
+	// 送信バッファに入れた時刻
+	queuedAt time.Time
+}
+
+// 特定のクライアントだけに宛てたメッセージ
+type directMessage struct {
+	client *Client
+	message []byte
 }
 
 // Hubは全クライアントの接続を管理し、ブロードキャストを行う
@@ -35,135 +208,1343 @@ type Hub struct {
 	broadcast chan []byte
 
 	// 新規接続登録用チャネル
-	register chan *Client
+	register chan registerRequest
 
 	// 切断登録用チャネル
-	unregister chan *Client
+	unregister chan unregisterRequest
+
+	// 特定のクライアントに送るメッセージを受け取るチャネル
+	direct chan directMessage
+
+	// 条件に合うクライアントにだけ送るメッセージを受け取るチャネル
+	filtered chan filteredMessage
+
+	// hubのゴルーチンで実行する関数を受け取るチャネル
+	calls chan func()
+
+	// trueの間は新しい接続を受け付けない(ドレイン中)
+	draining atomic.Bool
+
+	// 一時停止中か(hubのゴルーチンのみが切り替える)
+	// 一時停止中は接続を切らずに、ブロードキャストを配信せずに溜めておく
+	paused atomic.Bool
+
+	// 一時停止中に溜めたブロードキャスト(hubのゴルーチンのみが触る)とその件数、溜められる上限
+	held []filteredMessage
+	heldCount atomic.Int64
+	pauseQueueLimit int
+	// 再開後に、ブロードキャストの頻度の上限に従って配信している途中の溜めた分(hubのゴルーチンのみが触る)
+	// 残っている間は新しいブロードキャストを受け取らず、溜めた順に配信する
+	replay []filteredMessage
+
+	// 書き込みエラー発生時に呼ばれるコールバック(任意)
+	// writePumpのゴルーチンから呼ばれるため、重い処理は避けること
+	OnWriteError func(c *Client, err error)
+
+	// ブロードキャストごとに配信結果を通知するコールバック(任意)
+	// seqはブロードキャストの通し番号、delivered/evictedは配信できた数と
+	// 送信バッファが満杯で切断した数。hubのゴルーチンから呼ばれる
+	OnBroadcast func(seq uint64, delivered, evicted int)
+
+	// 送信バッファが警告水位を超えたクライアントを通知するコールバック(任意)
+	// 切断される前の兆候として使える。hubのゴルーチンから呼ばれる
+	OnSlowClient func(c *Client, queued int)
+
+	// 受信したメッセージを中継する前に順に適用する処理(任意)
+	// 整形、サニタイズ、NGワードの除去などを組み合わせる。hubを起動する前に設定すること
+	Middleware []Middleware
+
+	// 宛先ごとに、送信バッファに入れる直前に適用する処理(任意)
+	// hubを起動する前に設定すること
+	OutboundFilters []OutboundFilter
+
+	// rpcのメソッド名ごとの処理(任意)。空の場合はrpcも通常のメッセージとして中継する
+	// hubを起動する前に設定すること
+	RPCHandlers map[string]RPCHandler
+
+	// クライアントが切断されたときに切断理由とともに呼ばれるコールバック(任意)
+	// hubのゴルーチンから呼ばれる
+	OnDisconnect func(c *Client, reason string)
+
+	// ブロードキャストの通し番号(hubのゴルーチンのみが更新する)
+	seq uint64
+
+	// pumpの頻発するエラーログを集約するロガー
+	errLog *rateLogger
+
+	// 全スペース合計の未配信メッセージ数の上限(0で無制限)
+	maxInFlight int
+
+	// 圧縮する送信フレームの最小サイズ
+	compressThreshold int
+
+	// 1回の書き込みでまとめて送るメッセージ数の上限(0で無制限)
+	maxDrain int
+
+	// このhubのクライアントの送信バッファに溜まっているバイト数
+	bufferedBytes atomic.Int64
+	// 全スペースのhubで共有する合計(memory.go)
+	totals *hubTotals
+
+	// 負荷をyellow/redとするクライアント数(0で使わない)と、段階の変化を知らせる最小の間隔
+	loadYellow int
+	loadRed int
+	loadInterval time.Duration
+
+	// 最後に知らせた負荷の段階と時刻(hubのゴルーチンのみが触る)
+	announcedLoad string
+	loadAnnouncedAt time.Time
+
+	// 1クライアントがbyteQuotaWindowの間に送れる合計バイト数(0で無制限)
+	byteQuota int64
+	byteQuotaWindow time.Duration
+
+	// ブロードキャストの配信方法(SetDeliveryStrategyで差し替わる)
+	delivery atomic.Pointer[delivery]
+
+	// ブロードキャストの宛先を集めるための領域(hubのゴルーチンのみが使う)
+	targets []*Client
+
+	// 再起動せずに変更できる設定(SIGHUPで差し替わる)
+	live atomic.Pointer[liveConfig]
+
+	// 1つの接続を使い続けられる最大の時間(0で無制限)
+	maxLifetime time.Duration
+
+	// カナリアにする接続の割合と、指定された接続を必ずカナリアにするヘッダー(空の場合は見ない)
+	canaryFraction float64
+	canaryHeader string
+
+	// 接続後、最初のメッセージを待つ時間(0でpongWaitと同じ扱い)
+	firstMessageTimeout time.Duration
+
+	// 接続のTCPキープアライブの間隔(0で変更しない、負の値で無効)
+	tcpKeepAlive time.Duration
+
+	// writePumpがpingを送る間隔(pingPeriod。テストでは短くする)
+	pingInterval time.Duration
+
+	// 送信バッファの警告水位(0で警告しない)
+	slowWatermark int
+
+	// 警告水位をこの回数超えたクライアントにはブロードキャストを送らない(0で切り替えない)
+	demoteAfter int
+
+	// 送信バッファで待てる時間の上限。これより古いメッセージは送らずに捨てる(0で無制限)
+	maxQueueAge time.Duration
+
+	// 全クライアントで最も古い未配信メッセージがこの時間を超えたら警告する(0で警告しない)
+	queueAgeAlarm time.Duration
+
+	// 最後に計測した、全クライアントで最も古い未配信メッセージの待ち時間と、警告中か
+	oldestQueued atomic.Int64
+	queueAgeAlarming atomic.Bool
+
+	// 送信が詰まったクライアントの割合がこれを超えたら、優先度の低い種類のメッセージを間引く(0で間引かない)
+	shedThreshold float64
+	lowPriorityTypes map[string]bool
+
+	// 間引き中か
+	shedding atomic.Bool
+
+	// hub自身がブロードキャストする頻度の上限(nilで無制限)
+	fanoutLimiter *tokenBucket
+
+	// ブロードキャストの頻度を制限中か、と制限が始まった回数
+	broadcastLimited atomic.Bool
+	broadcastLimitedCount atomic.Uint64
+
+	// 接続に必要なプロトコルバージョンの下限(0で確認しない)
+	minProtocolVersion int
+
+	// 中継する既知のメッセージの種類と、それ以外の種類の扱い
+	knownTypes map[string]bool
+	unknownTypePolicy string
+
+	// 種類ごとの受け取るのに必要なプロトコルバージョン
+	typeVersions map[string]int
+
+	// 圧縮が有効か
+	compression bool
+
+	// メッセージの署名器(nilで署名しない)
+	signer *signer
+
+	// 違反を繰り返すIPアドレスを一時的に禁止するポリシー(nilで禁止しない)
+	// 全スペースで共有する
+	bans *banPolicy
+
+	// 切断理由ごとの再接続までの待ち時間(負の値は再接続しない)
+	reconnectPolicy map[string]time.Duration
+
+	// 全クライアントの送信バッファに溜まっている未配信メッセージの合計
+	// 送信バッファに入れたときと取り出したときに増減する(Client.buffer)
+	queued atomic.Int64
+
+	// 接続中のクライアント数(mapを触らずに読めるようにする)
+	count atomic.Int64
+
+	// アップグレードからhubへの登録までの途中にある接続の数と、その上限(0で無制限)
+	pendingRegistrations atomic.Int64
+	maxPendingRegistrations int
+
+	// 同時接続数の最大値(起動以降と、最後のリセット以降)
+	// hubのゴルーチンのみが更新する
+	peakSinceStart atomic.Int64
+	peak atomic.Int64
+
+	// 起動からの累計(統計用)
+	broadcasts atomic.Uint64
+	evictions atomic.Uint64
+	slowWarnings atomic.Uint64
+	staleDrops atomic.Uint64
+	shedDrops atomic.Uint64
+	unsupportedSkips atomic.Uint64
+	demotions atomic.Uint64
+	memoryEvictions atomic.Uint64
+	demotedSkips atomic.Uint64
+	quotaRejects atomic.Uint64
+	oldestDrops atomic.Uint64
+	signatureRejects atomic.Uint64
+	banRejects atomic.Uint64
+	ipRejects atomic.Uint64
+	registrationRejects atomic.Uint64
+	canaryConnections atomic.Uint64
+	normalConnections atomic.Uint64
+	pauseDrops atomic.Uint64
+
+	// 切断理由ごとの切断数
+	disconnectMu sync.Mutex
+	disconnects map[string]uint64
+	bytesIn atomic.Uint64
+	bytesOut atomic.Uint64
+
+	// 全クライアントのpingの往復時間
+	latency latencyHistogram
+
+	// Closeが呼ばれたときにクローズされるチャネル
+	done chan struct{}
+	closeOnce sync.Once
+
+	// runが終了したときにクローズされるチャネル
+	stopped chan struct{}
+
+	// 実行中のpumpゴルーチン
+	pumps sync.WaitGroup
+
+	// クライアントがいなくなった時刻(UnixNano、0は接続中のクライアントがいる)
+	// 定期的な計測のときにhubのゴルーチンが更新する
+	emptySince atomic.Int64
+
+	// 実行中のpumpゴルーチンの数(リークの確認用。接続中は1クライアントあたり2になる)
+	activePumps atomic.Int64
 }
 
+// 未配信メッセージ数の上限を超えている間、再確認するまでの間隔
+const backpressureRecheck = 10 * time.Millisecond
+
+// 最も古い未配信メッセージの待ち時間を計測する間隔
+// ブロードキャストごとではなく定期的に計測して、配信の負荷を増やさないようにする
+const queueAgeSampleInterval = time.Second
+
 // コンストラクタでHubの初期化を行う
-func newHub() *Hub {
-	return &Hub{
+func newHub(cfg Config) *Hub {
+	knownTypes := make(map[string]bool)
+	for _, typ := range cfg.MessageTypes {
+		knownTypes[typ] = true
+	}
+	lowPriorityTypes := make(map[string]bool)
+	for _, typ := range cfg.LowPriorityTypes {
+		lowPriorityTypes[typ] = true
+	}
+	var fanoutLimiter *tokenBucket
+	if cfg.BroadcastRate > 0 {
+		fanoutLimiter = newTokenBucket(cfg.BroadcastRate)
+	}
+	h := &Hub{
+		fanoutLimiter: fanoutLimiter,
 		clients: make(map[*Client]bool),
 		broadcast: make(chan []byte),
-		register: make(chan *Client),
-		unregister: make(chan *Client),
+		register: make(chan registerRequest),
+		unregister: make(chan unregisterRequest),
+		direct: make(chan directMessage),
+		filtered: make(chan filteredMessage),
+		calls: make(chan func()),
+		disconnects: make(map[string]uint64),
+		errLog: newRateLogger(cfg.LogWindow),
+		reconnectPolicy: cfg.ReconnectPolicy,
+		maxInFlight: cfg.MaxInFlight,
+		maxPendingRegistrations: cfg.MaxPendingRegistrations,
+		pauseQueueLimit: cfg.PauseQueueLimit,
+		compressThreshold: cfg.CompressionThreshold,
+		maxDrain: cfg.MaxDrainPerWrite,
+		totals: newHubTotals(cfg),
+		byteQuota: cfg.ByteQuota,
+		loadYellow: cfg.LoadYellow,
+		loadRed: cfg.LoadRed,
+		loadInterval: cfg.LoadUpdateInterval,
+		announcedLoad: loadGreen,
+		byteQuotaWindow: cfg.ByteQuotaWindow,
+		tcpKeepAlive: cfg.TCPKeepAlive,
+		pingInterval: pingPeriod,
+		firstMessageTimeout: cfg.FirstMessageTimeout,
+		maxLifetime: cfg.MaxLifetime,
+		canaryFraction: cfg.CanaryFraction,
+		canaryHeader: cfg.CanaryHeader,
+		slowWatermark: cfg.SlowClientWatermark,
+		demoteAfter: cfg.DemoteAfter,
+		maxQueueAge: cfg.MaxQueueAge,
+		queueAgeAlarm: cfg.QueueAgeAlarm,
+		shedThreshold: cfg.ShedThreshold,
+		lowPriorityTypes: lowPriorityTypes,
+		minProtocolVersion: cfg.MinProtocolVersion,
+		knownTypes: knownTypes,
+		typeVersions: cfg.TypeVersions,
+		unknownTypePolicy: cfg.UnknownTypePolicy,
+		compression: cfg.Compression,
+		signer: newSigner(cfg.SigningKey, cfg.SigningAlgorithm),
+		done: make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	h.live.Store(newLiveConfig(cfg))
+	strategy, _ := newDeliveryStrategy(h, cfg.DeliveryStrategy, cfg.DeliveryWorkers)
+	h.SetDeliveryStrategy(cfg.DeliveryStrategy, strategy)
+	return h
+}
+
+// hubを停止する
+// runを終了させ、全クライアントにクローズフレームを送って切断し、
+// 全てのpumpが終了するまで待つ。複数回呼んでも安全
+// (runを実行中のhubに対して呼ぶこと)
+func (h *Hub) Close() {
+	h.closeOnce.Do(func() {
+		close(h.done)
+	})
+	<-h.stopped
+	h.pumps.Wait()
+}
+
+// クライアントを登録する。hubが停止済みかドレイン中の場合はfalseを返す
+func (h *Hub) registerClient(c *Client) bool {
+	req := registerRequest{client: c, accepted: make(chan bool, 1)}
+	select {
+	case h.register <- req:
+		return <-req.accepted
+	case <-h.done:
+		return false
+	}
+}
+
+// クライアントの登録を解除する。hubが停止済みの場合は何もしない
+// reasonには切断理由を指定する
+func (h *Hub) unregisterClient(c *Client, reason string) {
+	select {
+	case h.unregister <- unregisterRequest{client: c, reason: reason}:
+	case <-h.done:
+	}
+}
+
+// メッセージをブロードキャストに流す。hubが停止済みの場合はfalseを返す
+func (h *Hub) publish(message []byte) bool {
+	select {
+	case h.broadcast <- message:
+		return true
+	case <-h.done:
+		return false
+	}
+}
+
+// 特定のクライアントにだけメッセージを送る。hubが停止済みの場合はfalseを返す
+// 送信チャネルへの書き込みはhubのゴルーチンで行うため、切断済みのクライアントに送っても安全
+func (h *Hub) sendTo(c *Client, message []byte) bool {
+	select {
+	case h.direct <- directMessage{client: c, message: message}:
+		return true
+	case <-h.done:
+		return false
+	}
+}
+
+// SendToの配信結果
+const (
+	// 送信バッファに入れた
+	deliveryDelivered = "delivered"
+	// 宛先が接続していない(切断済み、またはhubが停止済み)
+	deliveryOffline = "recipient_offline"
+	// 宛先の送信バッファが満杯だったため、宛先を切断した
+	deliveryBufferFull = "buffer_full"
+)
+
+// 特定のクライアントにメッセージを送り、配信結果を返す
+// sendToと違い、hubが送信バッファに入れ終わるまで待つ。送信者に届いたかを知らせたい場合に使う
+// (クライアントが実際に受け取ったかまでは分からない)
+func (h *Hub) SendTo(c *Client, message []byte) string {
+	status := deliveryOffline
+	h.do(func() {
+		if !h.clients[c] {
+			return
+		}
+		if h.enqueue(c, message) {
+			status = deliveryDelivered
+		} else {
+			status = deliveryBufferFull
+		}
+	})
+	return status
+}
+
+// predがtrueを返すクライアントにだけメッセージを送る
+// predはhubのゴルーチンでクライアントごとに呼ばれるため、すぐに返る軽い処理にすること
+// (他のクライアントへの配信やhubへの送信を行ってはならない)
+func (h *Hub) BroadcastFunc(pred func(*Client) bool, msg []byte) {
+	select {
+	case h.filtered <- filteredMessage{pred: pred, message: msg}:
+	case <-h.done:
+	}
+}
+
+// hubのゴルーチンでfnを実行し、終わるまで待つ。hubが停止済みの場合はfalseを返す
+// fnからはhubの内部状態(clients等)を安全に読み書きできる
+func (h *Hub) do(fn func()) bool {
+	finished := make(chan struct{})
+	select {
+	case h.calls <- func() { fn(); close(finished) }:
+		<-finished
+		return true
+	case <-h.done:
+		return false
+	}
+}
+
+// 切断時に送るクローズフレームの内容を返す
+// hubの停止やドレインによる切断の場合はその旨を伝える
+func (h *Hub) closeFrame(reason string) []byte {
+	switch reason {
+	case reasonShutdown:
+		return websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down")
+	case reasonClientClose:
+		return websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+	case reasonMaxLifetime:
+		return websocket.FormatCloseMessage(websocket.CloseNormalClosure, "max lifetime reached")
+	case reasonBanned:
+		return websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "banned")
+	case reasonTooLarge:
+		return websocket.FormatCloseMessage(websocket.CloseMessageTooBig, "message too large")
+	}
+	return []byte{}
+}
+
+// 接続中のクライアント数を返す(どのゴルーチンからでも呼べる)
+func (h *Hub) ClientCount() int {
+	return int(h.count.Load())
+}
+
+// クライアントを追加する。hubのゴルーチンからのみ呼ぶこと
+func (h *Hub) addClient(c *Client) {
+	h.clients[c] = true
+	h.totals.clients.Add(1)
+	n := h.count.Add(1)
+	if n > h.peak.Load() {
+		h.peak.Store(n)
+	}
+	if n > h.peakSinceStart.Load() {
+		h.peakSinceStart.Store(n)
+	}
+}
+
+// クライアントがいなくなった時刻を記録する。hubのゴルーチンからのみ呼ぶこと
+func (h *Hub) markEmpty(now time.Time) {
+	if len(h.clients) > 0 {
+		h.emptySince.Store(0)
+	} else if h.emptySince.Load() == 0 {
+		h.emptySince.Store(now.UnixNano())
 	}
 }
 
+// クライアントがいない状態が続いている時間を返す(接続中のクライアントがいる場合は0)
+func (h *Hub) emptyFor(now time.Time) time.Duration {
+	since := h.emptySince.Load()
+	if since == 0 {
+		return 0
+	}
+	return now.Sub(time.Unix(0, since))
+}
+
+// 最後のリセット以降の同時接続数の最大値を、現在の接続数に戻す
+func (h *Hub) ResetPeak() {
+	h.do(func() {
+		h.peak.Store(h.count.Load())
+	})
+}
+
+// クライアントを取り除き、送信チャネルを閉じる。hubのゴルーチンからのみ呼ぶこと
+// reasonは切断理由として記録され、writePumpが切断前に送る再接続の案内にも使われる
+func (h *Hub) removeClient(c *Client, reason string) {
+	c.closeReason = reason
+	delete(h.clients, c)
+	close(c.send)
+	c.settle()
+	h.count.Add(-1)
+	h.totals.clients.Add(-1)
+
+	h.disconnectMu.Lock()
+	h.disconnects[reason]++
+	h.disconnectMu.Unlock()
+	log.Printf("クライアントが切断されました id=%s 理由=%s", c.id, reason)
+	if h.OnDisconnect != nil {
+		h.OnDisconnect(c, reason)
+	}
+}
+
+// 切断理由ごとの切断数を返す
+func (h *Hub) Disconnects() map[string]uint64 {
+	h.disconnectMu.Lock()
+	defer h.disconnectMu.Unlock()
+	counts := make(map[string]uint64, len(h.disconnects))
+	for reason, n := range h.disconnects {
+		counts[reason] = n
+	}
+	return counts
+}
+
+// 全クライアントの送信バッファに溜まっている未配信メッセージの合計を返す
+func (h *Hub) Queued() int64 {
+	return h.queued.Load()
+}
+
+// 全スペースの未配信メッセージの合計が上限を超えているかを返す
+// 他のスペースで送信が進んで下回っても知らせは来ないため、超えている間はbackpressureRecheckごとに確かめ直す
+func (h *Hub) overloaded() bool {
+	return h.maxInFlight > 0 && h.totals.queued.Load() >= int64(h.maxInFlight)
+}
+
 // hubに対する操作
 func (h *Hub) run() {
+	sample := time.NewTicker(queueAgeSampleInterval)
+	defer sample.Stop()
+	throttled := false
 	for {
+		// 未配信メッセージが上限を超えている間はbroadcastを受け取らず、
+		// 送信側(readPump)を待たせることでメモリの増加を防ぐ
+		broadcast := h.broadcast
+		var recheck <-chan time.Time
+		if over := h.overloaded(); over != throttled {
+			throttled = over
+			if throttled {
+				log.Printf("全スペースの未配信メッセージが上限(%d)に達したため、受信を一時停止します", h.maxInFlight)
+			} else {
+				log.Println("未配信メッセージが減ったため、受信を再開します")
+			}
+		}
+		if throttled {
+			broadcast = nil
+			recheck = time.After(backpressureRecheck)
+		}
+
+		// ブロードキャストの頻度が上限に達している間は、次に配信できるまで
+		// broadcastとfilteredの受け取りを待たせて配信を平準化する
+		filtered := h.filtered
+		var wait time.Duration
+		if h.fanoutLimiter != nil {
+			wait = h.fanoutLimiter.delay(time.Now())
+			wasLimited := h.broadcastLimited.Swap(wait > 0)
+			if wait > 0 && !wasLimited {
+				h.broadcastLimitedCount.Add(1)
+			}
+			if wait > 0 {
+				broadcast, filtered = nil, nil
+				if !throttled || wait < backpressureRecheck {
+					recheck = time.After(wait)
+				}
+			}
+		}
+		// 再開前に溜めておいた分は、新しいブロードキャストより先に配信する
+		if len(h.replay) > 0 {
+			if wait == 0 && !throttled {
+				h.replayNext()
+				continue
+			}
+			broadcast, filtered = nil, nil
+		}
+
 		select {
-		case client := <-h.register:
-			h.clients[client] = true
-			log.Println("新しいクライアントが作成されました")
-		case client := <-h.unregister:
-			if _, ok := h.clients[client]; ok {
-				delete(h.clients, client)
-				close(client.send)
-				log.Println("クライアントが切断されました")
-			}
-		case message := <-h.broadcast:
-			// 全てクライアントにメッセージを送信
+		case <-h.done:
+			// 全クライアントの送信チャネルを閉じ、writePumpにクローズフレームを送らせる
 			for client := range h.clients {
-				select {
-				case client.send <- message:
-				default:
-					// 送信バッファ(client.send)がいっぱいの場合はクライアントを閉じる
-					close(client.send)
-					delete(h.clients, client)
-				}
+				h.removeClient(client, reasonShutdown)
+			}
+			close(h.stopped)
+			return
+		case req := <-h.register:
+			// ドレイン中は登録しない。serveWsでドレイン中かを確かめた後、Drainがクライアントの一覧を
+			// 取ってから登録しに来た接続は、一覧に入らずに切断されないまま残ってしまうため
+			if h.draining.Load() {
+				req.accepted <- false
+				break
 			}
+			h.addClient(req.client)
+			log.Println("新しいクライアントが作成されました")
+			if h.paused.Load() {
+				h.enqueue(req.client, pausedMessage)
+			}
+			req.accepted <- true
+		case req := <-h.unregister:
+			// 既に取り除かれている場合は、最初に記録した切断理由を優先する
+			if _, ok := h.clients[req.client]; ok {
+				h.removeClient(req.client, req.reason)
+			}
+		case d := <-h.direct:
+			if _, ok := h.clients[d.client]; ok {
+				h.enqueue(d.client, d.message)
+			}
+		case <-recheck:
+		case message := <-broadcast:
+			h.fanout(message, nil)
+		case f := <-filtered:
+			h.fanout(f.message, f.pred)
+		case fn := <-h.calls:
+			fn()
+		case now := <-sample.C:
+			h.sampleQueueAge()
+			h.markEmpty(now)
+			h.updateLoad(now)
 		}
 	}
 }
 
+// クライアントの送信バッファにメッセージを入れる。hubのゴルーチンからのみ呼ぶこと
+// 送信バッファ(client.send)がいっぱいの場合はクライアントを閉じてfalseを返す
+// OutboundFiltersで送らないことになった場合は、切断しないためtrueを返す
+func (h *Hub) enqueue(c *Client, message []byte) bool {
+	message, ok := h.outboundFor(c, message)
+	if !ok {
+		return true
+	}
+	return h.push(c, message)
+}
+
+// OutboundFiltersを適用済みのメッセージを送信バッファに入れる。hubのゴルーチンからのみ呼ぶこと
+// 送信バッファがいっぱいの場合はクライアントを閉じてfalseを返す
+func (h *Hub) push(c *Client, message []byte) bool {
+	if !c.offer(message) {
+		h.evict(c)
+		return false
+	}
+	h.checkSlow(c)
+	return true
+}
+
+// OutboundFiltersを適用した、クライアントcに送る内容を返す。送らない場合はfalseを返す
+func (h *Hub) outboundFor(c *Client, message []byte) ([]byte, bool) {
+	if len(h.OutboundFilters) == 0 {
+		return message, true
+	}
+	return h.applyOutboundFilters(c, message)
+}
+
+// 送信バッファにメッセージを入れる。バッファが一杯の場合は待たずにfalseを返す
+func (c *Client) offer(message []byte) bool {
+	select {
+	case c.send <- outbound{data: message, queuedAt: time.Now()}:
+		c.buffer(1, len(message))
+		return true
+	default:
+		return false
+	}
+}
+
+// 送信バッファからメッセージを1つ取り出す。空の場合や閉じられている場合は待たずにfalseを返す
+// hubも古いメッセージを捨てるために取り出すことがあるため、len(c.send)の分が取り出せるとは限らない
+func (c *Client) take() (outbound, bool) {
+	select {
+	case m, ok := <-c.send:
+		return m, ok
+	default:
+		return outbound{}, false
+	}
+}
+
+// 送信バッファがあふれたクライアントを切断する。hubのゴルーチンからのみ呼ぶこと
+func (h *Hub) evict(c *Client) {
+	h.removeClient(c, reasonOverload)
+	h.evictions.Add(1)
+}
+
+// 切断される前に、送信バッファが警告水位を超えたクライアントを知らせる
+// hubのゴルーチンからのみ呼ぶこと
+func (h *Hub) checkSlow(c *Client) {
+	if h.slowWatermark <= 0 {
+		return
+	}
+	queued := len(c.send)
+	if queued >= h.slowWatermark && !c.slow {
+		c.slow = true
+		h.slowWarnings.Add(1)
+		log.Printf("警告: クライアント %s の送信バッファが警告水位を超えました(%d/%d)", c.id, queued, cap(c.send))
+		if h.OnSlowClient != nil {
+			h.OnSlowClient(c, queued)
+		}
+		c.slowHits++
+		if h.demoteAfter > 0 && c.slowHits >= h.demoteAfter && !c.unicastOnly {
+			h.demote(c)
+		}
+	} else if queued < h.slowWatermark {
+		c.slow = false
+	}
+}
+
+// 送信が追いつかないクライアントを、切断せずにブロードキャストを送らないように切り替える
+// hubのゴルーチンからのみ呼ぶこと
+func (h *Hub) demote(c *Client) {
+	c.unicastOnly = true
+	h.demotions.Add(1)
+	log.Printf("警告: クライアント %s の送信バッファが警告水位を%d回超えたため、ブロードキャストを送らないようにします", c.id, c.slowHits)
+	// 警告水位は容量より小さいため、通常は空きがある
+	c.offer(unicastOnlyMessage)
+}
+
+// 送信バッファが警告水位(未設定なら容量)に達しているクライアントの割合から、
+// 優先度の低いメッセージを間引くかを判定して返す。hubのゴルーチンからのみ呼ぶこと
+func (h *Hub) updateShedding() bool {
+	if h.shedThreshold <= 0 || len(h.lowPriorityTypes) == 0 {
+		return false
+	}
+	level := h.slowWatermark
+	if level <= 0 {
+		level = sendBufferSize
+	}
+	pressured := 0
+	for client := range h.clients {
+		if len(client.send) >= level {
+			pressured++
+		}
+	}
+	shedding := len(h.clients) > 0 && float64(pressured)/float64(len(h.clients)) > h.shedThreshold
+	if h.shedding.Swap(shedding) != shedding {
+		if shedding {
+			log.Printf("送信が詰まっているクライアントが%d/%d人になったため、優先度の低いメッセージの配信を止めます", pressured, len(h.clients))
+		} else {
+			log.Println("送信の詰まりが解消したため、優先度の低いメッセージの配信を再開します")
+		}
+	}
+	return shedding
+}
+
+// 全クライアントで最も古い未配信メッセージの待ち時間を計測し、
+// 警告の閾値を超えたとき(と下回ったとき)にログを出す。hubのゴルーチンからのみ呼ぶこと
+// 個々の遅いクライアントではなく、サーバー全体の送信の遅れを検知するためのもの
+func (h *Hub) sampleQueueAge() {
+	now := time.Now().UnixNano()
+	var oldest time.Duration
+	for client := range h.clients {
+		if since := client.writingSince.Load(); since > 0 {
+			oldest = max(oldest, time.Duration(now-since))
+		}
+	}
+	h.oldestQueued.Store(int64(oldest))
+	if h.queueAgeAlarm <= 0 {
+		return
+	}
+	alarming := oldest > h.queueAgeAlarm
+	if h.queueAgeAlarming.Swap(alarming) != alarming {
+		if alarming {
+			log.Printf("送信バッファで%vより長く待っているメッセージがあります(最長 %v)", h.queueAgeAlarm, oldest.Round(time.Millisecond))
+		} else {
+			log.Println("送信バッファのメッセージの待ち時間が通常に戻りました")
+		}
+	}
+}
+
+// predを満たすクライアント(nilの場合は全クライアント)にメッセージを送信する
+// hubのゴルーチンからのみ呼ぶこと
+func (h *Hub) fanout(message []byte, pred func(*Client) bool) {
+	// 一時停止中は配信せずに溜めておき、再開時に配信する
+	// 上限を超えた分は捨てる
+	if h.paused.Load() {
+		if len(h.held) >= h.pauseQueueLimit {
+			h.pauseDrops.Add(1)
+			h.errLog.Printf("pause-drop", "一時停止中に溜められる上限(%d)を超えたため、メッセージを捨てました", h.pauseQueueLimit)
+			return
+		}
+		h.held = append(h.held, filteredMessage{message: message, pred: pred})
+		h.heldCount.Store(int64(len(h.held) + len(h.replay)))
+		return
+	}
+	// 過負荷で間引き中は、優先度の低い種類のメッセージを全員分まとめて捨てる
+	// (送信バッファを埋めてクライアントを次々に切断してしまうのを避ける)
+	if h.updateShedding() && h.lowPriorityTypes[messageType(message)] {
+		h.shedDrops.Add(1)
+		return
+	}
+	if h.fanoutLimiter != nil {
+		h.fanoutLimiter.allow(time.Now())
+	}
+	h.seq++
+	h.broadcasts.Add(1)
+	// 種類は受け取れるかの確認が必要になったときに一度だけ取り出す
+	typ, typed := "", false
+	for client := range h.clients {
+		if pred != nil && !pred(client) {
+			continue
+		}
+		if client.unicastOnly {
+			h.demotedSkips.Add(1)
+			continue
+		}
+		if client.types != nil || len(h.typeVersions) > 0 {
+			if !typed {
+				typ, typed = messageType(message), true
+			}
+			// 受け取れない種類を送ると古いクライアントがエラーになるため、そのクライアントには送らない
+			if !client.supportsType(typ) {
+				h.unsupportedSkips.Add(1)
+				continue
+			}
+		}
+		h.targets = append(h.targets, client)
+	}
+	delivered, evicted := h.delivery.Load().strategy.Deliver(h.targets, message)
+	clear(h.targets)
+	h.targets = h.targets[:0]
+	if h.OnBroadcast != nil {
+		h.OnBroadcast(h.seq, delivered, evicted)
+	}
+}
+
+// 違反を1回記録し、繰り返したためにIPアドレスを禁止した場合はtrueを返す
+func (c *Client) violated() bool {
+	if c.hub.bans == nil || !c.hub.bans.violation(c.ip, time.Now()) {
+		return false
+	}
+	log.Printf("警告: クライアント %s (%s) が違反を繰り返したため、%vの間接続を禁止します", c.id, c.ip, c.hub.bans.cooldown)
+	return true
+}
+
+// 受信サイズの上限を超えたメッセージのうち、接続を閉じる前に読み切れる超過分
+// これより大きく超えたメッセージは、gorilla/websocketが本体を読まずに接続を閉じる
+const readLimitSlack = 4 << 10
+
+// 受信サイズの上限超過を違反として記録し、切断の理由を返す
+// 上限超過は通常の切断と区別して記録する
+// 違反したクライアントを特定できるよう、集約せずにクライアントごとに出力する
+func (c *Client) tooLarge(limit int64) string {
+	log.Printf("警告: クライアント %s が受信サイズの上限(%dバイト)を超えたため切断します", c.id, limit)
+	if c.violated() {
+		return reasonBanned
+	}
+	return reasonTooLarge
+}
+
 // クライアントからのメッセージ受信を処理する
 func (c *Client) readPump() {
+	reason := reasonReadError
+	c.hub.activePumps.Add(1)
 	defer func() {
-		c.hub.unregister <- c
-		c.conn.Close()
+		c.hub.activePumps.Add(-1)
+		c.hub.unregisterClient(c, reason)
+		// 読み込みエラーの場合は接続が使えないためすぐに閉じる
+		// それ以外は、writePumpが案内やクローズフレームを送ってから接続を閉じる
+		if reason == reasonReadError {
+			c.conn.Close()
+		}
+		c.hub.pumps.Done()
 	}()
 	// 読み込みの制限とタイムアウト設定
-	c.conn.SetReadLimit(512)
-	c.conn.SetReadDeadline(time.Now().Add(60 * time.Second))
-	c.conn.SetPongHandler(func(string) error {
-		c.conn.SetReadDeadline(time.Now().Add(60 * time.Second))
+	// gorilla/websocketはフレームのヘッダーを読んだ時点で、分割されたメッセージの合計サイズが
+	// 上限を超えるかを判定するため、上限を超える分の本体をバッファに溜め込むことはない
+	// ただし上限を超えるとgorilla/websocketが自分でクローズフレームを送り、以降はこちらから書き込めなくなる
+	// 切断の理由(禁止したことなど)を知らせられるよう、接続の上限はreadLimitSlackだけ大きくして
+	// 少し超えただけのメッセージはここで読み切ってから断る
+	live := c.hub.live.Load()
+	c.conn.SetReadLimit(live.readLimit + readLimitSlack)
+	// 接続しただけで何も送らないクライアントが枠を占有し続けないよう、
+	// 最初のメッセージはpongWaitより短い期限で待つ(受信専用クライアントは送信しないため対象外)
+	awaitingFirst := c.hub.firstMessageTimeout > 0 && !c.readonly
+	if awaitingFirst {
+		c.conn.SetReadDeadline(time.Now().Add(c.hub.firstMessageTimeout))
+	} else {
+		c.conn.SetReadDeadline(time.Now().Add(pongWait))
+	}
+	c.conn.SetPongHandler(func(appData string) error {
+		c.recordRTT(appData, time.Now())
+		// 最初のメッセージが届くまでは、pongで期限を延ばさない
+		if !awaitingFirst {
+			c.conn.SetReadDeadline(time.Now().Add(pongWait))
+		}
 		return nil
 	})
+	// クローズフレームへの応答はここでは返さず、送信バッファを送り切った後にwritePumpが返す
+	c.conn.SetCloseHandler(func(int, string) error {
+		return nil
+	})
+	notified := false
+	limiter := newTypeLimiter(c.rates.Limits, c.rates.Default)
+	timeSync := newTokenBucket(timeSyncRate)
+	limitsQuery := newTokenBucket(limitsQueryRate)
+	var quota *byteQuota
+	if c.hub.byteQuota > 0 {
+		quota = newByteQuota(c.hub.byteQuota, c.hub.byteQuotaWindow)
+	}
 	for {
 		// メッセージ受信(テキストメッセージ)
 		_, message, err := c.conn.ReadMessage()
 		if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				// 最初のメッセージか、pongが一定時間届かなかった
+				reason = reasonIdle
+				if awaitingFirst {
+					reason = reasonNoFirstMessage
+				}
+				break
+			}
+			if errors.Is(err, websocket.ErrReadLimit) {
+				// 上限を大きく超えたメッセージは、gorilla/websocketがこの時点でコード1009(Message Too Big)の
+				// クローズフレームを送信済みのため、案内やクローズフレームは送れない
+				reason = c.tooLarge(live.readLimit)
+				break
+			}
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-				log.Printf("readPump エラー: %v", err)
+				c.hub.errLog.Printf("readPump エラー", "readPump エラー: %v", err)
+			}
+			var ce *websocket.CloseError
+			if errors.As(err, &ce) && ce.Code != websocket.CloseAbnormalClosure {
+				// クライアントからクローズフレームが届いた
+				// 送信バッファに残っている分をwritePumpが送り切ってからクローズフレームを返す
+				c.flushUntil.Store(time.Now().Add(closeFlushTimeout).UnixNano())
+				reason = reasonClientClose
 			}
 			break
 		}
+		c.hub.bytesIn.Add(uint64(len(message)))
+		size := int64(len(message))
+		// 設定が読み込み直された場合は、接続中のこのクライアントにも反映する
+		if l := c.hub.live.Load(); l != live {
+			live = l
+			c.conn.SetReadLimit(live.readLimit + readLimitSlack)
+			c.rates = live.rateProfile(c.origin)
+			limiter = newTypeLimiter(c.rates.Limits, c.rates.Default)
+		}
+		if size > live.readLimit {
+			// writePumpが理由の案内とクローズフレームを送ってから切断する
+			reason = c.tooLarge(live.readLimit)
+			break
+		}
+		if awaitingFirst {
+			awaitingFirst = false
+			c.conn.SetReadDeadline(time.Now().Add(pongWait))
+		}
+		if c.readonly {
+			// 受信専用クライアントからの送信は捨てる(エラーは最初の1回だけ送る)
+			if !notified {
+				notified = true
+				c.hub.sendTo(c, errorMessage(codeReadOnly, "this connection is read-only; messages are not delivered", 0))
+			}
+			continue
+		}
+		// 署名が正しいメッセージだけを受け付け、以降は署名を外した本文を扱う
+		if s := c.hub.signer; s != nil {
+			payload, ok := s.verify(message)
+			if !ok {
+				c.hub.signatureRejects.Add(1)
+				c.hub.errLog.Printf("署名エラー", "警告: クライアント %s から署名の正しくないメッセージが届きました", c.id)
+				c.hub.sendTo(c, errorMessage(codeInvalidSignature, "invalid or missing signature; message dropped", 0))
+				continue
+			}
+			message = payload
+		}
+		if c.msgpack {
+			converted, err := msgpackToJSON(message)
+			if err != nil {
+				c.hub.sendTo(c, errorMessage(codeInvalidFormat, "invalid MessagePack message; dropped", 0))
+				continue
+			}
+			message = converted
+		}
+		typ := messageType(message)
+		if typ == "time_sync" {
+			// 時刻合わせは中継せず、要求したクライアントにだけ即座に応答する
+			if timeSync.allow(time.Now()) {
+				c.hub.sendTo(c, timeSyncReply(message))
+			}
+			continue
+		}
+		if typ == "limits" {
+			// 送信できる残りの量は中継せず、問い合わせたクライアントにだけ返す
+			// (問い合わせ自体は残りの量を減らさない)
+			if now := time.Now(); limitsQuery.allow(now) {
+				c.hub.sendTo(c, limitsReply(limiter, quota, now))
+			}
+			continue
+		}
+		if !c.acceptType(typ) {
+			continue
+		}
+		// 種類ごとのレート上限を超えたメッセージはそのメッセージだけ捨てる
+		if !limiter.allow(typ, time.Now()) {
+			// 制限され始めるごとに1回の違反として数える
+			if limiter.shouldNotify(typ) {
+				if c.violated() {
+					reason = reasonBanned
+					break
+				}
+				c.hub.sendTo(c, errorMessage(codeRateLimited, fmt.Sprintf("rate limit exceeded for %q messages; dropping until the rate drops", typ), limiter.retryAfter(typ, time.Now())))
+			}
+			continue
+		}
+		// 受信バイト数の上限を超えたメッセージは、古いメッセージが直近の期間から外れて残りが増えるまで捨てる
+		if quota != nil && !quota.allow(size, time.Now()) {
+			c.hub.quotaRejects.Add(1)
+			if quota.shouldNotify() {
+				c.hub.sendTo(c, quotaExceededMessage(quota, time.Now()))
+			}
+			continue
+		}
+		if typ == rpcType && len(c.hub.RPCHandlers) > 0 {
+			// rpcは中継せず、ハンドラーの結果を要求したクライアントにだけ返す
+			c.handleRPC(message)
+			continue
+		}
+		m, err := c.hub.applyMiddleware(c, &Message{Type: typ, Data: message})
+		if err != nil {
+			c.hub.sendTo(c, errorMessage(codeRejected, err.Error(), 0))
+			continue
+		}
+		if m == nil {
+			continue
+		}
 		// 受信したメッセージをhubのbroadcastに送る
-		c.hub.broadcast <- message
+		if !c.hub.publish(m.Data) {
+			break
+		}
+	}
+}
+
+// 書き込みエラーを通知し、クライアントの登録を解除する
+// 書き込みエラーが起きたクライアントは必ずここで切断扱いとする
+// (readPumpの終了を待たずにhubから外すため、以降のブロードキャストは届かない)
+func (c *Client) writeFailed(err error) {
+	if errors.Is(err, websocket.ErrCloseSent) {
+		// 受信サイズの上限を大きく超えたため、gorilla/websocketがクローズフレームを送った後は書き込めない
+		// 切断はreadPumpが理由を付けて行うため、書き込みエラーとしては扱わない
+		return
+	}
+	log.Printf("writePump エラー: クライアント %s: %v", c.id, err)
+	if c.hub.OnWriteError != nil {
+		c.hub.OnWriteError(c, err)
 	}
+	c.hub.unregisterClient(c, reasonWriteError)
 }
 
 // クライアントへのメッセージ送信を処理する
+// このゴルーチンが接続への唯一の書き込み手となる(Clientのconnの説明を参照)
 func (c *Client) writePump() {
-	ticker := time.NewTicker(54 * time.Second)
+	ticker := time.NewTicker(c.hub.pingInterval)
+	c.hub.activePumps.Add(1)
 	defer func() {
+		c.hub.activePumps.Add(-1)
+		c.settle()
 		ticker.Stop()
 		c.conn.Close()
+		c.hub.pumps.Done()
 	}()
+	var expired <-chan time.Time
+	if c.hub.maxLifetime > 0 {
+		lifetime := time.NewTimer(c.hub.maxLifetime - time.Since(c.connectedAt))
+		defer lifetime.Stop()
+		expired = lifetime.C
+	}
 	for {
 		select {
+		case <-expired:
+			// 最大の接続時間を超えたため、hubに切断してもらう
+			// (sendが閉じられると、案内とクローズフレームを送って終了する)
+			expired = nil
+			c.hub.unregisterClient(c, reasonMaxLifetime)
 		case message, ok := <-c.send:
-			// 書き込みタイムアウト設定
-			c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
 			if !ok {
 				// hubがチャネルをクローズした場合
-				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
-				return
-			}
-			// 書き込み用のwriterを取得
-			w, err := c.conn.NextWriter(websocket.TextMessage)
-			if err != nil {
+				c.writeClose()
 				return
 			}
-			w.Write(message)
-
-			// バッファ内のメッセージもまとめて送信
-			n := len(c.send)
-			for i := 0; i < n; i++ {
-				w.Write([]byte("\n"))
-				w.Write(<-c.send)
-			}
-
-			if err := w.Close(); err != nil {
+			if err := c.writeBatch(message); err != nil {
+				c.writeFailed(err)
 				return
 			}
 		case <-ticker.C:
 			// 定期的にpingを送信して接続を維持
-			c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
-			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+			if err := c.writePing(); err != nil {
+				c.writeFailed(err)
 				return
 			}
 		}
 	}
 }
 
+// 送信するメッセージをクライアントの形式に変換し、署名が有効であれば署名を付ける
+func (c *Client) encode(data []byte) []byte {
+	if c.msgpack {
+		data = jsonToMsgpack(data)
+	}
+	if c.hub.signer != nil {
+		data = c.hub.signer.sign(data)
+	}
+	return data
+}
+
+// messageとsendに溜まっているメッセージ(maxDrain件まで)を改行区切りで1つのフレームにまとめて送信する
+// 送信バッファで待ちすぎたメッセージは、古い内容を今さら届けないように捨てる
+// writePumpのゴルーチンからのみ呼ぶこと
+func (c *Client) writeBatch(message outbound) error {
+	c.beginWrite()
+	defer c.endWrite()
+	c.writingSince.Store(message.queuedAt.UnixNano())
+	defer c.writingSince.Store(0)
+
+	// バッファ内のメッセージもまとめて送信する
+	now := time.Now()
+	var batch [][]byte
+	size := 0
+	add := func(m outbound) {
+		c.buffer(-1, -len(m.data))
+		if c.hub.maxQueueAge > 0 && now.Sub(m.queuedAt) > c.hub.maxQueueAge {
+			c.hub.staleDrops.Add(1)
+			return
+		}
+		data := c.encode(m.data)
+		if len(batch) > 0 && !c.msgpack {
+			size++
+		}
+		batch = append(batch, data)
+		size += len(data)
+	}
+	add(message)
+	n := len(c.send)
+	// 上限を超えた分は次の書き込みに回し、その間にwritePumpがpingを送れるようにする
+	if c.hub.maxDrain > 0 && n > c.hub.maxDrain-1 {
+		n = c.hub.maxDrain - 1
+	}
+	for i := 0; i < n; i++ {
+		m, ok := c.take()
+		if !ok {
+			break
+		}
+		add(m)
+	}
+	if len(batch) == 0 {
+		return nil
+	}
+
+	// 書き込みタイムアウト設定
+	c.conn.SetWriteDeadline(c.writeDeadline())
+	// 小さいフレームは圧縮してもCPUを使うだけなので圧縮しない
+	c.conn.EnableWriteCompression(c.compress && size >= c.hub.compressThreshold)
+
+	// MessagePackは改行で区切れないため、1件ずつバイナリフレームで送る
+	if c.msgpack {
+		for _, m := range batch {
+			c.conn.EnableWriteCompression(c.compress && len(m) >= c.hub.compressThreshold)
+			if err := c.conn.WriteMessage(websocket.BinaryMessage, m); err != nil {
+				return err
+			}
+		}
+		c.hub.bytesOut.Add(uint64(size))
+		return nil
+	}
+
+	// 書き込み用のwriterを取得
+	w, err := c.conn.NextWriter(websocket.TextMessage)
+	if err != nil {
+		return err
+	}
+	for i, m := range batch {
+		if i > 0 {
+			_, err = w.Write([]byte("\n"))
+		}
+		if err == nil {
+			_, err = w.Write(m)
+		}
+		if err != nil {
+			// 途中まで書いたフレームは完成させられないため、writerを閉じてエラーを返す
+			// (writePumpは接続を閉じて終了し、クライアントは登録解除される)
+			w.Close()
+			return err
+		}
+	}
+
+	if err := w.Close(); err != nil {
+		return err
+	}
+	c.hub.bytesOut.Add(uint64(size))
+	return nil
+}
+
+// 単一書き込みの約束(Clientのconnの説明を参照)が破られたときにpanicするか
+// テストではtrueにして確実に気づけるようにし、本番ではログに出力して接続を使い続ける
+var panicOnConcurrentWrite = false
+
+// connへの書き込みを始める。他のゴルーチンが書き込み中であれば約束が破られている
+func (c *Client) beginWrite() {
+	if c.writing.CompareAndSwap(false, true) {
+		return
+	}
+	if panicOnConcurrentWrite {
+		panic("クライアント " + c.id + " の接続に並行して書き込もうとしました")
+	}
+	log.Printf("警告: クライアント %s の接続に並行して書き込もうとしました(書き込みはwritePumpからのみ行うこと)", c.id)
+}
+
+// connへの書き込みを終える
+func (c *Client) endWrite() {
+	c.writing.Store(false)
+}
+
+// 必要に応じて再接続の案内を送り、クローズフレームを送信する。writePumpのゴルーチンからのみ呼ぶこと
+func (c *Client) writeClose() {
+	c.beginWrite()
+	defer c.endWrite()
+	c.conn.SetWriteDeadline(c.writeDeadline())
+	if hint := c.hub.reconnectHint(c.closeReason); hint != nil {
+		frameType := websocket.TextMessage
+		if c.msgpack {
+			frameType = websocket.BinaryMessage
+		}
+		c.conn.WriteMessage(frameType, c.encode(hint))
+	}
+	c.conn.WriteMessage(websocket.CloseMessage, c.hub.closeFrame(c.closeReason))
+}
+
+// pingを送信する。writePumpのゴルーチンからのみ呼ぶこと
+func (c *Client) writePing() error {
+	c.beginWrite()
+	defer c.endWrite()
+	c.conn.SetWriteDeadline(c.writeDeadline())
+	return c.conn.WriteMessage(websocket.PingMessage, pingPayload(time.Now()))
+}
+
+// 書き込みの期限を返す
+// クライアントからのクローズ後は、残りを送り切る期限(flushUntil)を超えないようにする
+func (c *Client) writeDeadline() time.Time {
+	deadline := time.Now().Add(writeWait)
+	if until := c.flushUntil.Load(); until != 0 && until < deadline.UnixNano() {
+		deadline = time.Unix(0, until)
+	}
+	return deadline
+}
+
+// クライアントがpermessage-deflateを申し出ているかを返す
+// Upgraderは圧縮が有効で、クライアントが申し出ている場合にだけ圧縮をネゴシエートする
+func offersCompression(r *http.Request) bool {
+	for _, v := range r.Header.Values("Sec-Websocket-Extensions") {
+		for _, ext := range strings.Split(v, ",") {
+			name, _, _ := strings.Cut(ext, ";")
+			if strings.EqualFold(strings.TrimSpace(name), "permessage-deflate") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// クライアントIDを生成する
+func newClientID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
 // HTTPリクエストをWebSocket接続にアップグレードし、新しいクライアントを登録する
 func serveWs(hub *Hub, w http.ResponseWriter, r *http.Request) {
-	conn, err := upgrader.Upgrade(w, r, nil)
+	serveReserved(hub, hub.pendingRegistrations.Add(1), w, r)
+}
+
+// serveWsの本体。hubへの登録待ちの接続として数えた後に呼び、pendingには数えた後の数を渡す
+// 登録を終えるか断った時点で、数えた分を減らす
+func serveReserved(hub *Hub, pending int64, w http.ResponseWriter, r *http.Request) {
+	defer hub.pendingRegistrations.Add(-1)
+	if hub.draining.Load() {
+		// ドレイン中は新しい接続を受け付けず、ロードバランサに別のインスタンスへ振り分けてもらう
+		http.Error(w, "server is draining", http.StatusServiceUnavailable)
+		return
+	}
+	// 接続が集中してhubへの登録待ちが溜まりすぎた場合は、アップグレード前に断って
+	// 待たされるゴルーチンが際限なく増えないようにする
+	if hub.maxPendingRegistrations > 0 && pending > int64(hub.maxPendingRegistrations) {
+		hub.registrationRejects.Add(1)
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "too many pending connections", http.StatusServiceUnavailable)
+		return
+	}
+	ip := remoteIP(r)
+	if !hub.live.Load().ipFilter.allowed(ip) {
+		// 許可されていないIPアドレスからの接続はアップグレード前に拒否する
+		hub.ipRejects.Add(1)
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	if hub.bans != nil {
+		if until, ok := hub.bans.bannedUntil(ip, time.Now()); ok {
+			// 禁止中のIPアドレスからの接続はアップグレード前に拒否する
+			hub.banRejects.Add(1)
+			w.Header().Set("Retry-After", fmt.Sprint(int(time.Until(until).Seconds())+1))
+			http.Error(w, "banned", http.StatusForbidden)
+			return
+		}
+	}
+	version, subprotocol := negotiateVersion(r, hub.minProtocolVersion)
+	if hub.minProtocolVersion > 0 && version == 0 {
+		// 対応バージョンを申告しない古いクライアントはアップグレード前に拒否する
+		http.Error(w, upgradeRequiredMessage(hub.minProtocolVersion), http.StatusUpgradeRequired)
+		return
+	}
+	format := r.URL.Query().Get("format")
+	if format != "" && format != formatJSON && format != formatMsgpack {
+		http.Error(w, "format must be json or msgpack", http.StatusBadRequest)
+		return
+	}
+	var header http.Header
+	if subprotocol != "" {
+		header = http.Header{"Sec-Websocket-Protocol": {subprotocol}}
+	}
+	conn, err := upgrader.Upgrade(w, r, header)
 	if err != nil {
 		log.Println("upgradeエラー:", err)
 		return
 	}
+	// NATの裏などでpingが届かなくなった相手を、OSのレベルでも検知できるようにする
+	if err := setKeepAlive(conn.NetConn(), hub.tcpKeepAlive); err != nil {
+		hub.errLog.Printf("keepalive", "TCPキープアライブの設定エラー: %v", err)
+	}
 	client := &Client{
 		hub: hub,
+		id: newClientID(),
 		conn: conn,
-		send: make(chan []byte, 256),
+		send: make(chan outbound, sendBufferSize),
+		readonly: r.URL.Query().Get("mode") == "readonly",
+		msgpack: format == formatMsgpack,
+		version: version,
+		types: acceptedTypes(r),
+		ip: ip,
+		connectedAt: time.Now(),
+		canary: hub.isCanary(r),
+		origin: r.Header.Get("Origin"),
+		rates: hub.live.Load().rateProfile(r.Header.Get("Origin")),
+		compress: hub.compression && offersCompression(r),
 	}
-	client.hub.register <- client
+	// 登録前に送信バッファへ入れておき、歓迎メッセージが必ず最初のフレームになるようにする
+	client.offer(hub.welcomeMessage(client))
 
+	// 登録前にpumpの数を加算しておき、Closeが登録済みクライアントのpumpを待てるようにする
+	hub.pumps.Add(2)
+	if !hub.registerClient(client) {
+		// 停止済みかドレイン中のhubには登録しない
+		hub.pumps.Add(-2)
+		client.release()
+		conn.WriteControl(websocket.CloseMessage, hub.closeFrame(reasonShutdown), time.Now().Add(time.Second))
+		conn.Close()
+		return
+	}
+	hub.countCohort(client)
 	// 読み書きをゴルーチンで処理
 	go client.readPump()
 	go client.writePump()
@@ -171,17 +1552,90 @@ func serveWs(hub *Hub, w http.ResponseWriter, r *http.Request) {
 }
 
 
-func main() {
-	hub := newHub()
-	go hub.run()
-
-	http.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
+// サーバーのエンドポイントを登録したハンドラーを返す
+func newMux(cfg Config, hubs *hubRegistry) *http.ServeMux {
+	hub, _ := hubs.get(defaultSpace)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
 		serveWs(hub, w, r)
 	})
+	mux.HandleFunc("/ws/{space}", func(w http.ResponseWriter, r *http.Request) {
+		serveSpace(hubs, w, r)
+	})
+	if cfg.EchoEndpoint {
+		mux.HandleFunc("/ws/echo", func(w http.ResponseWriter, r *http.Request) {
+			serveEcho(cfg.ReadLimit, w, r)
+		})
+	}
+	mux.HandleFunc("GET /version", serveVersion)
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
+		serveHealthz(hubs, w, r)
+	})
+	mux.HandleFunc("GET /stats", func(w http.ResponseWriter, r *http.Request) {
+		serveStats(hubs, w, r)
+	})
+	mux.HandleFunc("GET /stats/runtime", func(w http.ResponseWriter, r *http.Request) {
+		serveRuntimeStats(hubs, w, r)
+	})
+	mux.HandleFunc("POST /admin/drain", adminOnly(cfg.AdminToken, func(w http.ResponseWriter, r *http.Request) {
+		serveDrain(hubs, cfg.DrainWindow, w, r)
+	}))
+	mux.HandleFunc("POST /admin/pause", adminOnly(cfg.AdminToken, func(w http.ResponseWriter, r *http.Request) {
+		servePause(hubs, w, r)
+	}))
+	mux.HandleFunc("POST /admin/resume", adminOnly(cfg.AdminToken, func(w http.ResponseWriter, r *http.Request) {
+		serveResume(hubs, w, r)
+	}))
+	mux.HandleFunc("POST /admin/spaces/{space}", adminOnly(cfg.AdminToken, func(w http.ResponseWriter, r *http.Request) {
+		serveDeclareSpace(hubs, w, r)
+	}))
+	mux.HandleFunc("POST /admin/peak/reset", adminOnly(cfg.AdminToken, func(w http.ResponseWriter, r *http.Request) {
+		serveResetPeak(hubs, w, r)
+	}))
+	mux.HandleFunc("POST /admin/delivery/{strategy}", adminOnly(cfg.AdminToken, func(w http.ResponseWriter, r *http.Request) {
+		serveSetDelivery(hubs, w, r)
+	}))
+	return mux
+}
+
+func main() {
+	startTime = time.Now()
+	cfg := loadConfig()
+	if err := cfg.validate(); err != nil {
+		log.Fatal("設定エラー: ", err)
+	}
+	upgrader.ReadBufferSize = cfg.ReadBufferSize
+	upgrader.WriteBufferSize = cfg.WriteBufferSize
+	upgrader.EnableCompression = cfg.Compression
+	hubs := newHubRegistry(cfg)
+	if cfg.StatsInterval > 0 {
+		go hubs.logStats(cfg.StatsInterval)
+	}
+	if cfg.ReloadFile != "" || cfg.IPFilterFile != "" {
+		go hubs.watchReload()
+	}
+	if cfg.SpaceIdleTimeout > 0 {
+		go hubs.reapIdleSpaces(cfg.SpaceIdleTimeout)
+	}
+	go hubs.shutdownOnSignal(cfg.DrainWindow)
+
+	mux := newMux(cfg, hubs)
+
+	if cfg.SocketPath != "" {
+		ln, err := listenUnix(cfg.SocketPath, cfg.SocketMode)
+		if err != nil {
+			log.Fatal("listen error:", err)
+		}
+		log.Println("WebSocket server started on unix socket", cfg.SocketPath)
+		if err := http.Serve(ln, mux); err != nil {
+			log.Fatal("Serve error:", err)
+		}
+		return
+	}
 
-	add := ":8080"
+	add := cfg.Addr
 	log.Println("WebSocket server started on", add)
-	if err := http.ListenAndServe(add, nil); err != nil {
+	if err := http.ListenAndServe(add, mux); err != nil {
 		log.Fatal("ListenAndServe error:", err)
 	}
 }
\ No newline at end of file
@@ -0,0 +1,1400 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"app/wstest"
+
+	"github.com/gorilla/websocket"
+)
+
+func init() {
+	// 単一書き込みの約束が破られたら、ログに出して見逃さないよう、テストではpanicさせる
+	panicOnConcurrentWrite = true
+}
+
+// テスト用のwsConn
+// 実際のソケットの代わりに、読み込ませるメッセージを渡したり、書き込まれたフレームを確かめたり、
+// 書き込みエラーを起こしたりできる
+type fakeConn struct {
+	// ReadMessageが返すメッセージ。閉じるとReadMessageはエラー(readErr、nilならio.ErrUnexpectedEOF)を返す
+	reads chan []byte
+	readErr error
+
+	mu sync.Mutex
+	frames []fakeFrame
+	// 成功させる書き込みの回数と、それを超えた書き込みで返すエラー(nilの場合は失敗させない)
+	failAfter int
+	writeErr error
+	writesDone int
+	// nilでなければ、閉じられるまで書き込みを止める
+	gate chan struct{}
+	// 書き込み用のwriterを返すまでにかける時間(遅い回線の代わり)
+	writerDelay time.Duration
+	// 開いたまま閉じられていないwriterの数
+	openWriters int
+	compress bool
+
+	// 書き込み中の数。2以上になったら並行して書き込まれている
+	writing atomic.Int32
+	concurrent atomic.Bool
+
+	closed chan struct{}
+	closeOnce sync.Once
+}
+
+// 書き込まれたフレーム
+type fakeFrame struct {
+	typ int
+	data []byte
+	compressed bool
+}
+
+func newFakeConn() *fakeConn {
+	return &fakeConn{reads: make(chan []byte, 16), closed: make(chan struct{})}
+}
+
+// n回目より後の書き込みをerrで失敗させる
+func (c *fakeConn) failWrites(n int, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.failAfter, c.writeErr = n, err
+}
+
+// 書き込みを止める。unstallを呼ぶまで、書き込みは戻らない
+func (c *fakeConn) stall() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gate = make(chan struct{})
+}
+
+// 止めていた書き込みを再開する
+func (c *fakeConn) unstall() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	close(c.gate)
+	c.gate = nil
+}
+
+// 書き込みを1回数え、失敗させる場合はエラーを返す
+func (c *fakeConn) write() error {
+	c.mu.Lock()
+	if gate := c.gate; gate != nil {
+		c.mu.Unlock()
+		<-gate
+		c.mu.Lock()
+	}
+	defer c.mu.Unlock()
+	if c.writeErr != nil && c.writesDone >= c.failAfter {
+		return c.writeErr
+	}
+	c.writesDone++
+	return nil
+}
+
+func (c *fakeConn) begin() {
+	if c.writing.Add(1) > 1 {
+		c.concurrent.Store(true)
+	}
+}
+
+func (c *fakeConn) end() {
+	c.writing.Add(-1)
+}
+
+func (c *fakeConn) record(typ int, data []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.frames = append(c.frames, fakeFrame{typ: typ, data: bytes.Clone(data), compressed: c.compress})
+}
+
+// 書き込まれたテキストフレームを、まとめられた分も1件ずつに分けて返す
+func (c *fakeConn) messages() []string {
+	var messages []string
+	for _, f := range c.written() {
+		if f.typ == websocket.TextMessage {
+			messages = append(messages, strings.Split(string(f.data), "\n")...)
+		}
+	}
+	return messages
+}
+
+// 読み込ませるメッセージを終わりにし、以降のReadMessageでerrを返す
+func (c *fakeConn) closeReads(err error) {
+	c.readErr = err
+	close(c.reads)
+}
+
+// これまでに書き込まれたフレームを返す
+func (c *fakeConn) written() []fakeFrame {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]fakeFrame(nil), c.frames...)
+}
+
+func (c *fakeConn) isClosed() bool {
+	select {
+	case <-c.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *fakeConn) ReadMessage() (int, []byte, error) {
+	select {
+	case m, ok := <-c.reads:
+		if !ok {
+			if c.readErr != nil {
+				return 0, nil, c.readErr
+			}
+			return 0, nil, io.ErrUnexpectedEOF
+		}
+		return websocket.TextMessage, m, nil
+	case <-c.closed:
+		return 0, nil, net.ErrClosed
+	}
+}
+
+func (c *fakeConn) NextWriter(messageType int) (io.WriteCloser, error) {
+	time.Sleep(c.writerDelay)
+	if err := c.write(); err != nil {
+		return nil, err
+	}
+	c.begin()
+	c.mu.Lock()
+	c.openWriters++
+	c.mu.Unlock()
+	return &fakeWriter{conn: c, typ: messageType}, nil
+}
+
+func (c *fakeConn) WriteMessage(messageType int, data []byte) error {
+	c.begin()
+	defer c.end()
+	if err := c.write(); err != nil {
+		return err
+	}
+	c.record(messageType, data)
+	return nil
+}
+
+func (c *fakeConn) SetReadLimit(int64) {}
+func (c *fakeConn) SetReadDeadline(time.Time) error { return nil }
+func (c *fakeConn) SetWriteDeadline(time.Time) error { return nil }
+func (c *fakeConn) SetPongHandler(func(string) error) {}
+func (c *fakeConn) SetCloseHandler(func(int, string) error) {}
+
+func (c *fakeConn) EnableWriteCompression(enable bool) {
+	c.mu.Lock()
+	c.compress = enable
+	c.mu.Unlock()
+}
+
+func (c *fakeConn) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	return nil
+}
+
+// 1つのフレームを組み立てるwriter。閉じたときにフレームとして記録する
+type fakeWriter struct {
+	conn *fakeConn
+	typ int
+	buf bytes.Buffer
+	failed bool
+	closed bool
+}
+
+func (w *fakeWriter) Write(p []byte) (int, error) {
+	if err := w.conn.write(); err != nil {
+		w.failed = true
+		return 0, err
+	}
+	return w.buf.Write(p)
+}
+
+func (w *fakeWriter) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	w.conn.mu.Lock()
+	w.conn.openWriters--
+	w.conn.mu.Unlock()
+	w.conn.end()
+	// 途中で失敗したフレームは届かない
+	if !w.failed {
+		w.conn.record(w.typ, w.buf.Bytes())
+	}
+	return nil
+}
+
+var _ wsConn = (*fakeConn)(nil)
+
+// cfgでhubを起動し、テストの終わりに停止する
+func startHub(t *testing.T, cfg Config) *Hub {
+	t.Helper()
+	return startHubWith(t, cfg, nil)
+}
+
+// cfgでhubを作り、setupでコールバックなどを設定してから起動する
+func startHubWith(t *testing.T, cfg Config, setup func(*Hub)) *Hub {
+	t.Helper()
+	h := newHub(cfg)
+	if setup != nil {
+		setup(h)
+	}
+	go h.run()
+	t.Cleanup(h.Close)
+	return h
+}
+
+// fakeConnを使うクライアントを作る(hubには登録しない)
+func newFakeClient(h *Hub) (*Client, *fakeConn) {
+	conn := newFakeConn()
+	c := &Client{
+		hub: h,
+		id: newClientID(),
+		conn: conn,
+		send: make(chan outbound, sendBufferSize),
+		connectedAt: time.Now(),
+		rates: h.live.Load().rateProfile(""),
+	}
+	return c, conn
+}
+
+// fakeConnを使うクライアントをhubに登録する。pumpは起動しない
+func addFakeClient(t *testing.T, h *Hub) (*Client, *fakeConn) {
+	t.Helper()
+	c, conn := newFakeClient(h)
+	if !h.registerClient(c) {
+		t.Fatal("クライアントを登録できませんでした")
+	}
+	return c, conn
+}
+
+// fakeConnを使うクライアントをhubに登録し、serveWsと同じようにpumpを起動する
+func connectFake(t *testing.T, h *Hub) (*Client, *fakeConn) {
+	t.Helper()
+	c, conn := newFakeClient(h)
+	h.pumps.Add(2)
+	if !h.registerClient(c) {
+		h.pumps.Add(-2)
+		t.Fatal("クライアントを登録できませんでした")
+	}
+	go c.readPump()
+	go c.writePump()
+	return c, conn
+}
+
+// cfgで全スペースのhubを起動し、mainと同じエンドポイントを持つテスト用サーバーを立てる
+// 接続先のURL(ws://...)を返す。hubとサーバーはテストの終わりに停止する
+func startServer(t *testing.T, cfg Config) (*hubRegistry, string) {
+	t.Helper()
+	reg := newHubRegistry(cfg)
+	srv := httptest.NewServer(newMux(cfg, reg))
+	t.Cleanup(srv.Close)
+	t.Cleanup(reg.Close)
+	return reg, "ws" + strings.TrimPrefix(srv.URL, "http")
+}
+
+// ログの出力先を差し替えて、テストの間に出力されたログを集める
+type logBuffer struct {
+	mu sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *logBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func captureLog(t *testing.T) *logBuffer {
+	b := &logBuffer{}
+	log.SetOutput(b)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	return b
+}
+
+// condがtrueになるまで待つ。期限までにならなければテストを失敗させる
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(3 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("%s を待ちましたが、期限までになりませんでした", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestWritePumpSendsBufferedBatchBeforeClose(t *testing.T) {
+	h := startHub(t, defaultConfig())
+	c, conn := addFakeClient(t, h)
+	for _, m := range []string{`{"n":1}`, `{"n":2}`, `{"n":3}`} {
+		h.sendTo(c, []byte(m))
+	}
+	// 送信バッファに溜まったままsendが閉じられた状態で、writePumpを動かす
+	h.unregisterClient(c, reasonShutdown)
+	h.pumps.Add(1)
+	go c.writePump()
+	eventually(t, "接続が閉じられる", conn.isClosed)
+
+	frames := conn.written()
+	if len(frames) != 3 {
+		t.Fatalf("フレーム数 = %d, want 3 (まとめたメッセージ、再接続の案内、クローズ): %+v", len(frames), frames)
+	}
+	if got, want := string(frames[0].data), `{"n":1}`+"\n"+`{"n":2}`+"\n"+`{"n":3}`; got != want {
+		t.Errorf("まとめたフレーム = %q, want %q", got, want)
+	}
+	if got := messageType(frames[1].data); got != "disconnect" {
+		t.Errorf("2番目のフレームの種類 = %q, want disconnect", got)
+	}
+	if frames[2].typ != websocket.CloseMessage {
+		t.Errorf("最後のフレームの種類 = %d, want クローズフレーム", frames[2].typ)
+	}
+}
+
+func TestWritePumpStopsOnWriteError(t *testing.T) {
+	h := startHub(t, defaultConfig())
+	c, conn := connectFake(t, h)
+	conn.failWrites(0, errors.New("broken pipe"))
+	h.sendTo(c, []byte(`{"type":"chat"}`))
+
+	eventually(t, "書き込みエラーによる切断", func() bool {
+		return h.Disconnects()[reasonWriteError] == 1
+	})
+	eventually(t, "pumpの終了", func() bool { return h.activePumps.Load() == 0 })
+	if !conn.isClosed() {
+		t.Error("書き込みエラーの後も接続が閉じられていません")
+	}
+	if n := h.ClientCount(); n != 0 {
+		t.Errorf("ClientCount = %d, want 0", n)
+	}
+}
+
+func TestReadPumpRelaysAndUnregistersOnReadError(t *testing.T) {
+	h := startHub(t, defaultConfig())
+	_, sender := connectFake(t, h)
+	_, receiver := connectFake(t, h)
+
+	sender.reads <- []byte(`{"type":"chat","text":"hi"}`)
+	eventually(t, "ブロードキャストの受信", func() bool {
+		for _, f := range receiver.written() {
+			if messageType(f.data) == "chat" {
+				return true
+			}
+		}
+		return false
+	})
+
+	close(sender.reads)
+	eventually(t, "読み込みエラーによる切断", func() bool {
+		return h.Disconnects()[reasonReadError] == 1
+	})
+	eventually(t, "送信側の接続が閉じられる", sender.isClosed)
+	if n := h.ClientCount(); n != 1 {
+		t.Errorf("ClientCount = %d, want 1", n)
+	}
+}
+
+func TestServerRelaysBetweenClients(t *testing.T) {
+	_, url := startServer(t, defaultConfig())
+	alice := wstest.Dial(t, url+"/ws")
+	defer alice.Close()
+	bob := wstest.Dial(t, url+"/ws", wstest.WithQuery("version", "1"))
+	defer bob.Close()
+	alice.Expect("welcome")
+	bob.Expect("welcome")
+
+	alice.SendJSON(map[string]any{"type": "chat", "text": "hello"})
+	if m := bob.Expect("chat"); m["text"] != "hello" {
+		t.Errorf("受信したメッセージ = %v", m)
+	}
+	// 送信者自身にも届く
+	alice.Expect("chat")
+}
+
+func TestBackpressureHoldsBroadcastsUntilQueueDrains(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.MaxInFlight = 4
+	h := startHub(t, cfg)
+	// writePumpを動かさず、送信バッファに溜まる一方のクライアント
+	c, _ := addFakeClient(t, h)
+
+	published := make(chan struct{}, 10)
+	go func() {
+		for i := 0; i < 6; i++ {
+			h.publish([]byte(`{"type":"chat"}`))
+			published <- struct{}{}
+		}
+	}()
+	eventually(t, "未配信メッセージが上限に達する", func() bool { return h.Queued() == 4 })
+	time.Sleep(50 * time.Millisecond)
+	if n := len(published); n != 4 {
+		t.Fatalf("上限に達した後も受け取ったブロードキャスト = %d, want 4", n)
+	}
+	if q := h.Stats().Queued; q != 4 {
+		t.Errorf("Stats.Queued = %d, want 4", q)
+	}
+
+	// writePumpが1件送ったのと同じように取り出すと、次のブロードキャストを受け取る
+	m, _ := c.take()
+	c.buffer(-1, -len(m.data))
+	eventually(t, "受信の再開", func() bool { return len(published) == 5 })
+	time.Sleep(50 * time.Millisecond)
+	if n := len(published); n != 5 {
+		t.Errorf("1件空いた後に受け取ったブロードキャスト = %d, want 5", n)
+	}
+}
+
+func TestBackpressureCountsQueuedMessagesAcrossSpaces(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.MaxInFlight = 4
+	reg := newHubRegistry(cfg)
+	defer reg.Close()
+	room1 := reg.all()[defaultSpace]
+	room2, _ := reg.get("room2")
+	c, _ := addFakeClient(t, room1)
+	addFakeClient(t, room2)
+	for i := 0; i < 3; i++ {
+		room1.publish([]byte(`{"type":"chat"}`))
+	}
+	room1.do(func() {})
+
+	// room2だけでは上限に達していないが、全スペースの合計では上限に達する
+	published := make(chan struct{}, 10)
+	go func() {
+		for i := 0; i < 3; i++ {
+			room2.publish([]byte(`{"type":"chat"}`))
+			published <- struct{}{}
+		}
+	}()
+	eventually(t, "未配信メッセージが上限に達する", func() bool { return reg.totals.queued.Load() == 4 })
+	time.Sleep(50 * time.Millisecond)
+	if n := len(published); n != 1 {
+		t.Fatalf("合計が上限に達した後もroom2が受け取ったブロードキャスト = %d, want 1", n)
+	}
+
+	// 他のスペースで送信が進めば、room2も受け取りを再開する
+	room1.do(func() {
+		m, _ := c.take()
+		c.buffer(-1, -len(m.data))
+	})
+	eventually(t, "受信の再開", func() bool { return len(published) == 2 })
+}
+
+func TestOversizedMessageIsLoggedPerClientAndClosedWith1009(t *testing.T) {
+	logs := captureLog(t)
+	cfg := defaultConfig()
+	cfg.ReadLimit = 64
+	reg, url := startServer(t, cfg)
+
+	var ids []string
+	for i := 0; i < 2; i++ {
+		c := wstest.Dial(t, url+"/ws")
+		defer c.Close()
+		ids = append(ids, c.Expect("welcome")["client_id"].(string))
+		c.SendJSON(map[string]any{"type": "chat", "text": strings.Repeat("x", 100)})
+		_, err := c.ReadMessage()
+		if !websocket.IsCloseError(err, websocket.CloseMessageTooBig) {
+			t.Errorf("上限を超えた後の受信 = %v, want クローズコード1009", err)
+		}
+	}
+	hub := reg.all()[defaultSpace]
+	eventually(t, "受信サイズ超過による切断", func() bool { return hub.Disconnects()[reasonTooLarge] == 2 })
+	if n := hub.Disconnects()[reasonReadError]; n != 0 {
+		t.Errorf("読み込みエラーとして数えられた切断 = %d, want 0", n)
+	}
+	// 同じ期間内に続けて起きても、クライアントごとに出力される
+	for _, id := range ids {
+		if !strings.Contains(logs.String(), "クライアント "+id+" が受信サイズの上限(64バイト)を超えた") {
+			t.Errorf("クライアント %s の受信サイズ超過がログに出力されていません:\n%s", id, logs)
+		}
+	}
+}
+
+func TestWritesAfterReadLimitCloseAreNotWriteErrors(t *testing.T) {
+	logs := captureLog(t)
+	writeErrors := make(chan error, 4)
+	h := startHubWith(t, defaultConfig(), func(h *Hub) {
+		h.OnWriteError = func(c *Client, err error) { writeErrors <- err }
+	})
+	_, conn := connectFake(t, h)
+	conn.stall()
+	conn.failWrites(0, websocket.ErrCloseSent)
+	h.publish([]byte(`{"type":"chat"}`))
+
+	// 上限を大きく超えたメッセージを受け取ると、gorilla/websocketがクローズフレームを送ってから
+	// ErrReadLimitを返し、以降の書き込みはErrCloseSentになる
+	conn.closeReads(websocket.ErrReadLimit)
+	eventually(t, "受信サイズ超過による切断", func() bool { return h.Disconnects()[reasonTooLarge] == 1 })
+	conn.unstall()
+	eventually(t, "writePumpの終了", func() bool { return h.activePumps.Load() == 0 })
+
+	if len(writeErrors) != 0 {
+		t.Errorf("クローズフレームを送った後の書き込みがOnWriteErrorに渡されました: %v", <-writeErrors)
+	}
+	if strings.Contains(logs.String(), "writePump エラー") {
+		t.Errorf("クローズフレームを送った後の書き込みがエラーとして出力されました:\n%s", logs)
+	}
+	if n := h.Disconnects()[reasonWriteError]; n != 0 {
+		t.Errorf("書き込みエラーとして数えられた切断 = %d, want 0", n)
+	}
+}
+
+func TestConcurrentWriteGuardTrips(t *testing.T) {
+	h := startHub(t, defaultConfig())
+	c, conn := newFakeClient(h)
+	// writePumpの代わりに書き込みを始め、書き込み中のまま止めておく
+	conn.stall()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c.writeBatch(outbound{data: []byte(`{"type":"chat"}`)})
+	}()
+	eventually(t, "書き込みの開始", func() bool { return c.writing.Load() })
+
+	// 書き込み中に別のゴルーチンから書き込むと、テストではpanicする
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("並行した書き込みでpanicしませんでした")
+			}
+		}()
+		c.writePing()
+	}()
+
+	conn.unstall()
+	<-done
+	if c.writing.Load() {
+		t.Error("書き込みを終えた後も書き込み中のままです")
+	}
+
+	// 本番ではpanicせずに警告を出力する
+	panicOnConcurrentWrite = false
+	t.Cleanup(func() { panicOnConcurrentWrite = true })
+	logs := captureLog(t)
+	c.writing.Store(true)
+	c.writePing()
+	if !strings.Contains(logs.String(), "クライアント "+c.id+" の接続に並行して書き込もうとしました") {
+		t.Errorf("並行した書き込みの警告が出力されていません: %q", logs.String())
+	}
+}
+
+func TestConcurrentServerSendsDoNotWriteConcurrently(t *testing.T) {
+	h := startHub(t, defaultConfig())
+	var clients []*Client
+	var conns []*fakeConn
+	for i := 0; i < 3; i++ {
+		c, conn := connectFake(t, h)
+		clients = append(clients, c)
+		conns = append(conns, conn)
+	}
+
+	// 宛先指定、全員へのお知らせ、条件付きのブロードキャストを複数のゴルーチンから同時に送る
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				h.SendTo(clients[j%len(clients)], []byte(`{"type":"direct"}`))
+				h.notifyAll([]byte(`{"type":"notice"}`))
+				h.BroadcastFunc(func(*Client) bool { return true }, []byte(`{"type":"event"}`))
+				h.publish([]byte(`{"type":"chat"}`))
+			}
+		}()
+	}
+	wg.Wait()
+	eventually(t, "全ての送信の書き込み", func() bool { return h.Queued() == 0 })
+
+	for i, conn := range conns {
+		if conn.concurrent.Load() {
+			t.Errorf("クライアント%dの接続に並行して書き込まれました", i)
+		}
+	}
+}
+
+func TestBroadcastRateSmoothsBursts(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.BroadcastRate = 20
+	h := startHub(t, cfg)
+	addFakeClient(t, h)
+
+	start := time.Now()
+	go func() {
+		for i := 0; i < 30; i++ {
+			h.publish([]byte(`{"type":"presence"}`))
+		}
+	}()
+	// 上限の1秒分(20件)はすぐに配信し、残りは1秒あたり20件の速さで配信する
+	time.Sleep(100 * time.Millisecond)
+	if n := h.broadcasts.Load(); n < 20 || n > 23 {
+		t.Errorf("最初の100msで配信した数 = %d, want 20〜23", n)
+	}
+	if !h.Stats().BroadcastLimited {
+		t.Error("頻度の上限に達しているのにBroadcastLimitedがfalseです")
+	}
+	eventually(t, "全件の配信", func() bool { return h.broadcasts.Load() == 30 })
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Errorf("30件の配信にかかった時間 = %v, want 約500ms以上", elapsed)
+	}
+	if n := h.Stats().BroadcastLimitedCount; n == 0 {
+		t.Error("BroadcastLimitedCount = 0")
+	}
+}
+
+func TestOnWriteErrorIsCalledAndClientUnregistered(t *testing.T) {
+	errs := make(chan error, 1)
+	h := startHubWith(t, defaultConfig(), func(h *Hub) {
+		h.OnWriteError = func(c *Client, err error) { errs <- err }
+	})
+	c, conn := connectFake(t, h)
+	injected := errors.New("connection reset by peer")
+	conn.failWrites(0, injected)
+	h.sendTo(c, []byte(`{"type":"chat"}`))
+
+	select {
+	case err := <-errs:
+		if !errors.Is(err, injected) {
+			t.Errorf("OnWriteErrorに渡されたエラー = %v, want %v", err, injected)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("OnWriteErrorが呼ばれません")
+	}
+	eventually(t, "登録の解除", func() bool { return h.ClientCount() == 0 })
+	// 登録を解除したクライアントには、以降のメッセージは届かない
+	if status := h.SendTo(c, []byte(`{"type":"chat"}`)); status != deliveryOffline {
+		t.Errorf("SendTo = %s, want %s", status, deliveryOffline)
+	}
+	if n := h.Disconnects()[reasonWriteError]; n != 1 {
+		t.Errorf("書き込みエラーによる切断 = %d, want 1", n)
+	}
+}
+
+func TestCloseStopsAllGoroutinesAndRejectsRegister(t *testing.T) {
+	before := runtime.NumGoroutine()
+	h := newHub(defaultConfig())
+	go h.run()
+	var conns []*fakeConn
+	for i := 0; i < 3; i++ {
+		_, conn := connectFake(t, h)
+		conns = append(conns, conn)
+	}
+
+	h.Close()
+	// 2回目以降は何もしない
+	h.Close()
+	for i, conn := range conns {
+		if !conn.isClosed() {
+			t.Errorf("クライアント%dの接続が閉じられていません", i)
+		}
+		frames := conn.written()
+		if len(frames) == 0 || frames[len(frames)-1].typ != websocket.CloseMessage {
+			t.Errorf("クライアント%dにクローズフレームが送られていません: %v", i, frames)
+		}
+	}
+	eventually(t, "ゴルーチンの終了", func() bool { return runtime.NumGoroutine() <= before })
+
+	c, _ := newFakeClient(h)
+	if h.registerClient(c) {
+		t.Error("停止したhubにクライアントを登録できました")
+	}
+}
+
+func TestClientCountStaysAccurateUnderConcurrentConnects(t *testing.T) {
+	h := startHub(t, defaultConfig())
+	const workers, perWorker = 8, 50
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < perWorker; i++ {
+				c, _ := newFakeClient(h)
+				if !h.registerClient(c) {
+					t.Error("クライアントを登録できませんでした")
+					return
+				}
+				// 同時に数を読んでも競合しない
+				h.ClientCount()
+				// 半分だけ切断させて、最後に残る数を確かめる
+				if i%2 == 0 {
+					h.unregisterClient(c, reasonClientClose)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	want := workers * perWorker / 2
+	h.do(func() {
+		if n := len(h.clients); n != want {
+			t.Errorf("登録中のクライアント = %d, want %d", n, want)
+		}
+	})
+	if n := h.ClientCount(); n != want {
+		t.Errorf("ClientCount = %d, want %d", n, want)
+	}
+}
+
+func TestCompressionSkipsFramesBelowThreshold(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Compression = true
+	cfg.CompressionThreshold = 64
+	h := startHub(t, cfg)
+	c, conn := newFakeClient(h)
+	c.compress = true
+	if !h.registerClient(c) {
+		t.Fatal("クライアントを登録できませんでした")
+	}
+	h.pumps.Add(1)
+	go c.writePump()
+
+	small := []byte(`{"type":"chat","text":"hi"}`)
+	large := []byte(`{"type":"chat","text":"` + strings.Repeat("a", 100) + `"}`)
+	h.sendTo(c, small)
+	eventually(t, "小さいフレームの送信", func() bool { return len(conn.written()) == 1 })
+	h.sendTo(c, large)
+	eventually(t, "大きいフレームの送信", func() bool { return len(conn.written()) == 2 })
+
+	frames := conn.written()
+	if frames[0].compressed {
+		t.Errorf("しきい値(%dバイト)未満の%dバイトのフレームが圧縮されました", cfg.CompressionThreshold, len(small))
+	}
+	if !frames[1].compressed {
+		t.Errorf("しきい値(%dバイト)以上の%dバイトのフレームが圧縮されていません", cfg.CompressionThreshold, len(large))
+	}
+}
+
+func TestBroadcastFuncDeliversOnlyToMatchingClients(t *testing.T) {
+	h := startHub(t, defaultConfig())
+	regions := []string{"us", "eu", "us", "jp"}
+	clients := make([]*Client, len(regions))
+	for i, region := range regions {
+		clients[i], _ = addFakeClient(t, h)
+		clients[i].SetSession(region)
+	}
+	region := func(want string) func(*Client) bool {
+		return func(c *Client) bool { return c.Session() == want }
+	}
+
+	h.BroadcastFunc(region("us"), []byte(`{"type":"announce","n":1}`))
+	h.BroadcastFunc(region("jp"), []byte(`{"type":"announce","n":2}`))
+	h.BroadcastFunc(region("cn"), []byte(`{"type":"announce","n":3}`))
+	h.BroadcastFunc(func(*Client) bool { return true }, []byte(`{"type":"announce","n":4}`))
+	h.do(func() {
+		want := map[string]int{"us": 2, "eu": 1, "jp": 2}
+		for i, c := range clients {
+			if n := len(c.send); n != want[regions[i]] {
+				t.Errorf("クライアント%d(%s)の送信バッファの件数 = %d, want %d", i, regions[i], n, want[regions[i]])
+			}
+		}
+	})
+}
+
+func TestSlowClientWarningFiresAtWatermark(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.SlowClientWatermark = 4
+	warned := make(chan int, 4)
+	h := startHubWith(t, cfg, func(h *Hub) {
+		h.OnSlowClient = func(c *Client, queued int) { warned <- queued }
+	})
+	logs := captureLog(t)
+	c, _ := addFakeClient(t, h)
+
+	for i := 0; i < 3; i++ {
+		h.sendTo(c, []byte(`{"type":"chat"}`))
+	}
+	h.do(func() {})
+	if len(warned) != 0 {
+		t.Fatalf("警告水位の手前で警告されました: %d", <-warned)
+	}
+	// 警告水位に達したときに1回だけ知らせる
+	for i := 0; i < 3; i++ {
+		h.sendTo(c, []byte(`{"type":"chat"}`))
+	}
+	h.do(func() {})
+	if len(warned) != 1 {
+		t.Fatalf("警告の回数 = %d, want 1", len(warned))
+	}
+	if queued := <-warned; queued != cfg.SlowClientWatermark {
+		t.Errorf("警告したときの件数 = %d, want %d", queued, cfg.SlowClientWatermark)
+	}
+	if !strings.Contains(logs.String(), "クライアント "+c.id+" の送信バッファが警告水位を超えました(4/") {
+		t.Errorf("クライアントIDを含む警告が出力されていません: %q", logs.String())
+	}
+	if n := h.Stats().SlowWarnings; n != 1 {
+		t.Errorf("SlowWarnings = %d, want 1", n)
+	}
+	if n := h.ClientCount(); n != 1 {
+		t.Errorf("警告したクライアントが切断されました: ClientCount = %d", n)
+	}
+}
+
+func TestPersistentlySlowClientIsDemotedInsteadOfEvicted(t *testing.T) {
+	for _, demoteAfter := range []int{0, 2} {
+		t.Run(fmt.Sprintf("demote-after=%d", demoteAfter), func(t *testing.T) {
+			cfg := defaultConfig()
+			cfg.SlowClientWatermark = 4
+			cfg.DemoteAfter = demoteAfter
+			h := startHub(t, cfg)
+			c, _ := addFakeClient(t, h)
+			// 警告水位を超えて追いついた後、もう一度警告水位を超える
+			for i := 0; i < 2; i++ {
+				for j := 0; j < cfg.SlowClientWatermark; j++ {
+					h.publish([]byte(`{"type":"chat"}`))
+				}
+				if i == 0 {
+					h.do(func() {
+						for len(c.send) > 0 {
+							<-c.send
+						}
+					})
+				}
+			}
+			// 追いつけなくなるまでブロードキャストする
+			for i := 0; i < sendBufferSize+10; i++ {
+				h.publish([]byte(`{"type":"chat"}`))
+			}
+			h.do(func() {})
+
+			st := h.Stats()
+			if demoteAfter == 0 {
+				if st.Clients != 0 || st.Evictions != 1 || st.Demotions != 0 {
+					t.Errorf("切り替えない場合の統計 = clients %d, evictions %d, demotions %d, want 0, 1, 0", st.Clients, st.Evictions, st.Demotions)
+				}
+				return
+			}
+			if st.Clients != 1 || st.Evictions != 0 || st.Demotions != 1 {
+				t.Fatalf("統計 = clients %d, evictions %d, demotions %d, want 1, 0, 1", st.Clients, st.Evictions, st.Demotions)
+			}
+			if st.DemotedSkips != uint64(sendBufferSize+10) {
+				t.Errorf("DemotedSkips = %d, want %d", st.DemotedSkips, sendBufferSize+10)
+			}
+			// 切り替えたことを知らせた後は、宛先を指定したメッセージだけが届く
+			h.sendTo(c, []byte(`{"type":"direct"}`))
+			h.do(func() {
+				var got []string
+				for len(c.send) > 0 {
+					m := <-c.send
+					got = append(got, string(m.data))
+				}
+				want := []string{`{"type":"chat"}`, `{"type":"chat"}`, `{"type":"chat"}`, `{"type":"chat"}`, string(unicastOnlyMessage), `{"type":"direct"}`}
+				if !slices.Equal(got, want) {
+					t.Errorf("切り替えた後の送信バッファ = %q, want %q", got, want)
+				}
+			})
+		})
+	}
+}
+
+func TestClientWithoutCompressionGetsUncompressedFrames(t *testing.T) {
+	saved := upgrader.EnableCompression
+	t.Cleanup(func() { upgrader.EnableCompression = saved })
+	upgrader.EnableCompression = true
+	cfg := defaultConfig()
+	cfg.Compression = true
+	_, url := startServer(t, cfg)
+	plain := wstest.Dial(t, url+"/ws")
+	defer plain.Close()
+	deflate := wstest.Dial(t, url+"/ws", wstest.WithCompression())
+	defer deflate.Close()
+
+	hasCompression := func(m map[string]any) bool {
+		caps, _ := m["capabilities"].([]any)
+		for _, c := range caps {
+			if c == "compression" {
+				return true
+			}
+		}
+		return false
+	}
+	if hasCompression(plain.Expect("welcome")) {
+		t.Error("圧縮を申し出ていないクライアントに compression が通知されました")
+	}
+	if !hasCompression(deflate.Expect("welcome")) {
+		t.Error("圧縮を申し出たクライアントに compression が通知されていません")
+	}
+
+	// しきい値を超える大きさのメッセージでも、圧縮できないクライアントには圧縮せずに送る
+	// (圧縮したフレームが届くと、クライアントはプロトコル違反として読み込みに失敗する)
+	text := strings.Repeat("a", cfg.CompressionThreshold+100)
+	plain.SendJSON(map[string]any{"type": "chat", "text": text})
+	for name, c := range map[string]*wstest.Client{"圧縮なし": plain, "圧縮あり": deflate} {
+		if m := c.Expect("chat"); m["text"] != text {
+			t.Errorf("%sのクライアントが受信したメッセージが一致しません", name)
+		}
+	}
+}
+
+func TestWritePumpSkipsStaleMessages(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.MaxQueueAge = 50 * time.Millisecond
+	h := startHub(t, cfg)
+	c, conn := addFakeClient(t, h)
+	h.sendTo(c, []byte(`{"n":1}`))
+	h.sendTo(c, []byte(`{"n":2}`))
+	// writePumpが止まっている間に古くなったことにする
+	time.Sleep(2 * cfg.MaxQueueAge)
+	h.sendTo(c, []byte(`{"n":3}`))
+
+	h.pumps.Add(1)
+	go c.writePump()
+	eventually(t, "新しいメッセージの送信", func() bool { return len(conn.written()) == 1 })
+	if got := string(conn.written()[0].data); got != `{"n":3}` {
+		t.Errorf("送信したフレーム = %q, want 古くなっていないメッセージだけ", got)
+	}
+	if n := h.Stats().StaleDrops; n != 2 {
+		t.Errorf("StaleDrops = %d, want 2", n)
+	}
+}
+
+func TestSheddingReducesDisconnectsUnderLoad(t *testing.T) {
+	// 送信が止まったクライアントが多数いる状態で、優先度の低いメッセージを大量に流す
+	run := func(shedThreshold float64) (overloaded uint64, shed uint64) {
+		cfg := defaultConfig()
+		cfg.ShedThreshold = shedThreshold
+		cfg.LowPriorityTypes = []string{"presence"}
+		h := startHub(t, cfg)
+		for i := 0; i < 4; i++ {
+			connectFake(t, h)
+		}
+		for i := 0; i < 6; i++ {
+			addFakeClient(t, h)
+		}
+		for i := 0; i < 2*sendBufferSize; i++ {
+			h.publish([]byte(`{"type":"presence"}`))
+			if i%20 == 0 {
+				h.publish([]byte(`{"type":"chat"}`))
+			}
+		}
+		h.do(func() {})
+		return h.Disconnects()[reasonOverload], h.Stats().ShedDrops
+	}
+
+	without, _ := run(0)
+	with, shed := run(0.5)
+	if without < 6 {
+		t.Errorf("間引きなしでの切断 = %d, want 送信が止まった6人以上", without)
+	}
+	if with >= without {
+		t.Errorf("間引きありでの切断 = %d, want 間引きなし(%d)より少ない", with, without)
+	}
+	if shed == 0 {
+		t.Error("優先度の低いメッセージが間引かれていません")
+	}
+	t.Logf("切断: 間引きなし=%d 間引きあり=%d (間引いたメッセージ=%d)", without, with, shed)
+}
+
+func TestQueuedMessagesAreFlushedOnClientClose(t *testing.T) {
+	h := startHub(t, defaultConfig())
+	c, conn := addFakeClient(t, h)
+	for _, m := range []string{`{"n":1}`, `{"n":2}`, `{"n":3}`} {
+		h.sendTo(c, []byte(m))
+	}
+	// 送信バッファに溜まった状態でクライアントからクローズフレームが届く
+	conn.closeReads(&websocket.CloseError{Code: websocket.CloseNormalClosure})
+	h.pumps.Add(2)
+	go c.readPump()
+	go c.writePump()
+	eventually(t, "接続が閉じられる", conn.isClosed)
+
+	// まとめ方はwritePumpが読み出した時点の溜まり具合で変わるため、中身だけを確かめる
+	frames := conn.written()
+	if len(frames) < 2 || frames[len(frames)-1].typ != websocket.CloseMessage {
+		t.Fatalf("フレーム = %+v, want 溜まっていたメッセージの後にクローズフレーム", frames)
+	}
+	var delivered []string
+	for _, f := range frames[:len(frames)-1] {
+		delivered = append(delivered, string(f.data))
+	}
+	if got, want := strings.Join(delivered, "\n"), `{"n":1}`+"\n"+`{"n":2}`+"\n"+`{"n":3}`; got != want {
+		t.Errorf("送り切ったメッセージ = %q, want %q", got, want)
+	}
+	if n := h.Disconnects()[reasonClientClose]; n != 1 {
+		t.Errorf("クライアントからの切断 = %d, want 1", n)
+	}
+}
+
+func TestFragmentedMessagesAreAssembledUpToReadLimit(t *testing.T) {
+	cfg := defaultConfig()
+	reg, url := startServer(t, cfg)
+	// 受信サイズの上限より小さいフレームに分割して送る
+	sender := wstest.Dial(t, url+"/ws", wstest.WithWriteBufferSize(64))
+	defer sender.Close()
+	sender.Expect("welcome")
+
+	within := strings.Repeat("x", int(cfg.ReadLimit)-64)
+	sender.SendJSON(map[string]any{"type": "chat", "text": within})
+	if m := sender.Expect("chat"); m["text"] != within {
+		t.Errorf("分割して送った上限以内のメッセージが組み立てられていません: %d文字", len(m["text"].(string)))
+	}
+
+	// 分割された各フレームは上限以内でも、合計が上限を超えたら拒否する
+	sender.SendJSON(map[string]any{"type": "chat", "text": strings.Repeat("x", int(cfg.ReadLimit))})
+	if _, err := sender.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseMessageTooBig) {
+		t.Errorf("上限を超えた後の受信 = %v, want クローズコード1009", err)
+	}
+	hub := reg.all()[defaultSpace]
+	eventually(t, "受信サイズ超過による切断", func() bool { return hub.Disconnects()[reasonTooLarge] == 1 })
+	if n := hub.Stats().Broadcasts; n != 1 {
+		t.Errorf("Broadcasts = %d, want 上限以内のメッセージの1件だけ", n)
+	}
+}
+
+func TestDisconnectReasonIsRecordedForEachPath(t *testing.T) {
+	tests := []struct {
+		reason string
+		cause func(h *Hub, c *Client, conn *fakeConn)
+	}{
+		{reasonClientClose, func(h *Hub, c *Client, conn *fakeConn) {
+			conn.closeReads(&websocket.CloseError{Code: websocket.CloseNormalClosure})
+		}},
+		{reasonReadError, func(h *Hub, c *Client, conn *fakeConn) {
+			conn.closeReads(nil)
+		}},
+		{reasonIdle, func(h *Hub, c *Client, conn *fakeConn) {
+			conn.closeReads(os.ErrDeadlineExceeded)
+		}},
+		{reasonWriteError, func(h *Hub, c *Client, conn *fakeConn) {
+			conn.failWrites(0, errors.New("broken pipe"))
+			h.sendTo(c, []byte(`{"type":"chat"}`))
+		}},
+		{reasonShutdown, func(h *Hub, c *Client, conn *fakeConn) {
+			h.Close()
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.reason, func(t *testing.T) {
+			reasons := make(chan string, 1)
+			h := startHubWith(t, defaultConfig(), func(h *Hub) {
+				h.OnDisconnect = func(c *Client, reason string) { reasons <- reason }
+			})
+			logs := captureLog(t)
+			c, conn := connectFake(t, h)
+			tt.cause(h, c, conn)
+
+			select {
+			case reason := <-reasons:
+				if reason != tt.reason {
+					t.Errorf("OnDisconnectの理由 = %s, want %s", reason, tt.reason)
+				}
+			case <-time.After(3 * time.Second):
+				t.Fatal("OnDisconnectが呼ばれません")
+			}
+			if n := h.Disconnects()[tt.reason]; n != 1 {
+				t.Errorf("Disconnects()[%s] = %d, want 1", tt.reason, n)
+			}
+			if want := "クライアントが切断されました id=" + c.id + " 理由=" + tt.reason; !strings.Contains(logs.String(), want) {
+				t.Errorf("切断のログに %q が含まれていません:\n%s", want, logs)
+			}
+		})
+	}
+}
+
+func TestSessionIsKeptAcrossMessages(t *testing.T) {
+	// 接続ごとに受け取ったメッセージの数を数える
+	type state struct{ received int }
+	h := startHubWith(t, defaultConfig(), func(h *Hub) {
+		h.Middleware = []Middleware{func(c *Client, m *Message) (*Message, error) {
+			s, _ := c.Session().(*state)
+			if s == nil {
+				s = &state{}
+				c.SetSession(s)
+			}
+			s.received++
+			return m, nil
+		}}
+	})
+	alice, aliceConn := connectFake(t, h)
+	bob, bobConn := connectFake(t, h)
+	if alice.Session() != nil {
+		t.Fatalf("設定する前のSession = %v, want nil", alice.Session())
+	}
+	for i := 0; i < 3; i++ {
+		aliceConn.reads <- []byte(`{"type":"chat"}`)
+	}
+	bobConn.reads <- []byte(`{"type":"chat"}`)
+	eventually(t, "メッセージの中継", func() bool { return h.Stats().Broadcasts == 4 })
+
+	for name, tt := range map[string]struct {
+		c *Client
+		want int
+	}{"alice": {alice, 3}, "bob": {bob, 1}} {
+		s, ok := tt.c.Session().(*state)
+		if !ok {
+			t.Errorf("%sのSession = %v, want *state", name, tt.c.Session())
+			continue
+		}
+		if s.received != tt.want {
+			t.Errorf("%sのSessionで数えたメッセージ = %d, want %d", name, s.received, tt.want)
+		}
+	}
+}
+
+func TestQueueAgeAlarmFiresOnBacklog(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.QueueAgeAlarm = 50 * time.Millisecond
+	h := startHub(t, cfg)
+	logs := captureLog(t)
+	connectFake(t, h)
+	_, conn := connectFake(t, h)
+
+	// 1人の書き込みが止まったまま、メッセージが溜まっていく
+	conn.stall()
+	for i := 0; i < 5; i++ {
+		h.publish([]byte(`{"type":"chat"}`))
+	}
+	time.Sleep(2 * cfg.QueueAgeAlarm)
+	h.do(h.sampleQueueAge)
+	st := h.Stats()
+	if !st.QueueAgeAlarm || st.OldestQueuedMs < cfg.QueueAgeAlarm.Milliseconds() {
+		t.Errorf("書き込みが止まっている間の統計 = alarm %v, oldest %dms, want true, %dms以上", st.QueueAgeAlarm, st.OldestQueuedMs, cfg.QueueAgeAlarm.Milliseconds())
+	}
+	if !strings.Contains(logs.String(), "送信バッファで50msより長く待っているメッセージがあります") {
+		t.Errorf("警告が出力されていません:\n%s", logs)
+	}
+
+	conn.unstall()
+	eventually(t, "送り終えた後の警告の解除", func() bool {
+		h.do(h.sampleQueueAge)
+		return !h.Stats().QueueAgeAlarm
+	})
+	if !strings.Contains(logs.String(), "送信バッファのメッセージの待ち時間が通常に戻りました") {
+		t.Errorf("警告の解除が出力されていません:\n%s", logs)
+	}
+}
+
+func TestSilentClientIsClosedAfterFirstMessageTimeout(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.FirstMessageTimeout = 100 * time.Millisecond
+	reg, url := startServer(t, cfg)
+	silent := wstest.Dial(t, url+"/ws")
+	defer silent.Close()
+	talker := wstest.Dial(t, url+"/ws")
+	defer talker.Close()
+	display := wstest.Dial(t, url+"/ws", wstest.WithQuery("mode", "readonly"))
+	defer display.Close()
+	for _, c := range []*wstest.Client{silent, talker, display} {
+		c.Expect("welcome")
+	}
+	start := time.Now()
+	talker.SendJSON(map[string]any{"type": "chat"})
+
+	// 何も送らない接続は、pongWaitを待たずに閉じられる
+	silent.Expect("chat")
+	if _, err := silent.ReadMessage(); err == nil {
+		t.Fatal("何も送らない接続が閉じられていません")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("閉じられるまでの時間 = %v, want 約%v", elapsed, cfg.FirstMessageTimeout)
+	}
+	hub := reg.all()[defaultSpace]
+	eventually(t, "最初のメッセージを待つ期限による切断", func() bool {
+		return hub.Disconnects()[reasonNoFirstMessage] == 1
+	})
+	// 最初のメッセージを送った接続と受信専用の接続は、期限を過ぎても残る
+	time.Sleep(2 * cfg.FirstMessageTimeout)
+	if n := hub.ClientCount(); n != 2 {
+		t.Errorf("ClientCount = %d, want 2", n)
+	}
+}
+
+func TestConnectionIsClosedAtMaxLifetime(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.MaxLifetime = 200 * time.Millisecond
+	reg, url := startServer(t, cfg)
+	start := time.Now()
+	c := wstest.Dial(t, url+"/ws")
+	defer c.Close()
+	c.Expect("welcome")
+	// 最大の接続時間までは、やり取りしていても切断しない
+	c.SendJSON(map[string]any{"type": "chat"})
+	c.Expect("chat")
+
+	if m := c.Expect("disconnect"); m["reason"] != reasonMaxLifetime || m["reconnect"] != true {
+		t.Errorf("再接続の案内 = %v, want reason %s, reconnect true", m, reasonMaxLifetime)
+	}
+	_, err := c.ReadMessage()
+	var ce *websocket.CloseError
+	if !errors.As(err, &ce) || ce.Code != websocket.CloseNormalClosure || ce.Text != "max lifetime reached" {
+		t.Errorf("案内の後の受信 = %v, want クローズコード1000 max lifetime reached", err)
+	}
+	if elapsed := time.Since(start); elapsed < cfg.MaxLifetime || elapsed > cfg.MaxLifetime+time.Second {
+		t.Errorf("切断までの時間 = %v, want 約%v", elapsed, cfg.MaxLifetime)
+	}
+	hub := reg.all()[defaultSpace]
+	eventually(t, "最大の接続時間による切断", func() bool { return hub.Disconnects()[reasonMaxLifetime] == 1 })
+}
+
+func TestSendToReportsDeliveryStatus(t *testing.T) {
+	h := startHub(t, defaultConfig())
+	c, _ := addFakeClient(t, h)
+	msg := []byte(`{"type":"dm"}`)
+
+	if status := h.SendTo(c, msg); status != deliveryDelivered {
+		t.Errorf("接続中のクライアントへのSendTo = %s, want %s", status, deliveryDelivered)
+	}
+	// writePumpを動かさずに送信バッファを満杯にしておく
+	h.do(func() {
+		for c.offer(msg) {
+		}
+	})
+	if status := h.SendTo(c, msg); status != deliveryBufferFull {
+		t.Errorf("送信バッファが満杯のクライアントへのSendTo = %s, want %s", status, deliveryBufferFull)
+	}
+	// 満杯だった宛先は切断されている
+	if status := h.SendTo(c, msg); status != deliveryOffline {
+		t.Errorf("切断したクライアントへのSendTo = %s, want %s", status, deliveryOffline)
+	}
+	if n := h.Disconnects()[reasonOverload]; n != 1 {
+		t.Errorf("送信バッファ超過による切断 = %d, want 1", n)
+	}
+
+	// 登録していないクライアントと、停止したhubのクライアント
+	other, _ := newFakeClient(h)
+	if status := h.SendTo(other, msg); status != deliveryOffline {
+		t.Errorf("登録していないクライアントへのSendTo = %s, want %s", status, deliveryOffline)
+	}
+	live, _ := addFakeClient(t, h)
+	h.Close()
+	if status := h.SendTo(live, msg); status != deliveryOffline {
+		t.Errorf("停止したhubでのSendTo = %s, want %s", status, deliveryOffline)
+	}
+}
+
+func TestWriteFailureMidBatchTearsDownCleanly(t *testing.T) {
+	h := startHub(t, defaultConfig())
+	logs := captureLog(t)
+	c, conn := addFakeClient(t, h)
+	for _, m := range []string{`{"n":1}`, `{"n":2}`, `{"n":3}`} {
+		h.sendTo(c, []byte(m))
+	}
+	// NextWriterと1件目の書き込みは成功し、区切りの改行を書いたところで失敗する
+	conn.failWrites(2, errors.New("connection reset by peer"))
+	h.pumps.Add(1)
+	go c.writePump()
+
+	eventually(t, "書き込みエラーによる切断", func() bool { return h.Disconnects()[reasonWriteError] == 1 })
+	eventually(t, "接続が閉じられる", conn.isClosed)
+	eventually(t, "pumpの終了", func() bool { return h.activePumps.Load() == 0 })
+	conn.mu.Lock()
+	open := conn.openWriters
+	conn.mu.Unlock()
+	if open != 0 {
+		t.Errorf("閉じられていないwriter = %d, want 0", open)
+	}
+	// 途中まで書いたフレームは送られたことにならない
+	if frames := conn.written(); len(frames) != 0 {
+		t.Errorf("フレーム = %+v, want なし", frames)
+	}
+	if n := h.ClientCount(); n != 0 {
+		t.Errorf("ClientCount = %d, want 0", n)
+	}
+	if want := "writePump エラー: クライアント " + c.id + ": connection reset by peer"; !strings.Contains(logs.String(), want) {
+		t.Errorf("ログに %q が含まれていません:\n%s", want, logs)
+	}
+}
+
+func TestRegistrationBurstBeyondLimitIsRejected(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.MaxPendingRegistrations = 3
+	reg, url := startServer(t, cfg)
+	hub := reg.all()[defaultSpace]
+	// hubを塞いで、アップグレードを終えた接続が登録待ちのまま溜まるようにする
+	release := make(chan struct{})
+	blocked := make(chan struct{})
+	go hub.do(func() {
+		close(blocked)
+		<-release
+	})
+	<-blocked
+
+	var accepted []*wstest.Client
+	rejected := 0
+	for i := 0; i < 8; i++ {
+		c, resp, err := wstest.DialErr(t, url+"/ws")
+		switch {
+		case err == nil:
+			accepted = append(accepted, c)
+		case resp != nil && resp.StatusCode == http.StatusServiceUnavailable:
+			if resp.Header.Get("Retry-After") == "" {
+				t.Error("断った応答にRetry-Afterがありません")
+			}
+			rejected++
+		default:
+			t.Fatalf("接続 %d: err=%v resp=%v", i, err, resp)
+		}
+	}
+	if len(accepted) != cfg.MaxPendingRegistrations || rejected != 8-cfg.MaxPendingRegistrations {
+		t.Errorf("受け付けた接続 = %d, 断った接続 = %d, want %d, %d", len(accepted), rejected, cfg.MaxPendingRegistrations, 8-cfg.MaxPendingRegistrations)
+	}
+	if st := hub.Stats(); st.PendingRegistrations != int64(cfg.MaxPendingRegistrations) || st.RegistrationRejects != uint64(rejected) {
+		t.Errorf("統計 = pending %d, rejects %d, want %d, %d", st.PendingRegistrations, st.RegistrationRejects, cfg.MaxPendingRegistrations, rejected)
+	}
+
+	// hubが空けば、待っていた接続は登録される
+	close(release)
+	for _, c := range accepted {
+		c.Expect("welcome")
+		c.Close()
+	}
+	eventually(t, "登録待ちがなくなる", func() bool { return hub.pendingRegistrations.Load() == 0 })
+}
+
+func TestPingsAreSentDuringLargeBacklog(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.MaxDrainPerWrite = 4
+	h := startHubWith(t, cfg, func(h *Hub) { h.pingInterval = 20 * time.Millisecond })
+	c, conn := newFakeClient(h)
+	conn.writerDelay = 5 * time.Millisecond
+	if !h.registerClient(c) {
+		t.Fatal("クライアントを登録できませんでした")
+	}
+	// 送り切るまでに何回かpingの間隔を過ぎるだけのメッセージを溜めておく
+	for i := 0; i < 120; i++ {
+		h.sendTo(c, []byte(`{"type":"chat"}`))
+	}
+	h.pumps.Add(1)
+	go c.writePump()
+	eventually(t, "溜まったメッセージの送信", func() bool { return len(conn.messages()) == 120 })
+
+	// 先頭のメッセージを送ってから最後のメッセージを送るまでの間にもpingを送っている
+	pings, text := 0, 0
+	for _, f := range conn.written() {
+		switch f.typ {
+		case websocket.TextMessage:
+			text += strings.Count(string(f.data), "\n") + 1
+		case websocket.PingMessage:
+			if text > 0 && text < 120 {
+				pings++
+			}
+		}
+	}
+	if pings < 2 {
+		t.Errorf("溜まったメッセージを送っている間のping = %d回, want 2回以上", pings)
+	}
+}
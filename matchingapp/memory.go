@@ -0,0 +1,137 @@
+package main
+
+import (
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// 全スペースのhubで共有する合計
+// 未配信メッセージの件数と送信バッファに溜められる量の上限、負荷の段階は、スペースごとではなくサーバー全体で数える
+type hubTotals struct {
+	// 全スペースの接続中のクライアント数(負荷の段階を決める)
+	clients atomic.Int64
+
+	// 全クライアントの送信バッファに溜まっている未配信メッセージの件数(Hub.maxInFlightと比べる)
+	queued atomic.Int64
+
+	// 全クライアントの送信バッファに溜められる合計バイト数(0で無制限)と、現在の合計
+	maxBufferedBytes int64
+	bufferedBytes atomic.Int64
+	// 合計が上限を超えているか
+	memoryAlarming atomic.Bool
+	// 合計が上限を超えたことをhubRegistry.watchMemoryに知らせる
+	overCap chan struct{}
+}
+
+// hubRegistryを通さずに作ったhubは自分だけの合計を持つ(上限を適用するのはhubRegistryのみ)
+func newHubTotals(cfg Config) *hubTotals {
+	return &hubTotals{maxBufferedBytes: cfg.MaxBufferedBytes, overCap: make(chan struct{}, 1)}
+}
+
+// 合計が上限を超えたままの間に、切断できるクライアントがいなかった場合に確かめ直す間隔
+const memoryRecheck = 100 * time.Millisecond
+
+// 送信バッファにメッセージを入れたときと取り出したときに、溜まっている件数とバイト数を数える
+// 全クライアントを走査せずに合計を知るため、hubと全スペースの合計も同時に増減する
+func (c *Client) buffer(count, n int) {
+	c.queued.Add(int64(count))
+	c.buffered.Add(int64(n))
+	c.hub.queued.Add(int64(count))
+	c.hub.bufferedBytes.Add(int64(n))
+	t := c.hub.totals
+	t.queued.Add(int64(count))
+	if total := t.bufferedBytes.Add(int64(n)); n > 0 && t.maxBufferedBytes > 0 && total > t.maxBufferedBytes {
+		select {
+		case t.overCap <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// hubからの登録解除とwritePumpの終了の両方が済んだら、送信バッファに残ったままの分をhubの合計から引く
+// (どちらが先に済むかは決まっていないため、後に済んだ方が引く)
+func (c *Client) settle() {
+	if c.settled.Add(1) == 2 {
+		c.release()
+	}
+}
+
+// 送信バッファに残ったままの分をhubと全スペースの合計から引く
+func (c *Client) release() {
+	count := c.queued.Swap(0)
+	c.hub.queued.Add(-count)
+	c.hub.totals.queued.Add(-count)
+	n := c.buffered.Swap(0)
+	c.hub.bufferedBytes.Add(-n)
+	c.hub.totals.bufferedBytes.Add(-n)
+}
+
+// 全スペースの送信バッファに溜まっているバイト数が上限を超えるたびに、enforceMemoryCapで減らす
+func (r *hubRegistry) watchMemory() {
+	var recheck <-chan time.Time
+	for {
+		select {
+		case <-r.totals.overCap:
+		case <-recheck:
+		case <-r.done:
+			return
+		}
+		recheck = nil
+		if !r.enforceMemoryCap() {
+			recheck = time.After(memoryRecheck)
+		}
+	}
+}
+
+// 全スペースの送信バッファに溜まっているバイト数が上限を超えていれば、
+// 全スペースのクライアントのうち最も多く溜めているものから順に、溜まっている分を捨てて切断する
+// クライアントごとの上限とは別の、メモリを使い切らないための最後の手段
+// 上限以下に戻せた場合はtrueを返す
+func (r *hubRegistry) enforceMemoryCap() bool {
+	t := r.totals
+	if t.bufferedBytes.Load() > t.maxBufferedBytes && !t.memoryAlarming.Swap(true) {
+		log.Printf("警告: 送信バッファに溜まっているメッセージが上限(%dバイト)を超えたため、溜まっている量の多いクライアントを切断します", t.maxBufferedBytes)
+	}
+	for t.bufferedBytes.Load() > t.maxBufferedBytes {
+		// 各hubのクライアントはそのhubのゴルーチンでしか触れないため、hubごとに順に探す
+		var slowest *Client
+		for _, hub := range r.all() {
+			hub.do(func() {
+				for client := range hub.clients {
+					if slowest == nil || client.buffered.Load() > slowest.buffered.Load() {
+						slowest = client
+					}
+				}
+			})
+		}
+		if slowest == nil || slowest.buffered.Load() == 0 {
+			// 残りはwritePumpが送信中の分のため、送り終わるのを待つ
+			return false
+		}
+		hub := slowest.hub
+		hub.do(func() { hub.shed(slowest) })
+	}
+	if t.memoryAlarming.Swap(false) {
+		log.Println("送信バッファに溜まっているメッセージが上限を下回りました")
+	}
+	return true
+}
+
+// 送信バッファに溜まっている分を捨てて切断する。hubのゴルーチンからのみ呼ぶこと
+func (h *Hub) shed(c *Client) {
+	if !h.clients[c] {
+		// 探している間に切断された
+		return
+	}
+	// writePumpが送り終わるのを待たずにすぐ減らすため、溜まっている分はここで捨てる
+	for {
+		m, ok := c.take()
+		if !ok {
+			break
+		}
+		c.buffer(-1, -len(m.data))
+	}
+	h.memoryEvictions.Add(1)
+	h.evict(c)
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestExceedingMaxBufferedBytesEvictsTheSlowestClientAcrossSpaces(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.MaxBufferedBytes = 1000
+	reg := newHubRegistry(cfg)
+	defer reg.Close()
+	logs := captureLog(t)
+	room1 := reg.all()[defaultSpace]
+	room2, _ := reg.get("room2")
+	slow1, _ := addFakeClient(t, room1)
+	slow2, _ := addFakeClient(t, room2)
+
+	message := []byte(fmt.Sprintf(`{"type":"chat","text":"%s"}`, strings.Repeat("a", 73)))
+	// スペースごとには上限を超えないが、合計では上限を超える
+	for i := 0; i < 6; i++ {
+		room1.publish(message)
+	}
+	for i := 0; i < 5; i++ {
+		room2.publish(message)
+	}
+	eventually(t, "溜めている量の最も多いクライアントの切断", func() bool { return room1.Stats().MemoryEvictions == 1 })
+	if st := reg.ClientCount(); st != 1 {
+		t.Errorf("ClientCount = %d, want 1", st)
+	}
+	room1.do(func() {
+		if _, ok := room1.clients[slow1]; ok || slow1.closeReason != reasonOverload {
+			t.Errorf("溜めている量の最も多いクライアントが切断されていません: 理由=%q", slow1.closeReason)
+		}
+	})
+	if n := reg.totals.bufferedBytes.Load(); n != 5*int64(len(message)) {
+		t.Errorf("切断した後の合計 = %d, want %d", n, 5*len(message))
+	}
+	eventually(t, "警告の解除", func() bool { return !room2.Stats().MemoryAlarm })
+
+	// 上限を超え続けることはなく、残ったクライアントも溜めすぎれば切断する
+	for i := 0; i < 6; i++ {
+		room2.publish(message)
+	}
+	eventually(t, "残ったクライアントの切断", func() bool { return room2.Stats().MemoryEvictions == 1 })
+	room2.do(func() {
+		if _, ok := room2.clients[slow2]; ok {
+			t.Error("上限を超えた後もクライアントが残っています")
+		}
+	})
+	if n := reg.totals.bufferedBytes.Load(); n > cfg.MaxBufferedBytes {
+		t.Errorf("溜まっているバイト数 = %d, want %d以下", n, cfg.MaxBufferedBytes)
+	}
+	for _, want := range []string{"送信バッファに溜まっているメッセージが上限(1000バイト)を超えた", "送信バッファに溜まっているメッセージが上限を下回りました"} {
+		if !strings.Contains(logs.String(), want) {
+			t.Errorf("ログに %q がありません: %q", want, logs.String())
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+// 中継する前のクライアントからのメッセージ
+type Message struct {
+	// "type"フィールドの値(ない場合は空文字)
+	Type string
+	// ブロードキャストする内容
+	Data []byte
+}
+
+// 受信したメッセージを中継する前に加工する処理
+// 加工したメッセージを返すと次の処理に渡し、最後の処理が返したものをブロードキャストする
+// nilを返すとメッセージを黙って捨て、エラーを返すと捨てたうえで送信者にエラーの内容を知らせる
+// readPumpのゴルーチンから呼ばれる
+type Middleware func(c *Client, m *Message) (*Message, error)
+
+// クライアントの送信バッファに入れる直前に、宛先ごとにメッセージを加工する処理
+// 宛先に合わせた伏せ字や表示の切り替えに使う。falseを返すとその宛先には送らない
+// mは宛先ごとに作り直すため、書き換えても他の宛先には影響しない
+// hubのゴルーチンから呼ばれるため、すぐに返る軽い処理にすること
+type OutboundFilter func(c *Client, m *Message) (*Message, bool)
+
+// Hub.Middlewareを順に実行する
+// 捨てられた場合はnilを返す
+func (h *Hub) applyMiddleware(c *Client, m *Message) (*Message, error) {
+	for _, mw := range h.Middleware {
+		var err error
+		if m, err = mw(c, m); err != nil || m == nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// Hub.OutboundFiltersを順に実行する
+// 宛先に送らない場合はfalseを返す
+func (h *Hub) applyOutboundFilters(c *Client, data []byte) ([]byte, bool) {
+	m := &Message{Type: messageType(data), Data: data}
+	for _, filter := range h.OutboundFilters {
+		var ok bool
+		if m, ok = filter(c, m); !ok || m == nil {
+			return nil, false
+		}
+	}
+	return m.Data, true
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"regexp"
+	"slices"
+	"testing"
+)
+
+func TestMiddlewareChainTransformsDropsAndRejects(t *testing.T) {
+	var seen []string
+	h := startHubWith(t, defaultConfig(), func(h *Hub) {
+		h.Middleware = []Middleware{
+			// 前後の空白を取り除く
+			func(c *Client, m *Message) (*Message, error) {
+				var v map[string]any
+				json.Unmarshal(m.Data, &v)
+				if s, ok := v["text"].(string); ok {
+					v["text"] = string(bytes.TrimSpace([]byte(s)))
+				}
+				m.Data, _ = json.Marshal(v)
+				return m, nil
+			},
+			// 宣伝は黙って捨て、禁止語を含むものは送信者に知らせて捨てる
+			func(c *Client, m *Message) (*Message, error) {
+				seen = append(seen, string(m.Data))
+				switch {
+				case bytes.Contains(m.Data, []byte("spam")):
+					return nil, nil
+				case bytes.Contains(m.Data, []byte("forbidden")):
+					return nil, errors.New("message contains a forbidden word")
+				}
+				return m, nil
+			},
+		}
+	})
+	_, sender := connectFake(t, h)
+	_, receiver := connectFake(t, h)
+	for _, m := range []string{
+		`{"text":"  hello  ","type":"chat"}`,
+		`{"text":"buy spam","type":"chat"}`,
+		`{"text":"forbidden","type":"chat"}`,
+		`{"text":"bye","type":"chat"}`,
+	} {
+		sender.reads <- []byte(m)
+	}
+	eventually(t, "メッセージの中継", func() bool { return len(receiver.messages()) == 2 })
+
+	// 後の処理には前の処理が加工した後のメッセージが渡る
+	if seen[0] != `{"text":"hello","type":"chat"}` {
+		t.Errorf("2番目の処理に渡されたメッセージ = %s, want 空白を取り除いた後のもの", seen[0])
+	}
+	want := []string{`{"text":"hello","type":"chat"}`, `{"text":"bye","type":"chat"}`}
+	if got := receiver.messages(); !slices.Equal(got, want) {
+		t.Errorf("受信者に届いたメッセージ = %q, want %q", got, want)
+	}
+	eventually(t, "送信者への通知", func() bool { return len(sender.messages()) == 3 })
+	got := sender.messages()
+	var e errorFrame
+	if err := json.Unmarshal([]byte(got[1]), &e); err != nil || e.Code != codeRejected || e.Message != "message contains a forbidden word" {
+		t.Errorf("送信者に届いたメッセージ = %q, want 2番目に拒否の理由を含む%sのエラー", got, codeRejected)
+	}
+}
+
+func TestOutboundFiltersRedactAndSuppressPerClient(t *testing.T) {
+	email := regexp.MustCompile(`[a-z]+@[a-z.]+`)
+	h := startHubWith(t, defaultConfig(), func(h *Hub) {
+		h.OutboundFilters = []OutboundFilter{
+			// ゲストには他の利用者のメールアドレスを見せない
+			func(c *Client, m *Message) (*Message, bool) {
+				if c.Session() == "guest" {
+					m.Data = email.ReplaceAll(m.Data, []byte("***"))
+				}
+				return m, true
+			},
+			// ミュートしたクライアントにはチャットを送らない
+			func(c *Client, m *Message) (*Message, bool) {
+				return m, !(c.Session() == "muted" && m.Type == "chat")
+			},
+		}
+	})
+	member, _ := addFakeClient(t, h)
+	guest, _ := addFakeClient(t, h)
+	guest.SetSession("guest")
+	muted, _ := addFakeClient(t, h)
+	muted.SetSession("muted")
+
+	h.publish([]byte(`{"type":"chat","from":"alice@example.com"}`))
+	h.publish([]byte(`{"type":"notice"}`))
+	queued := func(c *Client) []string {
+		var got []string
+		h.do(func() {
+			for len(c.send) > 0 {
+				got = append(got, string((<-c.send).data))
+			}
+		})
+		return got
+	}
+	tests := []struct {
+		name string
+		c *Client
+		want []string
+	}{
+		{"member", member, []string{`{"type":"chat","from":"alice@example.com"}`, `{"type":"notice"}`}},
+		{"guest", guest, []string{`{"type":"chat","from":"***"}`, `{"type":"notice"}`}},
+		{"muted", muted, []string{`{"type":"notice"}`}},
+	}
+	for _, tt := range tests {
+		if got := queued(tt.c); !slices.Equal(got, tt.want) {
+			t.Errorf("%sに送るメッセージ = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
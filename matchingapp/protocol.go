@@ -0,0 +1,344 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// サーバーが話せるプロトコルの最新バージョン
+// クライアントはサブプロトコル "matching.v<N>" かクエリパラメータ version=<N> で申告する
+const protocolVersion = 1
+
+// サブプロトコル名の接頭辞
+const subprotocolPrefix = "matching.v"
+
+// 切断理由
+// 切断ログ、Stats.Disconnects、Hub.OnDisconnect、再接続の案内で使われる
+const (
+	reasonShutdown = "shutdown"
+	reasonOverload = "overload"
+	reasonIdle = "idle_timeout"
+	// 接続後、最初のメッセージが期限内に届かなかった
+	reasonNoFirstMessage = "first_message_timeout"
+	reasonTooLarge = "message_too_large"
+	// クライアントからクローズフレームが届いた(再接続の案内は送らない)
+	reasonClientClose = "client_close"
+	// 接続の読み込み/書き込みに失敗した
+	reasonReadError = "read_error"
+	reasonWriteError = "write_error"
+	// 接続してから最大の接続時間がたった(再認証のために繋ぎ直してもらう)
+	reasonMaxLifetime = "max_lifetime"
+	// 違反を繰り返したため一時的に接続を禁止した
+	reasonBanned = "banned"
+)
+
+// 既知でない種類のメッセージを受け取ったときの扱い
+const (
+	// そのまま中継する(種類を確認しない)
+	unknownTypePassthrough = "passthrough"
+	// 送信者に通知せずに捨てる
+	unknownTypeDrop = "drop"
+	// 捨てて送信者にエラーを返す
+	unknownTypeReject = "reject"
+)
+
+// メッセージの種類を取り出すための型
+type typedMessage struct {
+	Type string `json:"type"`
+}
+
+// 受信したメッセージの種類("type"フィールド)を返す
+// JSONオブジェクトでない場合や種類がない場合は空文字を返す
+func messageType(message []byte) string {
+	var m typedMessage
+	if json.Unmarshal(message, &m) != nil {
+		return ""
+	}
+	return m.Type
+}
+
+// 種類typのメッセージを中継してよいかを返す
+// 既知でない種類は設定された扱いに従い、rejectの場合は送信者に通知する
+func (c *Client) acceptType(typ string) bool {
+	h := c.hub
+	if h.unknownTypePolicy == unknownTypePassthrough || h.knownTypes[typ] {
+		return true
+	}
+	// rpcは中継せずにサーバーが処理するため、既知の種類として扱う
+	if typ == rpcType && len(h.RPCHandlers) > 0 {
+		return true
+	}
+	if h.unknownTypePolicy == unknownTypeReject {
+		h.sendTo(c, errorMessage(codeUnknownType, fmt.Sprintf("unknown message type %q", typ), 0))
+	}
+	return false
+}
+
+// クライアントが接続時に申告した、受け取れるメッセージの種類を返す
+// クエリパラメータ types=a,b で申告する。申告がなければnilを返す
+func acceptedTypes(r *http.Request) map[string]bool {
+	if !r.URL.Query().Has("types") {
+		return nil
+	}
+	types := make(map[string]bool)
+	for _, typ := range splitList(r.URL.Query().Get("types")) {
+		types[typ] = true
+	}
+	return types
+}
+
+// 種類typのメッセージをこのクライアントが受け取れるかを返す
+// 種類のないメッセージは常に受け取れるものとする
+func (c *Client) supportsType(typ string) bool {
+	if typ == "" {
+		return true
+	}
+	if c.types != nil && !c.types[typ] {
+		return false
+	}
+	return c.version >= c.hub.typeVersions[typ]
+}
+
+// クライアントへ知らせるエラーの種類(errorフレームのcode)
+// クライアントは文面ではなくこの値を見て処理を分ける
+const (
+	// 受信専用(mode=readonly)の接続から送信した
+	codeReadOnly = "READ_ONLY"
+	// 中継しない種類のメッセージを送った(unknown-type-policy=reject)
+	codeUnknownType = "UNKNOWN_TYPE"
+	// 種類ごとの受信レート上限を超えた(retry_after_msの後に再開できる)
+	codeRateLimited = "RATE_LIMITED"
+	// 署名がない、または一致しない
+	codeInvalidSignature = "INVALID_SIGNATURE"
+	// メッセージを選んだ形式(format)として読めない
+	codeInvalidFormat = "INVALID_FORMAT"
+	// Hub.Middlewareが拒否した
+	codeRejected = "REJECTED"
+	// 一定期間あたりの受信バイト数の上限を超えた(retry_after_msの後に使った量が0に戻る)
+	codeQuotaExceeded = "QUOTA_EXCEEDED"
+)
+
+// 送信したメッセージを受け付けなかったことを知らせるフレーム
+type errorFrame struct {
+	Type string `json:"type"`
+	Code string `json:"code"`
+	Message string `json:"message"`
+	RetryAfterMs int64 `json:"retry_after_ms,omitempty"`
+	// QUOTA_EXCEEDEDの場合の、直近の期間に残っている受信バイト数
+	QuotaRemaining *int64 `json:"quota_remaining_bytes,omitempty"`
+}
+
+// errorフレームを組み立てる。retryAfterが0の場合はretry_after_msを省略する
+func errorMessage(code, text string, retryAfter time.Duration) []byte {
+	b, _ := json.Marshal(errorFrame{Type: "error", Code: code, Message: text, RetryAfterMs: retryAfter.Milliseconds()})
+	return b
+}
+
+// 受信バイト数の上限を超えたことを知らせるerrorフレームを組み立てる
+func quotaExceededMessage(q *byteQuota, now time.Time) []byte {
+	remaining := q.remaining()
+	b, _ := json.Marshal(errorFrame{
+		Type: "error",
+		Code: codeQuotaExceeded,
+		Message: fmt.Sprintf("byte quota of %d bytes per %v exceeded; dropping until older messages leave the window", q.limit, q.window),
+		RetryAfterMs: q.resetIn(now).Milliseconds(),
+		QuotaRemaining: &remaining,
+	})
+	return b
+}
+
+// クライアントが申告したプロトコルバージョンを選ぶ
+// サブプロトコルで申告された場合は応答で返すサブプロトコル名も返す
+// 対応範囲(minVersion〜protocolVersion)で最も新しいものを選び、申告がなければ0を返す
+func negotiateVersion(r *http.Request, minVersion int) (version int, subprotocol string) {
+	for _, p := range websocket.Subprotocols(r) {
+		v, err := strconv.Atoi(strings.TrimPrefix(p, subprotocolPrefix))
+		if !strings.HasPrefix(p, subprotocolPrefix) || err != nil {
+			continue
+		}
+		if v >= minVersion && v <= protocolVersion && v > version {
+			version, subprotocol = v, p
+		}
+	}
+	if version == 0 {
+		if v, err := strconv.Atoi(r.URL.Query().Get("version")); err == nil && v >= minVersion && v <= protocolVersion {
+			version = v
+		}
+	}
+	return version, subprotocol
+}
+
+// 古いクライアントに返すエラーメッセージ
+func upgradeRequiredMessage(minVersion int) string {
+	return fmt.Sprintf("this client is too old: protocol version %d or newer is required (offer subprotocol %s%d or ?version=%d); please upgrade",
+		minVersion, subprotocolPrefix, protocolVersion, protocolVersion)
+}
+
+// 接続直後に送る歓迎メッセージ
+// クライアントはこれを見て、使える機能や制限に合わせて動作を変えられる
+type welcomeFrame struct {
+	Type string `json:"type"`
+	ClientID string `json:"client_id"`
+	ProtocolVersion int `json:"protocol_version"`
+	Capabilities []string `json:"capabilities"`
+	Limits welcomeLimits `json:"limits"`
+	// 接続時点の負荷の段階(しきい値が設定されていない場合は省略)
+	// 以降は段階が変わるたびに {"type":"load"} で知らせる
+	Load string `json:"load,omitempty"`
+}
+
+// 歓迎メッセージで伝える制限
+type welcomeLimits struct {
+	MaxMessageBytes int64 `json:"max_message_bytes"`
+	SendBuffer int `json:"send_buffer"`
+	// 種類ごとの1秒あたりの受信上限と、それ以外の種類の上限(0で無制限)
+	RateLimits map[string]float64 `json:"rate_limits,omitempty"`
+	DefaultRateLimit float64 `json:"default_rate_limit"`
+	// 一定期間(ミリ秒)あたりの受信バイト数の上限(0で無制限)
+	ByteQuota int64 `json:"byte_quota,omitempty"`
+	ByteQuotaWindowMs int64 `json:"byte_quota_window_ms,omitempty"`
+}
+
+// 有効な設定からクライアントへの歓迎メッセージを組み立てる
+func (h *Hub) welcomeMessage(c *Client) []byte {
+	caps := []string{"spaces", "reconnect_hints", "time_sync", "types", "limits"}
+	if c.compress {
+		caps = append(caps, "compression")
+	}
+	if c.readonly {
+		caps = append(caps, "readonly")
+	}
+	if h.signer != nil {
+		caps = append(caps, "signatures")
+	}
+	if c.msgpack {
+		caps = append(caps, "msgpack")
+	}
+	if len(h.RPCHandlers) > 0 {
+		caps = append(caps, "rpc")
+	}
+	limits := welcomeLimits{
+		MaxMessageBytes: h.live.Load().readLimit,
+		SendBuffer: cap(c.send),
+		RateLimits: c.rates.Limits,
+		DefaultRateLimit: c.rates.Default,
+	}
+	if h.byteQuota > 0 {
+		limits.ByteQuota, limits.ByteQuotaWindowMs = h.byteQuota, h.byteQuotaWindow.Milliseconds()
+	}
+	b, _ := json.Marshal(welcomeFrame{
+		Type: "welcome",
+		Load: h.loadLevel(),
+		ClientID: c.id,
+		ProtocolVersion: protocolVersion,
+		Capabilities: caps,
+		Limits: limits,
+	})
+	return b
+}
+
+// 送信できる残りの量の問い合わせ({"type":"limits"})への応答
+// クライアントはこれを見て、上限に達する前に自分で送信を控えられる
+type limitsFrame struct {
+	Type string `json:"type"`
+	// 上限が設定されている種類ごとの残り(Limitsにない種類の分は"*")
+	Rates map[string]rateStatus `json:"rates"`
+	// 受信バイト数の上限の残り(上限が設定されていない場合は省略)
+	ByteQuota *quotaStatus `json:"byte_quota,omitempty"`
+}
+
+// 受信バイト数の上限の残り
+type quotaStatus struct {
+	Limit int64 `json:"limit"`
+	Remaining int64 `json:"remaining"`
+	ResetInMs int64 `json:"reset_in_ms"`
+}
+
+// 1クライアントあたりの問い合わせ({"type":"limits"})の上限(1秒あたり)
+const limitsQueryRate = 5
+
+// 問い合わせたクライアントの現在の状態から、limitsへの応答を組み立てる
+// quotaがnilの場合はbyte_quotaを省略する
+func limitsReply(limiter *typeLimiter, quota *byteQuota, now time.Time) []byte {
+	frame := limitsFrame{Type: "limits", Rates: limiter.status(now)}
+	if quota != nil {
+		quota.refresh(now)
+		frame.ByteQuota = &quotaStatus{Limit: quota.limit, Remaining: quota.remaining(), ResetInMs: quota.resetIn(now).Milliseconds()}
+	}
+	b, _ := json.Marshal(frame)
+	return b
+}
+
+// 時刻合わせの要求({"type":"time_sync","client_time":<ミリ秒>})への応答
+// クライアントは送った時刻と受け取った時刻から、往復時間と時刻のずれを見積もれる
+type timeSyncFrame struct {
+	Type string `json:"type"`
+	ServerTime int64 `json:"server_time"`
+	ClientTime json.RawMessage `json:"client_time,omitempty"`
+}
+
+// 1クライアントあたりの時刻合わせの要求の上限(1秒あたり)
+// 通常のレート上限とは別に数え、チャットなどが制限中でも時刻合わせはできるようにする
+const timeSyncRate = 5
+
+// 時刻合わせの要求に対する応答を組み立てる。client_timeはそのまま返す
+func timeSyncReply(message []byte) []byte {
+	var req struct {
+		ClientTime json.RawMessage `json:"client_time"`
+	}
+	json.Unmarshal(message, &req)
+	b, _ := json.Marshal(timeSyncFrame{Type: "time_sync", ServerTime: time.Now().UnixMilli(), ClientTime: req.ClientTime})
+	return b
+}
+
+// 停止の予告({"type":"shutdown_notice","seconds_remaining":N})
+// クライアントは切断される前に状態を保存したり、利用者に知らせたりできる
+type shutdownNoticeFrame struct {
+	Type string `json:"type"`
+	SecondsRemaining int64 `json:"seconds_remaining"`
+}
+
+// 停止(ドレインの開始)までの残り時間からお知らせを組み立てる(秒は切り上げる)
+func shutdownNoticeMessage(remaining time.Duration) []byte {
+	b, _ := json.Marshal(shutdownNoticeFrame{Type: "shutdown_notice", SecondsRemaining: int64((remaining + time.Second - 1) / time.Second)})
+	return b
+}
+
+// hubの一時停止と再開を知らせるフレーム
+var (
+	pausedMessage = []byte(`{"type":"paused"}`)
+	resumedMessage = []byte(`{"type":"resumed"}`)
+)
+
+// 送信が追いつかないため、以降はブロードキャストを送らないことを知らせるフレーム
+// 宛先を指定したメッセージは引き続き届く。ブロードキャストを受け取るには接続し直す
+var unicastOnlyMessage = []byte(`{"type":"unicast_only"}`)
+
+// 切断直前に送る再接続の案内
+type disconnectFrame struct {
+	Type string `json:"type"`
+	Reason string `json:"reason"`
+	Reconnect bool `json:"reconnect"`
+	ReconnectAfterMs int64 `json:"reconnect_after_ms,omitempty"`
+}
+
+// 切断理由に応じた再接続の案内を組み立てる
+// 理由が空か、設定に含まれない理由の場合はnilを返す
+func (h *Hub) reconnectHint(reason string) []byte {
+	after, ok := h.reconnectPolicy[reason]
+	if reason == "" || !ok {
+		return nil
+	}
+	f := disconnectFrame{Type: "disconnect", Reason: reason, Reconnect: after >= 0}
+	if after > 0 {
+		f.ReconnectAfterMs = after.Milliseconds()
+	}
+	b, _ := json.Marshal(f)
+	return b
+}
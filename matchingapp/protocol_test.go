@@ -0,0 +1,345 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"app/wstest"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestReadonlyClientReceivesButCannotSend(t *testing.T) {
+	_, url := startServer(t, defaultConfig())
+	display := wstest.Dial(t, url+"/ws", wstest.WithQuery("mode", "readonly"))
+	defer display.Close()
+	player := wstest.Dial(t, url+"/ws")
+	defer player.Close()
+	display.Expect("welcome")
+	player.Expect("welcome")
+
+	display.SendJSON(map[string]any{"type": "chat", "text": "from display"})
+	if m := display.Expect("error"); m["code"] != codeReadOnly {
+		t.Errorf("受信専用の接続から送ったときのエラー = %v, want code %s", m, codeReadOnly)
+	}
+	// エラーを知らせるのは最初の1回だけ
+	display.SendJSON(map[string]any{"type": "chat", "text": "from display"})
+
+	player.SendJSON(map[string]any{"type": "chat", "text": "from player"})
+	if m := display.Expect("chat"); m["text"] != "from player" {
+		t.Errorf("受信専用の接続が受け取ったメッセージ = %v", m)
+	}
+	// 受信専用の接続から送ったメッセージは誰にも届かない
+	if m := player.Expect("chat"); m["text"] != "from player" {
+		t.Errorf("受信したメッセージ = %v, want 自分の送信分だけ", m)
+	}
+	player.Timeout = 200 * time.Millisecond
+	player.ExpectNothing()
+}
+
+func TestDisconnectHintIsSentForEachCause(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.ReconnectPolicy[reasonBanned] = -1
+	tests := []struct {
+		reason string
+		// nilの場合は案内を送らない
+		want *disconnectFrame
+	}{
+		{reasonShutdown, &disconnectFrame{Reconnect: true, ReconnectAfterMs: 5000}},
+		{reasonOverload, &disconnectFrame{Reconnect: true, ReconnectAfterMs: 30000}},
+		{reasonIdle, &disconnectFrame{Reconnect: true}},
+		{reasonMaxLifetime, &disconnectFrame{Reconnect: true}},
+		{reasonBanned, &disconnectFrame{Reconnect: false}},
+		{reasonReadError, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.reason, func(t *testing.T) {
+			h := startHub(t, cfg)
+			c, conn := connectFake(t, h)
+			h.do(func() { h.removeClient(c, tt.reason) })
+			eventually(t, "接続が閉じられる", conn.isClosed)
+
+			frames := conn.written()
+			if tt.want == nil {
+				if len(frames) != 1 || frames[0].typ != websocket.CloseMessage {
+					t.Errorf("フレーム = %+v, want クローズフレームだけ", frames)
+				}
+				return
+			}
+			if len(frames) != 2 || frames[1].typ != websocket.CloseMessage {
+				t.Fatalf("フレーム = %+v, want 再接続の案内とクローズフレーム", frames)
+			}
+			var got disconnectFrame
+			if err := json.Unmarshal(frames[0].data, &got); err != nil {
+				t.Fatalf("再接続の案内をデコードできません: %v\n%s", err, frames[0].data)
+			}
+			want := *tt.want
+			want.Type, want.Reason = "disconnect", tt.reason
+			if got != want {
+				t.Errorf("再接続の案内 = %+v, want %+v", got, want)
+			}
+		})
+	}
+}
+
+func TestMinProtocolVersionAcceptsCurrentAndRejectsOldClients(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.MinProtocolVersion = protocolVersion
+	_, url := startServer(t, cfg)
+	current := fmt.Sprintf("%s%d", subprotocolPrefix, protocolVersion)
+
+	c := wstest.Dial(t, url+"/ws", wstest.WithSubprotocol(subprotocolPrefix+"0", current))
+	if p := c.Conn.Subprotocol(); p != current {
+		t.Errorf("選ばれたサブプロトコル = %q, want %q", p, current)
+	}
+	c.Expect("welcome")
+	c.Close()
+	c = wstest.Dial(t, url+"/ws", wstest.WithQuery("version", fmt.Sprint(protocolVersion)))
+	c.Expect("welcome")
+	c.Close()
+
+	for name, opts := range map[string][]wstest.Option{
+		"申告なし": nil,
+		"古いサブプロトコル": {wstest.WithSubprotocol(subprotocolPrefix + "0")},
+		"古いバージョン": {wstest.WithQuery("version", "0")},
+		"未来のバージョン": {wstest.WithQuery("version", fmt.Sprint(protocolVersion+1))},
+	} {
+		_, resp, err := wstest.DialErr(t, url+"/ws", opts...)
+		if err == nil || resp == nil || resp.StatusCode != http.StatusUpgradeRequired {
+			t.Errorf("%s: err=%v resp=%v, want 426", name, err, resp)
+			continue
+		}
+		body, _ := io.ReadAll(resp.Body)
+		if !strings.Contains(string(body), "please upgrade") {
+			t.Errorf("%s: エラーメッセージ = %q, want アップグレードの案内", name, body)
+		}
+	}
+}
+
+func TestWelcomeIsTheFirstFrame(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.RateLimits = map[string]float64{"chat": 5}
+	reg, url := startServer(t, cfg)
+	// 接続している間もブロードキャストを流し続ける
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		h := reg.all()[defaultSpace]
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				h.publish([]byte(`{"type":"chat"}`))
+			}
+		}
+	}()
+
+	for i := 0; i < 5; i++ {
+		c := wstest.Dial(t, url+"/ws")
+		_, frame, err := c.Conn.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		// 後に続くブロードキャストと1つのフレームにまとめられても、先頭は歓迎メッセージになる
+		first, _, _ := bytes.Cut(frame, []byte("\n"))
+		var m welcomeFrame
+		if err := json.Unmarshal(first, &m); err != nil || m.Type != "welcome" {
+			t.Fatalf("最初のメッセージ = %s, want welcome", first)
+		}
+		if m.ClientID == "" || m.ProtocolVersion != protocolVersion {
+			t.Errorf("歓迎メッセージ = %+v, want client_idとprotocol_version", m)
+		}
+		if m.Limits.MaxMessageBytes != cfg.ReadLimit || m.Limits.RateLimits["chat"] != 5 {
+			t.Errorf("歓迎メッセージの制限 = %+v, want 設定の値", m.Limits)
+		}
+		c.Close()
+	}
+}
+
+func TestUnknownTypePolicies(t *testing.T) {
+	for _, policy := range []string{unknownTypePassthrough, unknownTypeDrop, unknownTypeReject} {
+		t.Run(policy, func(t *testing.T) {
+			cfg := defaultConfig()
+			cfg.MessageTypes = []string{"chat"}
+			cfg.UnknownTypePolicy = policy
+			_, url := startServer(t, cfg)
+			sender := wstest.Dial(t, url+"/ws")
+			defer sender.Close()
+			receiver := wstest.Dial(t, url+"/ws")
+			defer receiver.Close()
+			sender.Expect("welcome")
+			receiver.Expect("welcome")
+
+			sender.SendJSON(map[string]any{"type": "mystery"})
+			sender.SendJSON(map[string]any{"type": "chat"})
+			if policy == unknownTypePassthrough {
+				receiver.Expect("mystery")
+			}
+			receiver.Expect("chat")
+
+			if policy == unknownTypeReject {
+				if m := sender.Expect("error"); m["code"] != codeUnknownType {
+					t.Errorf("送信者へのエラー = %v, want code %s", m, codeUnknownType)
+				}
+			} else if policy == unknownTypePassthrough {
+				sender.Expect("mystery")
+			}
+			// 捨てた場合は送信者にも何も知らせず、次のメッセージは中継する
+			sender.Expect("chat")
+		})
+	}
+}
+
+func TestTimeSyncEchoesClientTimeWithServerTime(t *testing.T) {
+	cfg := defaultConfig()
+	// 通常のメッセージの上限とは別に数える
+	cfg.DefaultRateLimit = 1
+	_, url := startServer(t, cfg)
+	c := wstest.Dial(t, url+"/ws")
+	defer c.Close()
+	other := wstest.Dial(t, url+"/ws")
+	defer other.Close()
+	c.Expect("welcome")
+	other.Expect("welcome")
+
+	for i := 0; i < 3; i++ {
+		before := time.Now().UnixMilli()
+		c.SendJSON(map[string]any{"type": "time_sync", "client_time": 1700000000123 + i})
+		m := c.Expect("time_sync")
+		after := time.Now().UnixMilli()
+		if m["client_time"] != float64(1700000000123+i) {
+			t.Errorf("client_time = %v, want 送ったままの値", m["client_time"])
+		}
+		if st, ok := m["server_time"].(float64); !ok || int64(st) < before || int64(st) > after {
+			t.Errorf("server_time = %v, want %d〜%d", m["server_time"], before, after)
+		}
+	}
+	// 要求したクライアントにだけ応答する
+	other.Timeout = 200 * time.Millisecond
+	other.ExpectNothing()
+}
+
+func TestErrorFrameCodes(t *testing.T) {
+	tests := []struct {
+		code string
+		cfg func(*Config)
+		client func(*Client)
+		sends []string
+		// retry_after_msを付けるか
+		retry bool
+	}{
+		{codeReadOnly, nil, func(c *Client) { c.readonly = true }, []string{`{"type":"chat"}`}, false},
+		{codeUnknownType, func(cfg *Config) {
+			cfg.MessageTypes = []string{"chat"}
+			cfg.UnknownTypePolicy = unknownTypeReject
+		}, nil, []string{`{"type":"mystery"}`}, false},
+		{codeRateLimited, func(cfg *Config) { cfg.RateLimits = map[string]float64{"chat": 1} }, nil,
+			[]string{`{"type":"chat"}`, `{"type":"chat"}`}, true},
+		{codeInvalidSignature, func(cfg *Config) { cfg.SigningKey = "secret" }, nil, []string{`{"type":"chat"}`}, false},
+		{codeInvalidFormat, nil, func(c *Client) { c.msgpack = true }, []string{"\xc1"}, false},
+		{codeRejected, nil, nil, []string{`{"type":"reject_me"}`}, false},
+		{codeQuotaExceeded, func(cfg *Config) {
+			cfg.ByteQuota = 30
+			cfg.ByteQuotaWindow = time.Minute
+		}, nil, []string{`{"type":"chat","n":1}`, `{"type":"chat","n":2}`}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.code, func(t *testing.T) {
+			cfg := defaultConfig()
+			if tt.cfg != nil {
+				tt.cfg(&cfg)
+			}
+			h := startHubWith(t, cfg, func(h *Hub) {
+				h.Middleware = []Middleware{func(c *Client, m *Message) (*Message, error) {
+					if m.Type == "reject_me" {
+						return nil, errors.New("rejected by policy")
+					}
+					return m, nil
+				}}
+			})
+			c, conn := newFakeClient(h)
+			if tt.client != nil {
+				tt.client(c)
+			}
+			h.pumps.Add(2)
+			if !h.registerClient(c) {
+				t.Fatal("クライアントを登録できませんでした")
+			}
+			go c.readPump()
+			go c.writePump()
+			for _, m := range tt.sends {
+				conn.reads <- []byte(m)
+			}
+
+			var e errorFrame
+			eventually(t, "エラーの通知", func() bool {
+				for _, f := range conn.written() {
+					data := f.data
+					if f.typ == websocket.BinaryMessage {
+						data, _ = msgpackToJSON(data)
+					}
+					for _, m := range bytes.Split(data, []byte("\n")) {
+						if h.signer != nil {
+							m, _ = h.signer.verify(m)
+						}
+						if messageType(m) == "error" {
+							json.Unmarshal(m, &e)
+							return true
+						}
+					}
+				}
+				return false
+			})
+			if e.Code != tt.code || e.Message == "" {
+				t.Errorf("エラー = %+v, want code %s と説明", e, tt.code)
+			}
+			if retry := e.RetryAfterMs > 0; retry != tt.retry {
+				t.Errorf("retry_after_ms = %d, want 付ける: %v", e.RetryAfterMs, tt.retry)
+			}
+		})
+	}
+}
+
+func TestMessagesAreSkippedForClientsThatCannotHandleTheirType(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.TypeVersions = map[string]int{"poll": 1}
+	reg, url := startServer(t, cfg)
+	v1 := wstest.WithQuery("version", "1")
+	clients := []struct {
+		name string
+		c *wstest.Client
+		poll bool
+	}{
+		{"バージョン1", wstest.Dial(t, url+"/ws", v1), true},
+		{"pollを申告したバージョン1", wstest.Dial(t, url+"/ws", v1, wstest.WithQuery("types", "chat,poll")), true},
+		{"pollを申告していないバージョン1", wstest.Dial(t, url+"/ws", v1, wstest.WithQuery("types", "chat")), false},
+		// バージョンを申告しない古いクライアントには、バージョン1で追加した種類を送らない
+		{"古いクライアント", wstest.Dial(t, url+"/ws"), false},
+	}
+	for _, cl := range clients {
+		defer cl.c.Close()
+		cl.c.Expect("welcome")
+	}
+
+	hub := reg.all()[defaultSpace]
+	hub.publish([]byte(`{"type":"poll"}`))
+	hub.publish([]byte(`{"type":"chat"}`))
+	for _, cl := range clients {
+		if cl.poll {
+			cl.c.Expect("poll")
+		}
+		// 受け取れない種類を飛ばして、次のメッセージが届く
+		cl.c.Expect("chat")
+	}
+	if n := hub.Stats().UnsupportedSkips; n != 2 {
+		t.Errorf("UnsupportedSkips = %d, want 2", n)
+	}
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"math"
+	"time"
+)
+
+// 受信レート上限の組(1秒あたりの件数)
+type RateProfile struct {
+	// 種類ごとの上限
+	Limits map[string]float64
+	// Limitsにない種類(種類なしを含む)に共通の上限(0で無制限)
+	Default float64
+}
+
+// トークンバケット方式のレート制限
+// 1秒あたりrate個のトークンが補充され、最大burst個まで貯められる
+type tokenBucket struct {
+	rate float64
+	burst float64
+	tokens float64
+	last time.Time
+}
+
+// 1秒あたりrate回を上限とするバケットを作る。瞬間的にはrate回(最低1回)まで許可する
+func newTokenBucket(rate float64) *tokenBucket {
+	burst := math.Max(1, math.Ceil(rate))
+	return &tokenBucket{rate: rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+// トークンを1つ消費できればtrueを返す
+func (b *tokenBucket) allow(now time.Time) bool {
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// 現在使えるトークンの数を返す(トークンは消費しない)
+func (b *tokenBucket) available(now time.Time) float64 {
+	return math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+}
+
+// 次のトークンが使えるようになるまでの時間を返す(トークンは消費しない)
+func (b *tokenBucket) delay(now time.Time) time.Duration {
+	tokens := b.available(now)
+	if tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - tokens) / b.rate * float64(time.Second))
+}
+
+// トークンが最大まで貯まるまでの時間を返す
+func (b *tokenBucket) fullIn(now time.Time) time.Duration {
+	return time.Duration((b.burst - b.available(now)) / b.rate * float64(time.Second))
+}
+
+// 直近の一定期間(window)あたりの受信バイト数の上限
+// 期間の区切りで一度に0へ戻すと、区切りの前後で上限の2倍まで送れてしまうため、
+// 期間をquotaSlices個の区間に分けて区間ごとに数え、古い区間から順に数えなくする
+// readPumpのゴルーチンからのみ使うため排他制御はしない
+type byteQuota struct {
+	limit int64
+	window time.Duration
+
+	// 区間ごとに受け付けたバイト数。slices[head]が今の区間
+	slices [quotaSlices]int64
+	head int
+	// 今の区間が始まった時刻
+	headStart time.Time
+	// slicesの合計
+	used int64
+	// 上限を超えたことを通知済みか(古い区間が外れて残りが増えたらやり直す)
+	notified bool
+}
+
+// byteQuotaの期間を分ける区間の数
+// 区間が細かいほど直近の期間を正確に数えられるが、区間をまたぐたびに進める手間が増える
+const quotaSlices = 10
+
+func newByteQuota(limit int64, window time.Duration) *byteQuota {
+	return &byteQuota{limit: limit, window: window, headStart: time.Now()}
+}
+
+// 区間1つの長さ
+func (q *byteQuota) sliceLen() time.Duration {
+	return max(1, q.window/quotaSlices)
+}
+
+// 今の区間を進め、期間から外れた区間の分を使った量から引く
+func (q *byteQuota) refresh(now time.Time) {
+	k := int(now.Sub(q.headStart) / q.sliceLen())
+	if k <= 0 {
+		return
+	}
+	q.headStart = q.headStart.Add(time.Duration(k) * q.sliceLen())
+	for i := 0; i < min(k, quotaSlices); i++ {
+		q.head = (q.head + 1) % quotaSlices
+		if q.slices[q.head] > 0 {
+			q.used -= q.slices[q.head]
+			q.slices[q.head] = 0
+			q.notified = false
+		}
+	}
+}
+
+// nバイトのメッセージを受け付けられれば使った量に加えてtrueを返す
+// 上限を超える場合は加えずにfalseを返す
+func (q *byteQuota) allow(n int64, now time.Time) bool {
+	q.refresh(now)
+	if q.used+n > q.limit {
+		return false
+	}
+	q.slices[q.head] += n
+	q.used += n
+	return true
+}
+
+// 直近の期間に残っているバイト数を返す
+func (q *byteQuota) remaining() int64 {
+	return q.limit - q.used
+}
+
+// 最も古い区間が期間から外れて、残りのバイト数が増えるまでの時間を返す(使った量が0なら0)
+func (q *byteQuota) resetIn(now time.Time) time.Duration {
+	for j := 1; j <= quotaSlices; j++ {
+		if q.slices[(q.head+j)%quotaSlices] > 0 {
+			return max(0, q.headStart.Add(time.Duration(j)*q.sliceLen()).Sub(now))
+		}
+	}
+	return 0
+}
+
+// 上限を超えたことを通知すべきかを返す(残りが増えるまでに最初の1回だけtrue)
+func (q *byteQuota) shouldNotify() bool {
+	if q.notified {
+		return false
+	}
+	q.notified = true
+	return true
+}
+
+// メッセージの種類ごとのレート制限
+// readPumpのゴルーチンからのみ使うため排他制御はしない
+type typeLimiter struct {
+	// 種類ごとの上限(1秒あたりの件数)
+	limits map[string]float64
+	// 上限が設定されていない種類に共通で使う上限(0で無制限)
+	fallback float64
+
+	buckets map[string]*tokenBucket
+	// 制限中であることを通知済みの種類
+	notified map[string]bool
+}
+
+func newTypeLimiter(limits map[string]float64, fallback float64) *typeLimiter {
+	return &typeLimiter{
+		limits: limits,
+		fallback: fallback,
+		buckets: make(map[string]*tokenBucket),
+		notified: make(map[string]bool),
+	}
+}
+
+// 種類typの送信を許可するかを返す
+// 上限が設定されていない種類はまとめて1つのバケットで数え、種類を変えて制限を逃れられないようにする
+func (l *typeLimiter) allow(typ string, now time.Time) bool {
+	rate, ok := l.limits[typ]
+	if !ok {
+		typ, rate = "", l.fallback
+	}
+	if rate <= 0 {
+		return true
+	}
+	b, ok := l.buckets[typ]
+	if !ok {
+		// 作った時刻をnowにしておき、nowより後の時刻で作ったために最初の分が減って見えないようにする
+		b = newTokenBucket(rate)
+		b.last = now
+		l.buckets[typ] = b
+	}
+	if b.allow(now) {
+		l.notified[typ] = false
+		return true
+	}
+	return false
+}
+
+// 種類typの次の送信が許可されるまでの時間を返す
+func (l *typeLimiter) retryAfter(typ string, now time.Time) time.Duration {
+	if _, ok := l.limits[typ]; !ok {
+		typ = ""
+	}
+	if b, ok := l.buckets[typ]; ok {
+		return b.delay(now)
+	}
+	return 0
+}
+
+// 種類ごとの残りの送信回数
+type rateStatus struct {
+	// 1秒あたりの上限
+	Limit float64 `json:"limit"`
+	// 今すぐ送れる回数
+	Remaining int `json:"remaining"`
+	// 次に送れるようになるまでの時間(今すぐ送れる場合は0)
+	RetryAfterMs int64 `json:"retry_after_ms"`
+	// 送れる回数が最大まで戻るまでの時間
+	FullInMs int64 `json:"full_in_ms"`
+}
+
+// Limitsにない種類の残りの送信回数を示すキー
+const fallbackRateKey = "*"
+
+// 上限が設定されている種類ごとの残りの送信回数を返す
+// Limitsにない種類の分はfallbackRateKeyで返す
+func (l *typeLimiter) status(now time.Time) map[string]rateStatus {
+	status := make(map[string]rateStatus, len(l.limits)+1)
+	add := func(key, typ string, rate float64) {
+		if rate <= 0 {
+			return
+		}
+		b, ok := l.buckets[typ]
+		if !ok {
+			// まだ送っていない種類は最大まで送れる
+			b = &tokenBucket{rate: rate, burst: math.Max(1, math.Ceil(rate)), last: now}
+			b.tokens = b.burst
+		}
+		status[key] = rateStatus{
+			Limit: rate,
+			Remaining: int(b.available(now)),
+			RetryAfterMs: b.delay(now).Milliseconds(),
+			FullInMs: b.fullIn(now).Milliseconds(),
+		}
+	}
+	for typ, rate := range l.limits {
+		add(typ, typ, rate)
+	}
+	add(fallbackRateKey, "", l.fallback)
+	return status
+}
+
+// 制限中の通知を送るべきかを返す(制限され始めた最初の1回だけtrue)
+func (l *typeLimiter) shouldNotify(typ string) bool {
+	if _, ok := l.limits[typ]; !ok {
+		typ = ""
+	}
+	if l.notified[typ] {
+		return false
+	}
+	l.notified[typ] = true
+	return true
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"app/wstest"
+)
+
+func TestTypeLimiterLimitsEachTypeIndependently(t *testing.T) {
+	l := newTypeLimiter(map[string]float64{"chat": 2, "typing": 5}, 1)
+	now := time.Now()
+	allowed := func(typ string, n int) int {
+		ok := 0
+		for i := 0; i < n; i++ {
+			if l.allow(typ, now) {
+				ok++
+			}
+		}
+		return ok
+	}
+
+	if n := allowed("chat", 10); n != 2 {
+		t.Errorf("chatを許可した数 = %d, want 2", n)
+	}
+	// chatが制限中でも、typingは自分の上限まで送れる
+	if n := allowed("typing", 10); n != 5 {
+		t.Errorf("typingを許可した数 = %d, want 5", n)
+	}
+	// 上限のない種類は共通の上限を1つのバケットで分け合う
+	if n := allowed("move", 3) + allowed("emote", 3) + allowed("", 3); n != 1 {
+		t.Errorf("上限のない種類を許可した数 = %d, want 1", n)
+	}
+
+	// 時間がたてば種類ごとの速さで戻る
+	now = now.Add(500 * time.Millisecond)
+	if n := allowed("chat", 10); n != 1 {
+		t.Errorf("0.5秒後にchatを許可した数 = %d, want 1", n)
+	}
+	if n := allowed("typing", 10); n != 2 {
+		t.Errorf("0.5秒後にtypingを許可した数 = %d, want 2", n)
+	}
+}
+
+func TestTypeLimiterNotifiesOncePerThrottle(t *testing.T) {
+	l := newTypeLimiter(map[string]float64{"chat": 1, "typing": 1}, 0)
+	now := time.Now()
+	l.allow("chat", now)
+	l.allow("typing", now)
+	if l.allow("chat", now) || !l.shouldNotify("chat") || l.shouldNotify("chat") {
+		t.Error("chatの制限は最初の1回だけ通知する")
+	}
+	if l.allow("typing", now) || !l.shouldNotify("typing") {
+		t.Error("typingの制限はchatと別に通知する")
+	}
+	if d := l.retryAfter("chat", now); d <= 0 || d > time.Second {
+		t.Errorf("retryAfter = %v, want 0〜1秒", d)
+	}
+	// 送れるようになれば、次の制限でもう一度通知する
+	now = now.Add(time.Second)
+	if !l.allow("chat", now) || l.allow("chat", now) || !l.shouldNotify("chat") {
+		t.Error("制限が解けた後の制限が通知されません")
+	}
+}
+
+func TestOriginsGetTheirOwnRateLimits(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.RateLimits = map[string]float64{"chat": 2}
+	const partner = "https://partner.example"
+	cfg.OriginRateLimits = map[string]RateProfile{partner: {Limits: map[string]float64{"chat": 5}}}
+	_, url := startServer(t, cfg)
+
+	// 種類ごとの上限を超えるまで送り、中継された数を返す
+	relayed := func(origin string) (int, map[string]any) {
+		c := wstest.Dial(t, url+"/ws", wstest.WithHeader("Origin", origin))
+		defer c.Close()
+		welcome := c.Expect("welcome")
+		for i := 0; i < 6; i++ {
+			c.SendJSON(map[string]any{"type": "chat"})
+		}
+		n := 0
+		for {
+			m := map[string]any{}
+			c.ReadJSON(&m)
+			if m["type"] == "error" {
+				if m["code"] != codeRateLimited {
+					t.Errorf("%s へのエラー = %v, want code %s", origin, m, codeRateLimited)
+				}
+				return n, welcome
+			}
+			n++
+		}
+	}
+
+	n, welcome := relayed("https://app.example")
+	if n != 2 {
+		t.Errorf("既定の上限で中継された数 = %d, want 2", n)
+	}
+	if limits := welcome["limits"].(map[string]any)["rate_limits"]; limits.(map[string]any)["chat"] != float64(2) {
+		t.Errorf("既定の上限の接続元に通知した上限 = %v, want chat=2", limits)
+	}
+	n, welcome = relayed(partner)
+	if n != 5 {
+		t.Errorf("%s の上限で中継された数 = %d, want 5", partner, n)
+	}
+	if limits := welcome["limits"].(map[string]any)["rate_limits"]; limits.(map[string]any)["chat"] != float64(5) {
+		t.Errorf("%s に通知した上限 = %v, want chat=5", partner, limits)
+	}
+}
+
+func TestByteQuotaAccumulatesAndResets(t *testing.T) {
+	start := time.Now()
+	q := &byteQuota{limit: 100, window: time.Minute, headStart: start}
+	for i, n := range []int64{40, 40, 20} {
+		if !q.allow(n, start.Add(time.Duration(i)*time.Second)) {
+			t.Fatalf("%d件目(%dバイト)が上限内なのに拒否されました", i+1, n)
+		}
+	}
+	if r := q.remaining(); r != 0 {
+		t.Errorf("上限まで使った後の残り = %d, want 0", r)
+	}
+	// 上限を超える分は加えずに拒否する
+	if q.allow(1, start.Add(10*time.Second)) {
+		t.Error("上限を超えたメッセージが受け付けられました")
+	}
+	if !q.shouldNotify() || q.shouldNotify() {
+		t.Error("上限超過の通知は残りが増えるまでに1回だけのはずです")
+	}
+	if d := q.resetIn(start.Add(10 * time.Second)); d != 50*time.Second {
+		t.Errorf("残りが増えるまでの時間 = %v, want 50s", d)
+	}
+
+	// 送った分が直近の期間から外れたら使った量から引き、通知もやり直す
+	later := start.Add(time.Minute)
+	if !q.allow(70, later) {
+		t.Fatal("期間が過ぎた後のメッセージが拒否されました")
+	}
+	if r := q.remaining(); r != 30 {
+		t.Errorf("期間が過ぎた後の残り = %d, want 30", r)
+	}
+	if q.allow(31, later) {
+		t.Error("期間が過ぎた後の上限を超えたメッセージが受け付けられました")
+	}
+	if !q.shouldNotify() {
+		t.Error("残りが増えた後に上限を超えたのに通知されません")
+	}
+}
+
+func TestByteQuotaWindowRollsAcrossBoundaries(t *testing.T) {
+	start := time.Now()
+	q := &byteQuota{limit: 100, window: time.Minute, headStart: start}
+	// 期間の終わり際に上限まで送っても、次の期間の始めにまた上限まで送れるわけではない
+	if !q.allow(100, start.Add(55*time.Second)) {
+		t.Fatal("上限内のメッセージが拒否されました")
+	}
+	if q.allow(1, start.Add(61*time.Second)) {
+		t.Error("期間の区切りをまたいだだけで上限を超えて送れました")
+	}
+	if q.allow(1, start.Add(113*time.Second)) {
+		t.Error("送ってから1分たたないうちに上限を超えて送れました")
+	}
+	if !q.allow(100, start.Add(115*time.Second)) {
+		t.Error("送ってから1分たった後のメッセージが拒否されました")
+	}
+
+	// 期間の中で送った分は、古いものから順に直近の期間から外れる
+	start = start.Add(10 * time.Minute)
+	q = &byteQuota{limit: 100, window: time.Minute, headStart: start}
+	q.allow(50, start)
+	q.allow(50, start.Add(30*time.Second))
+	if q.allow(50, start.Add(59*time.Second)) {
+		t.Error("直近の1分に100バイト送った後に受け付けられました")
+	}
+	if d := q.resetIn(start.Add(59 * time.Second)); d != time.Second {
+		t.Errorf("最初に送った分が外れるまでの時間 = %v, want 1s", d)
+	}
+	if !q.allow(50, start.Add(time.Minute)) {
+		t.Error("最初に送った分が外れた後のメッセージが拒否されました")
+	}
+	if r := q.remaining(); r != 0 {
+		t.Errorf("残り = %d, want 0", r)
+	}
+}
+
+func TestLimitsQueryReportsDecreasingBudget(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.RateLimits = map[string]float64{"chat": 5}
+	cfg.ByteQuota = 1000
+	_, url := startServer(t, cfg)
+	c := wstest.Dial(t, url+"/ws")
+	defer c.Close()
+	c.Expect("welcome")
+
+	query := func() (chat, quota float64) {
+		t.Helper()
+		c.SendJSON(map[string]any{"type": "limits"})
+		m := c.ExpectEventually("limits")
+		rates, _ := m["rates"].(map[string]any)
+		status, _ := rates["chat"].(map[string]any)
+		q, _ := m["byte_quota"].(map[string]any)
+		if status == nil || q == nil {
+			t.Fatalf("limitsへの応答にchatかbyte_quotaがありません: %v", m)
+		}
+		return status["remaining"].(float64), q["remaining"].(float64)
+	}
+	chat, quota := query()
+	if chat != 5 || quota != 1000 {
+		t.Fatalf("送信前の残り = chat %v, byte_quota %v, want 5, 1000", chat, quota)
+	}
+	message := `{"type":"chat"}`
+	for i := 0; i < 2; i++ {
+		c.SendJSON(map[string]any{"type": "chat"})
+	}
+	// 問い合わせ自体は残りの量を減らさない
+	for i := 0; i < 2; i++ {
+		chat, quota = query()
+		if chat != 3 || quota != float64(1000-2*len(message)) {
+			t.Errorf("2件送った後の残り = chat %v, byte_quota %v, want 3, %d", chat, quota, 1000-2*len(message))
+		}
+	}
+}
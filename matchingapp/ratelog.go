@@ -0,0 +1,55 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// 同じ種類のログを一定間隔ごとにまとめて出力するロガー
+// 最初の1件はそのまま出力し、間隔内に続いた分は件数だけ数えて
+// 間隔の終わりに「N件省略」という要約を1行出力する
+type rateLogger struct {
+	mu sync.Mutex
+	window time.Duration
+	// 種類ごとの省略件数(キーが存在する間は集約中)
+	suppressed map[string]int
+}
+
+func newRateLogger(window time.Duration) *rateLogger {
+	return &rateLogger{
+		window: window,
+		suppressed: make(map[string]int),
+	}
+}
+
+// keyごとに集約してログを出力する
+func (l *rateLogger) Printf(key string, format string, args ...any) {
+	if l.window <= 0 {
+		log.Printf(format, args...)
+		return
+	}
+	l.mu.Lock()
+	if _, ok := l.suppressed[key]; ok {
+		l.suppressed[key]++
+		l.mu.Unlock()
+		return
+	}
+	l.suppressed[key] = 0
+	l.mu.Unlock()
+
+	log.Printf(format, args...)
+	time.AfterFunc(l.window, func() { l.flush(key) })
+}
+
+// 集約期間を終え、省略した件数があれば要約を出力する
+func (l *rateLogger) flush(key string) {
+	l.mu.Lock()
+	n := l.suppressed[key]
+	delete(l.suppressed, key)
+	l.mu.Unlock()
+
+	if n > 0 {
+		log.Printf("%s: 直近%vで同様のログを%d件省略しました", key, l.window, n)
+	}
+}
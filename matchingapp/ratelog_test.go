@@ -0,0 +1,42 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRateLoggerCollapsesRepeatsIntoSummary(t *testing.T) {
+	logs := captureLog(t)
+	l := newRateLogger(100 * time.Millisecond)
+	for i := 0; i < 5; i++ {
+		l.Printf("read_error", "readPump エラー: client %d", i)
+	}
+	l.Printf("write_error", "writePump エラー")
+
+	out := logs.String()
+	if n := strings.Count(out, "readPump エラー"); n != 1 {
+		t.Errorf("集約期間内に出力された読み込みエラー = %d行, want 1\n%s", n, out)
+	}
+	if !strings.Contains(out, "writePump エラー") {
+		t.Errorf("別の種類のログが集約されています\n%s", out)
+	}
+	if strings.Contains(out, "省略") {
+		t.Errorf("集約期間が終わる前に要約が出力されました\n%s", out)
+	}
+
+	eventually(t, "要約の出力", func() bool {
+		return strings.Contains(logs.String(), "read_error: 直近100msで同様のログを4件省略しました")
+	})
+	// 1件だけの種類は要約を出さない
+	time.Sleep(50 * time.Millisecond)
+	if strings.Contains(logs.String(), "write_error:") {
+		t.Errorf("省略していない種類の要約が出力されました\n%s", logs.String())
+	}
+
+	// 集約期間を終えた後の最初の1件はまたそのまま出力する
+	l.Printf("read_error", "readPump エラー: client %d", 9)
+	if !strings.Contains(logs.String(), "readPump エラー: client 9") {
+		t.Errorf("集約期間の後のログが出力されません\n%s", logs.String())
+	}
+}
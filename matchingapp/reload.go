@@ -0,0 +1,134 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+)
+
+// 再起動せずに変更できる設定
+// hubはこれをまとめて差し替えるため、読む側は一度Loadした値を使えば途中で混ざらない
+type liveConfig struct {
+	readLimit int64
+	rateLimits map[string]float64
+	defaultRateLimit float64
+	originRateLimits map[string]RateProfile
+	// 接続を許可/拒否するIPアドレスの範囲(nilで制限しない)
+	ipFilter *ipFilter
+}
+
+func newLiveConfig(cfg Config) *liveConfig {
+	return &liveConfig{
+		readLimit: cfg.ReadLimit,
+		rateLimits: cfg.RateLimits,
+		defaultRateLimit: cfg.DefaultRateLimit,
+		originRateLimits: cfg.OriginRateLimits,
+		ipFilter: cfg.IPFilter,
+	}
+}
+
+// 接続元originに適用する受信レート上限を返す
+// 接続元ごとの設定がない場合は共通の上限を返す
+func (l *liveConfig) rateProfile(origin string) RateProfile {
+	if p, ok := l.originRateLimits[origin]; ok {
+		return p
+	}
+	return RateProfile{Limits: l.rateLimits, Default: l.defaultRateLimit}
+}
+
+// pathの設定ファイルを読み込み、cfgに反映したものを返す
+// ファイルには1行に1つ "名前=値" の形式でフラグを書く(空行と#で始まる行は無視する)
+// 再起動しないと変更できない設定は警告を出して無視する
+// origin-rate-limits を書いた場合は、ファイルに書いた接続元だけに置き換える
+func reloadConfig(path string, cfg Config) (Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return cfg, err
+	}
+	fs := flag.NewFlagSet("reload", flag.ContinueOnError)
+	defineReloadableFlags(fs, &cfg)
+	originsReset := false
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, value, ok := strings.Cut(strings.TrimLeft(line, "-"), "=")
+		if !ok {
+			return cfg, fmt.Errorf("%s:%d: 名前=値 の形式で指定してください: %q", path, i+1, line)
+		}
+		name, value = strings.TrimSpace(name), strings.TrimSpace(value)
+		if fs.Lookup(name) == nil {
+			if flag.Lookup(name) != nil {
+				log.Printf("%s:%d: %s は再起動しないと変更できないため無視します", path, i+1, name)
+				continue
+			}
+			return cfg, fmt.Errorf("%s:%d: 不明な設定です: %s", path, i+1, name)
+		}
+		if name == "origin-rate-limits" && !originsReset {
+			cfg.OriginRateLimits = nil
+			originsReset = true
+		}
+		if err := fs.Set(name, value); err != nil {
+			return cfg, fmt.Errorf("%s:%d: %s: %v", path, i+1, name, err)
+		}
+	}
+	return cfg, cfg.validate()
+}
+
+// 設定されているファイルを全て読み込み、cfgに反映したものを返す
+func reloadAll(cfg Config) (Config, error) {
+	if cfg.ReloadFile != "" {
+		reloaded, err := reloadConfig(cfg.ReloadFile, cfg)
+		if err != nil {
+			return cfg, err
+		}
+		cfg = reloaded
+	}
+	if cfg.IPFilterFile != "" {
+		filter, err := loadIPFilter(cfg.IPFilterFile)
+		if err != nil {
+			return cfg, err
+		}
+		cfg.IPFilter = filter
+	}
+	return cfg, nil
+}
+
+// SIGHUPを受け取るたびに設定ファイルとIPアドレスの範囲のファイルを読み込み直し、全スペースのhubに反映する
+// 接続は切らずに、接続中のクライアントにも次に受信したメッセージから適用する
+// IPアドレスの範囲は次の接続から適用し、接続中のクライアントは切断しない
+// 読み込みに失敗した場合は何も変更しない
+func (r *hubRegistry) watchReload() {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP)
+	for range sig {
+		if err := r.reload(); err != nil {
+			log.Println("設定の再読み込みエラー(変更しません):", err)
+			continue
+		}
+		log.Println("設定を再読み込みしました")
+	}
+}
+
+// 設定ファイルを読み込み直して全スペースのhubに反映する
+// 読み込みに失敗した場合は何も変更せずにエラーを返す
+func (r *hubRegistry) reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	cfg, err := reloadAll(r.cfg)
+	if err != nil {
+		return err
+	}
+	// 今後作成するスペースにも反映する
+	r.cfg = cfg
+	live := newLiveConfig(cfg)
+	for _, hub := range r.hubs {
+		hub.live.Store(live)
+	}
+	return nil
+}
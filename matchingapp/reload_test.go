@@ -0,0 +1,70 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"app/wstest"
+)
+
+func TestReloadChangesEffectiveRateLimit(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "reload.conf")
+	cfg := defaultConfig()
+	cfg.RateLimits = map[string]float64{"chat": 1}
+	cfg.ReloadFile = path
+	reg, url := startServer(t, cfg)
+	c := wstest.Dial(t, url+"/ws")
+	defer c.Close()
+	c.Expect("welcome")
+
+	// 上限を超えるまで送り、中継された数を返す
+	relayed := func() int {
+		t.Helper()
+		for i := 0; i < 6; i++ {
+			c.SendJSON(map[string]any{"type": "chat"})
+		}
+		n := 0
+		for {
+			m := map[string]any{}
+			c.ReadJSON(&m)
+			if m["type"] == "error" {
+				if m["code"] != codeRateLimited {
+					t.Errorf("エラー = %v, want code %s", m, codeRateLimited)
+				}
+				return n
+			}
+			n++
+		}
+	}
+	if n := relayed(); n != 1 {
+		t.Fatalf("再読み込み前に中継された数 = %d, want 1", n)
+	}
+
+	// 読み込みに失敗した場合は何も変えない
+	if err := os.WriteFile(path, []byte("rate-limits=chat=fast\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := reg.reload(); err == nil {
+		t.Fatal("不正な設定ファイルを読み込めました")
+	}
+	if live := reg.all()[defaultSpace].live.Load(); live.rateLimits["chat"] != 1 {
+		t.Fatalf("読み込みに失敗した後の上限 = %v, want 1のまま", live.rateLimits["chat"])
+	}
+
+	if err := os.WriteFile(path, []byte("# 調整\nrate-limits=chat=4\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := reg.reload(); err != nil {
+		t.Fatal(err)
+	}
+	// 接続を切らずに、次に受信したメッセージから新しい上限を使う
+	if n := relayed(); n != 4 {
+		t.Errorf("再読み込み後に中継された数 = %d, want 4", n)
+	}
+	// 再読み込みの後に作るスペースにも反映する
+	hub, _ := reg.get("room1")
+	if limit := hub.live.Load().rateLimits["chat"]; limit != 4 {
+		t.Errorf("再読み込みの後に作ったスペースの上限 = %v, want 4", limit)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// 要求/応答型のメッセージの種類
+// {"type":"rpc","id":"<相関ID>","method":"...","params":...} に対して
+// 同じ接続へ {"type":"rpc_result","id":"<相関ID>",...} を返す
+const (
+	rpcType = "rpc"
+	rpcResultType = "rpc_result"
+)
+
+// rpc_resultのerrorで返す種類
+const (
+	// Hub.RPCHandlersにないメソッドが呼ばれた
+	rpcMethodNotFound = "METHOD_NOT_FOUND"
+	// ハンドラーがエラーを返した
+	rpcHandlerError = "HANDLER_ERROR"
+	// ハンドラーの結果をJSONにできなかった
+	rpcInternalError = "INTERNAL_ERROR"
+)
+
+// rpcのメソッドを処理する関数
+// 返した値はJSONにしてresultで返し、エラーを返した場合はその内容をerrorで返す
+// readPumpのゴルーチンから呼ばれ、応答を返すまでこのクライアントの次のメッセージは処理されない
+type RPCHandler func(c *Client, params json.RawMessage) (any, error)
+
+// クライアントからの要求
+type rpcRequest struct {
+	ID string `json:"id"`
+	Method string `json:"method"`
+	Params json.RawMessage `json:"params,omitempty"`
+}
+
+// 要求への応答。ResultとErrorのどちらか一方を返す
+type rpcResultFrame struct {
+	Type string `json:"type"`
+	ID string `json:"id"`
+	Result json.RawMessage `json:"result,omitempty"`
+	Error *rpcError `json:"error,omitempty"`
+}
+
+type rpcError struct {
+	Code string `json:"code"`
+	Message string `json:"message"`
+}
+
+func rpcResultMessage(id string, result json.RawMessage, err *rpcError) []byte {
+	b, _ := json.Marshal(rpcResultFrame{Type: rpcResultType, ID: id, Result: result, Error: err})
+	return b
+}
+
+// rpcの要求を登録されたハンドラーに渡し、結果を要求したクライアントにだけ返す
+func (c *Client) handleRPC(message []byte) {
+	var req rpcRequest
+	if json.Unmarshal(message, &req) != nil || req.ID == "" || req.Method == "" {
+		c.hub.sendTo(c, errorMessage(codeInvalidFormat, "rpc requires string id and method; dropped", 0))
+		return
+	}
+	handler, ok := c.hub.RPCHandlers[req.Method]
+	if !ok {
+		c.hub.sendTo(c, rpcResultMessage(req.ID, nil, &rpcError{Code: rpcMethodNotFound, Message: fmt.Sprintf("unknown method %q", req.Method)}))
+		return
+	}
+	result, err := handler(c, req.Params)
+	if err != nil {
+		c.hub.sendTo(c, rpcResultMessage(req.ID, nil, &rpcError{Code: rpcHandlerError, Message: err.Error()}))
+		return
+	}
+	data, err := json.Marshal(result)
+	if err != nil {
+		c.hub.errLog.Printf("rpc", "rpcの結果をJSONにできませんでした method=%s: %v", req.Method, err)
+		c.hub.sendTo(c, rpcResultMessage(req.ID, nil, &rpcError{Code: rpcInternalError, Message: "failed to encode result"}))
+		return
+	}
+	c.hub.sendTo(c, rpcResultMessage(req.ID, data, nil))
+}
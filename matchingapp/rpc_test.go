@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRPCRepliesToTheCallerOnly(t *testing.T) {
+	h := startHubWith(t, defaultConfig(), func(h *Hub) {
+		h.RPCHandlers = map[string]RPCHandler{
+			"add": func(c *Client, params json.RawMessage) (any, error) {
+				var p struct{ A, B int }
+				if err := json.Unmarshal(params, &p); err != nil {
+					return nil, err
+				}
+				return map[string]int{"sum": p.A + p.B}, nil
+			},
+			"fail": func(c *Client, params json.RawMessage) (any, error) {
+				return nil, errors.New("boom")
+			},
+		}
+	})
+	_, caller := connectFake(t, h)
+	_, other := connectFake(t, h)
+
+	caller.reads <- []byte(`{"type":"rpc","id":"1","method":"add","params":{"a":1,"b":2}}`)
+	caller.reads <- []byte(`{"type":"rpc","id":"2","method":"missing"}`)
+	caller.reads <- []byte(`{"type":"rpc","id":"3","method":"fail"}`)
+	eventually(t, "3件の応答", func() bool { return len(caller.messages()) >= 3 })
+
+	want := []rpcResultFrame{
+		{Type: rpcResultType, ID: "1", Result: json.RawMessage(`{"sum":3}`)},
+		{Type: rpcResultType, ID: "2", Error: &rpcError{Code: rpcMethodNotFound}},
+		{Type: rpcResultType, ID: "3", Error: &rpcError{Code: rpcHandlerError, Message: "boom"}},
+	}
+	for i, m := range caller.messages() {
+		var got rpcResultFrame
+		if err := json.Unmarshal([]byte(m), &got); err != nil {
+			t.Fatalf("応答 %q: %v", m, err)
+		}
+		w := want[i]
+		if got.Type != w.Type || got.ID != w.ID || string(got.Result) != string(w.Result) {
+			t.Errorf("応答%d = %s, want id %s result %s", i+1, m, w.ID, w.Result)
+		}
+		if (got.Error == nil) != (w.Error == nil) || got.Error != nil && (got.Error.Code != w.Error.Code || w.Error.Message != "" && got.Error.Message != w.Error.Message) {
+			t.Errorf("応答%dのerror = %s, want %+v", i+1, m, w.Error)
+		}
+	}
+
+	// rpcは中継しない
+	time.Sleep(20 * time.Millisecond)
+	if got := other.messages(); len(got) != 0 {
+		t.Errorf("他のクライアントに届いたメッセージ = %q", got)
+	}
+	if n := h.Stats().Broadcasts; n != 0 {
+		t.Errorf("Broadcasts = %d, want 0", n)
+	}
+}
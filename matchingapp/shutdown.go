@@ -0,0 +1,53 @@
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// 停止の予告を送り始めてからドレインを始めるまでの間、intervalごとに
+// 全スペースのクライアントへ残り時間を知らせる。noticeが経過するまで戻らない
+func (r *hubRegistry) countdown(notice, interval time.Duration) {
+	if notice <= 0 {
+		return
+	}
+	log.Printf("停止の予告を開始しました: %v後にドレインします", notice)
+	end := time.Now().Add(notice)
+	for {
+		remaining := time.Until(end)
+		if remaining <= 0 {
+			return
+		}
+		msg := shutdownNoticeMessage(remaining)
+		for _, hub := range r.all() {
+			hub.notifyAll(msg)
+		}
+		time.Sleep(min(interval, remaining))
+	}
+}
+
+// SIGTERM(またはSIGINT)を受け取ったら、停止を予告してからドレインし、
+// 全クライアントが切断されるか期限が来たところで終了する
+// 終了を待っている間にもう一度シグナルを受け取った場合は、すぐに終了する
+func (r *hubRegistry) shutdownOnSignal(window time.Duration) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGTERM, os.Interrupt)
+	<-sig
+	signal.Stop(sig)
+	log.Println("終了シグナルを受け取りました。クライアントを切断してから終了します")
+
+	r.mu.Lock()
+	notice := r.cfg.ShutdownNotice
+	r.mu.Unlock()
+	r.Drain(window)
+	deadline := time.Now().Add(notice + window + closeFlushTimeout)
+	for r.ClientCount() > 0 && time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+	}
+	r.Close()
+	log.Println("終了します")
+	os.Exit(0)
+}
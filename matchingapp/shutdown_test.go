@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"app/wstest"
+)
+
+func TestShutdownNoticeCountsDownBeforeDisconnect(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.ShutdownNotice = 300 * time.Millisecond
+	cfg.ShutdownNoticeInterval = 100 * time.Millisecond
+	reg, url := startServer(t, cfg)
+	c := wstest.Dial(t, url+"/ws")
+	defer c.Close()
+	c.Expect("welcome")
+
+	start := time.Now()
+	reg.Drain(0)
+	// 予告の間から新しい接続は断る
+	if _, resp, err := wstest.DialErr(t, url+"/ws"); err == nil || resp == nil || resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("予告中の接続: err=%v resp=%v, want 503", err, resp)
+	}
+
+	var notices []time.Duration
+	for {
+		m := map[string]any{}
+		c.ReadJSON(&m)
+		elapsed := time.Since(start)
+		if m["type"] == "disconnect" {
+			if m["reason"] != reasonShutdown {
+				t.Errorf("切断理由 = %v, want %s", m["reason"], reasonShutdown)
+			}
+			if elapsed < cfg.ShutdownNotice {
+				t.Errorf("予告の期間(%v)より前の%vで切断されました", cfg.ShutdownNotice, elapsed)
+			}
+			break
+		}
+		if m["type"] != "shutdown_notice" {
+			t.Fatalf("予期しないメッセージ: %v", m)
+		}
+		if m["seconds_remaining"] != float64(1) {
+			t.Errorf("seconds_remaining = %v, want 1", m["seconds_remaining"])
+		}
+		notices = append(notices, elapsed)
+	}
+	if len(notices) < 3 || len(notices) > 4 {
+		t.Fatalf("予告の回数 = %d (%v), want 3〜4", len(notices), notices)
+	}
+	for i := 1; i < 3; i++ {
+		if gap := notices[i] - notices[i-1]; gap < 80*time.Millisecond || gap > 250*time.Millisecond {
+			t.Errorf("%d回目と%d回目の予告の間隔 = %v, want 約%v", i, i+1, gap, cfg.ShutdownNoticeInterval)
+		}
+	}
+}
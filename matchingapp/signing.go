@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"hash"
+)
+
+// 署名に使えるアルゴリズム
+var signingAlgorithms = map[string]func() hash.Hash{
+	"hmac-sha256": sha256.New,
+	"hmac-sha512": sha512.New,
+}
+
+// メッセージに付けるHMAC署名を作成/検証する
+// 署名付きのメッセージは "<16進数の署名>.<本文>" の形式で、署名は本文に対して計算する
+// クライアントからのメッセージは検証して本文だけを中継し、サーバーから送るメッセージには署名を付け直す
+type signer struct {
+	key []byte
+	newHash func() hash.Hash
+}
+
+// 共有鍵とアルゴリズムから署名器を作る。keyが空の場合はnil(署名しない)を返す
+// algはConfig.validateで確認済みであること
+func newSigner(key, alg string) *signer {
+	if key == "" {
+		return nil
+	}
+	return &signer{key: []byte(key), newHash: signingAlgorithms[alg]}
+}
+
+func (s *signer) mac(payload []byte) []byte {
+	m := hmac.New(s.newHash, s.key)
+	m.Write(payload)
+	return m.Sum(nil)
+}
+
+// 本文に署名を付けたメッセージを返す
+func (s *signer) sign(payload []byte) []byte {
+	sig := s.mac(payload)
+	b := make([]byte, 0, hex.EncodedLen(len(sig))+1+len(payload))
+	b = hex.AppendEncode(b, sig)
+	b = append(b, '.')
+	return append(b, payload...)
+}
+
+// 署名付きのメッセージを検証し、正しければ本文を返す
+// 署名がない場合や一致しない場合はfalseを返す(比較は一定時間で行う)
+func (s *signer) verify(message []byte) ([]byte, bool) {
+	encoded, payload, ok := bytes.Cut(message, []byte("."))
+	if !ok {
+		return nil, false
+	}
+	sig := make([]byte, hex.DecodedLen(len(encoded)))
+	if _, err := hex.Decode(sig, encoded); err != nil {
+		return nil, false
+	}
+	return payload, hmac.Equal(sig, s.mac(payload))
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"app/wstest"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestSignerVerify(t *testing.T) {
+	s := newSigner("secret", "hmac-sha256")
+	payload := []byte(`{"type":"chat"}`)
+	signed := s.sign(payload)
+	tampered := append([]byte(nil), signed...)
+	tampered[len(tampered)-2] = 'X'
+
+	tests := []struct {
+		name string
+		message []byte
+		ok bool
+	}{
+		{"正しい署名", signed, true},
+		{"本文の改ざん", tampered, false},
+		{"別の鍵の署名", newSigner("other", "hmac-sha256").sign(payload), false},
+		{"別のアルゴリズムの署名", newSigner("secret", "hmac-sha512").sign(payload), false},
+		{"署名なし", payload, false},
+		{"16進数でない署名", append([]byte("zz."), payload...), false},
+		{"空の署名", append([]byte("."), payload...), false},
+	}
+	for _, tt := range tests {
+		got, ok := s.verify(tt.message)
+		if ok != tt.ok {
+			t.Errorf("%s: verify = %v, want %v", tt.name, ok, tt.ok)
+		}
+		if ok && string(got) != string(payload) {
+			t.Errorf("%s: 本文 = %s, want %s", tt.name, got, payload)
+		}
+	}
+	if newSigner("", "hmac-sha256") != nil {
+		t.Error("鍵が空でも署名器が作られました")
+	}
+}
+
+func TestServerVerifiesAndSignsMessages(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.SigningKey = "secret"
+	reg, url := startServer(t, cfg)
+	s := newSigner(cfg.SigningKey, cfg.SigningAlgorithm)
+	c := wstest.Dial(t, url+"/ws")
+	defer c.Close()
+	// サーバーからのメッセージは全て署名されている
+	expect := func(typ string) map[string]any {
+		t.Helper()
+		raw, err := c.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		payload, ok := s.verify(raw)
+		if !ok {
+			t.Fatalf("サーバーからのメッセージの署名が正しくありません: %s", raw)
+		}
+		var m map[string]any
+		if err := json.Unmarshal(payload, &m); err != nil || m["type"] != typ {
+			t.Fatalf("受信したメッセージ = %s, want %s", payload, typ)
+		}
+		return m
+	}
+	expect("welcome")
+
+	send := func(message []byte) {
+		t.Helper()
+		if err := c.Conn.WriteMessage(websocket.TextMessage, message); err != nil {
+			t.Fatal(err)
+		}
+	}
+	send(s.sign([]byte(`{"type":"chat","text":"signed"}`)))
+	if m := expect("chat"); m["text"] != "signed" {
+		t.Errorf("中継したメッセージ = %v", m)
+	}
+	forged := newSigner("other", cfg.SigningAlgorithm).sign([]byte(`{"type":"chat","text":"forged"}`))
+	for _, message := range [][]byte{forged, []byte(`{"type":"chat","text":"unsigned"}`)} {
+		send(message)
+		if m := expect("error"); m["code"] != codeInvalidSignature {
+			t.Errorf("%s へのエラー = %v, want code %s", message, m, codeInvalidSignature)
+		}
+	}
+	if n := reg.all()[defaultSpace].Stats().SignatureRejects; n != 2 {
+		t.Errorf("SignatureRejects = %d, want 2", n)
+	}
+}
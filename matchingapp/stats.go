@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"runtime"
+	"time"
+)
+
+// hubの状態のスナップショット
+type Stats struct {
+	Clients int `json:"clients"`
+	// 同時接続数の最大値(起動以降と、最後のリセット以降)
+	PeakClients int64 `json:"peak_clients"`
+	PeakClientsSinceReset int64 `json:"peak_clients_since_reset"`
+	Queued int64 `json:"queued"`
+	Draining bool `json:"draining"`
+	// hubへの登録を待っている接続の数
+	PendingRegistrations int64 `json:"pending_registrations"`
+	// 一時停止中か、と一時停止中に溜めているブロードキャストの数
+	Paused bool `json:"paused"`
+	Held int64 `json:"held"`
+	// 最後に計測した、全クライアントで最も古い未配信メッセージの待ち時間(ミリ秒)と、警告中か
+	OldestQueuedMs int64 `json:"oldest_queued_ms"`
+	QueueAgeAlarm bool `json:"queue_age_alarm"`
+
+	// 起動からの累計
+	Broadcasts uint64 `json:"broadcasts"`
+	Evictions uint64 `json:"evictions"`
+	SlowWarnings uint64 `json:"slow_warnings"`
+	StaleDrops uint64 `json:"stale_drops"`
+	Shedding bool `json:"shedding"`
+	BroadcastLimited bool `json:"broadcast_limited"`
+	BroadcastLimitedCount uint64 `json:"broadcast_limited_count"`
+	ShedDrops uint64 `json:"shed_drops"`
+	// クライアントが受け取れない種類のため配信しなかった数(クライアントごとに数える)
+	UnsupportedSkips uint64 `json:"unsupported_skips"`
+	// 受信バイト数の上限を超えたため捨てたメッセージの数
+	QuotaRejects uint64 `json:"quota_rejects"`
+	// ブロードキャストを送らないように切り替えたクライアントの数と、そのために送らなかった数
+	Demotions uint64 `json:"demotions"`
+	// このスペースの送信バッファに溜まっているメッセージの合計バイト数と、
+	// 全スペースの合計が上限を超えているか、超えたためにこのスペースで切断した数
+	BufferedBytes int64 `json:"buffered_bytes"`
+	MemoryAlarm bool `json:"memory_alarm"`
+	MemoryEvictions uint64 `json:"memory_evictions"`
+	DemotedSkips uint64 `json:"demoted_skips"`
+	// 実行中のpumpゴルーチンの数。落ち着いた状態ではClientsの2倍になり、
+	// 切断後も減らない場合はゴルーチンがリークしている
+	ActivePumps int64 `json:"active_pumps"`
+	// 負荷の段階(しきい値が設定されていない場合は省略)
+	Load string `json:"load,omitempty"`
+	// 配信方法と、drop-oldestで送信バッファから捨てた古いメッセージの数
+	DeliveryStrategy string `json:"delivery_strategy"`
+	OldestDrops uint64 `json:"oldest_drops"`
+	SignatureRejects uint64 `json:"signature_rejects"`
+	BanRejects uint64 `json:"ban_rejects"`
+	// 許可されていないIPアドレスからの接続を拒否した数
+	IPRejects uint64 `json:"ip_rejects"`
+	RegistrationRejects uint64 `json:"registration_rejects"`
+	// カナリアにした接続とそれ以外の接続の数
+	CanaryConnections uint64 `json:"canary_connections"`
+	NormalConnections uint64 `json:"normal_connections"`
+	PauseDrops uint64 `json:"pause_drops"`
+	BytesIn uint64 `json:"bytes_in"`
+	BytesOut uint64 `json:"bytes_out"`
+
+	// pingの往復時間の分布(区切り以下の件数、累積ではない)
+	LatencyBuckets map[string]uint64 `json:"latency_buckets"`
+
+	// 切断理由ごとの切断数
+	Disconnects map[string]uint64 `json:"disconnects"`
+}
+
+// hubの現在の状態を返す(どのゴルーチンからでも呼べる)
+func (h *Hub) Stats() Stats {
+	return Stats{
+		Clients: h.ClientCount(),
+		PeakClients: h.peakSinceStart.Load(),
+		PeakClientsSinceReset: h.peak.Load(),
+		Queued: h.Queued(),
+		Draining: h.Draining(),
+		PendingRegistrations: h.pendingRegistrations.Load(),
+		Paused: h.paused.Load(),
+		Held: h.heldCount.Load(),
+		OldestQueuedMs: time.Duration(h.oldestQueued.Load()).Milliseconds(),
+		QueueAgeAlarm: h.queueAgeAlarming.Load(),
+		Broadcasts: h.broadcasts.Load(),
+		Evictions: h.evictions.Load(),
+		SlowWarnings: h.slowWarnings.Load(),
+		StaleDrops: h.staleDrops.Load(),
+		Shedding: h.shedding.Load(),
+		BroadcastLimited: h.broadcastLimited.Load(),
+		BroadcastLimitedCount: h.broadcastLimitedCount.Load(),
+		ShedDrops: h.shedDrops.Load(),
+		UnsupportedSkips: h.unsupportedSkips.Load(),
+		QuotaRejects: h.quotaRejects.Load(),
+		Demotions: h.demotions.Load(),
+		BufferedBytes: h.bufferedBytes.Load(),
+		MemoryAlarm: h.totals.memoryAlarming.Load(),
+		MemoryEvictions: h.memoryEvictions.Load(),
+		DemotedSkips: h.demotedSkips.Load(),
+		DeliveryStrategy: h.delivery.Load().name,
+		OldestDrops: h.oldestDrops.Load(),
+		SignatureRejects: h.signatureRejects.Load(),
+		BanRejects: h.banRejects.Load(),
+		IPRejects: h.ipRejects.Load(),
+		RegistrationRejects: h.registrationRejects.Load(),
+		CanaryConnections: h.canaryConnections.Load(),
+		NormalConnections: h.normalConnections.Load(),
+		PauseDrops: h.pauseDrops.Load(),
+		BytesIn: h.bytesIn.Load(),
+		BytesOut: h.bytesOut.Load(),
+		LatencyBuckets: h.latency.snapshot(),
+		Load: h.loadLevel(),
+		ActivePumps: h.activePumps.Load(),
+		Disconnects: h.Disconnects(),
+	}
+}
+
+// 一定間隔ごとに、前回からの増分を含む統計情報を全スペース分ログ出力する
+func (r *hubRegistry) logStats(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	// スペースは取り除かれた後に同じ名前で作り直されることがあるため、名前ではなくhubごとに前回の値を持つ
+	// (取り除かれたhubの分は次の回に持ち越さない)
+	prev := make(map[*Hub]Stats)
+	for range ticker.C {
+		prev = r.logStatsSince(prev, interval)
+	}
+}
+
+// prevからの増分を含む統計情報を全スペース分ログ出力し、次の回に渡す値を返す
+func (r *hubRegistry) logStatsSince(prev map[*Hub]Stats, interval time.Duration) map[*Hub]Stats {
+	next := make(map[*Hub]Stats, len(prev))
+	for space, hub := range r.all() {
+		s := hub.Stats()
+		p := prev[hub]
+		log.Printf("統計[%s]: クライアント=%d 配信=%d 送信=%dB 受信=%dB バッファ超過による切断=%d (直近%v)",
+			space, s.Clients, s.Broadcasts-p.Broadcasts, s.BytesOut-p.BytesOut, s.BytesIn-p.BytesIn, s.Evictions-p.Evictions, interval)
+		next[hub] = s
+	}
+	return next
+}
+
+// 全スペースの接続中クライアント数の合計を返す
+func (r *hubRegistry) ClientCount() int {
+	return int(r.totals.clients.Load())
+}
+
+// ヘルスチェック。稼働中であればクライアント数とともに200を返す
+// ドレイン中は503を返し、ロードバランサが新しい接続を振り分けないようにする
+func serveHealthz(reg *hubRegistry, w http.ResponseWriter, r *http.Request) {
+	if reg.Draining() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintf(w, "draining clients=%d\n", reg.ClientCount())
+		return
+	}
+	fmt.Fprintf(w, "ok clients=%d\n", reg.ClientCount())
+}
+
+// /stats/runtime のレスポンス
+type runtimeStats struct {
+	// プロセス全体のゴルーチンの数
+	Goroutines int `json:"goroutines"`
+	// 全スペースのpumpゴルーチンとクライアントの数
+	ActivePumps int64 `json:"active_pumps"`
+	Clients int `json:"clients"`
+}
+
+// ゴルーチンの数をJSONで返す(リークの確認用)
+// 落ち着いた状態では、goroutinesは起動直後の数(接続がないとき)にactive_pumpsを足した数前後になり、
+// active_pumpsはclientsの2倍(readPumpとwritePump)になる
+// 接続と切断を繰り返した後にこれより増えたままの場合は、どこかでゴルーチンがリークしている
+func serveRuntimeStats(reg *hubRegistry, w http.ResponseWriter, r *http.Request) {
+	var pumps int64
+	for _, hub := range reg.all() {
+		pumps += hub.activePumps.Load()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(runtimeStats{
+		Goroutines: runtime.NumGoroutine(),
+		ActivePumps: pumps,
+		Clients: reg.ClientCount(),
+	})
+}
+
+// スペースごとのhubの統計情報をJSONで返す
+func serveStats(reg *hubRegistry, w http.ResponseWriter, r *http.Request) {
+	stats := make(map[string]Stats)
+	for space, hub := range reg.all() {
+		stats[space] = hub.Stats()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
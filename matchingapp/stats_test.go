@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"app/wstest"
+)
+
+func TestLogStatsReportsActivityBetweenTicks(t *testing.T) {
+	reg := newHubRegistry(defaultConfig())
+	defer reg.Close()
+	h := reg.all()[defaultSpace]
+	addFakeClient(t, h)
+	logs := captureLog(t)
+
+	for i := 0; i < 3; i++ {
+		h.publish([]byte(`{"type":"chat"}`))
+	}
+	h.do(func() {})
+	prev := reg.logStatsSince(map[*Hub]Stats{}, time.Second)
+	if out := logs.String(); !strings.Contains(out, "統計[default]: クライアント=1 配信=3 ") {
+		t.Errorf("1回目の統計 = %q, want 配信=3", out)
+	}
+
+	h.publish([]byte(`{"type":"chat"}`))
+	h.do(func() {})
+	before := len(logs.String())
+	prev = reg.logStatsSince(prev, time.Second)
+	if out := logs.String()[before:]; !strings.Contains(out, "統計[default]: クライアント=1 配信=1 ") {
+		t.Errorf("2回目の統計 = %q, want 前回からの増分の 配信=1", out)
+	}
+
+	before = len(logs.String())
+	reg.logStatsSince(prev, time.Second)
+	if out := logs.String()[before:]; !strings.Contains(out, "配信=0 送信=0B 受信=0B バッファ超過による切断=0") {
+		t.Errorf("何もなかった間の統計 = %q, want 増分がすべて0", out)
+	}
+}
+
+func TestGoroutinesReturnToBaselineAfterConnectionsClose(t *testing.T) {
+	_, url := startServer(t, defaultConfig())
+	get := func() runtimeStats {
+		t.Helper()
+		resp, err := http.Get(httpURL(url) + "/stats/runtime")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var st runtimeStats
+		if err := json.NewDecoder(resp.Body).Decode(&st); err != nil {
+			t.Fatal(err)
+		}
+		return st
+	}
+	baseline := get()
+	if baseline.ActivePumps != 0 || baseline.Clients != 0 {
+		t.Fatalf("接続前の統計 = %+v", baseline)
+	}
+
+	const n = 20
+	for round := 0; round < 3; round++ {
+		var clients []*wstest.Client
+		for i := 0; i < n; i++ {
+			c := wstest.Dial(t, url+"/ws")
+			c.Expect("welcome")
+			clients = append(clients, c)
+		}
+		if st := get(); st.ActivePumps != 2*n || st.Clients != n || st.Goroutines < baseline.Goroutines+2*n {
+			t.Errorf("%d回目の接続中の統計 = %+v, want active_pumps %d, clients %d", round+1, st, 2*n, n)
+		}
+		for _, c := range clients {
+			c.Close()
+		}
+		eventually(t, "pumpの終了", func() bool { return get().ActivePumps == 0 })
+	}
+	// 接続と切断を繰り返しても、ゴルーチンは接続前の数に戻る
+	// (テスト用のHTTPクライアントの接続など、接続と関係なく一時的に増える分は見逃す)
+	eventually(t, "ゴルーチンの数が接続前に戻る", func() bool {
+		return get().Goroutines <= baseline.Goroutines+2
+	})
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime"
+	"time"
+)
+
+// ビルドバージョン
+// ビルド時に -ldflags "-X main.version=v1.2.3" で埋め込む
+var version = "dev"
+
+// サーバーの起動時刻(mainで設定する)
+var startTime time.Time
+
+// /version のレスポンス
+type versionInfo struct {
+	Version string `json:"version"`
+	GoVersion string `json:"go_version"`
+	StartTime time.Time `json:"start_time"`
+	UptimeSeconds float64 `json:"uptime_seconds"`
+}
+
+// ビルド情報と稼働時間をJSONで返す
+func serveVersion(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(versionInfo{
+		Version: version,
+		GoVersion: runtime.Version(),
+		StartTime: startTime,
+		UptimeSeconds: time.Since(startTime).Seconds(),
+	})
+}
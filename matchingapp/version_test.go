@@ -0,0 +1,49 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// /version を呼び出し、レスポンスを返す
+func getVersion(t *testing.T) versionInfo {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	serveVersion(rec, httptest.NewRequest("GET", "/version", nil))
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Content-Type = %q, want application/json", ct)
+	}
+	var info versionInfo
+	if err := json.Unmarshal(rec.Body.Bytes(), &info); err != nil {
+		t.Fatalf("レスポンスをデコードできません: %v\n%s", err, rec.Body)
+	}
+	return info
+}
+
+func TestVersionReportsBuildInfoAndUptime(t *testing.T) {
+	saved := startTime
+	t.Cleanup(func() { startTime = saved })
+	startTime = time.Now().Add(-time.Minute).Truncate(time.Second)
+
+	first := getVersion(t)
+	if first.Version != version {
+		t.Errorf("version = %q, want %q", first.Version, version)
+	}
+	if first.GoVersion != runtime.Version() {
+		t.Errorf("go_version = %q, want %q", first.GoVersion, runtime.Version())
+	}
+	if !first.StartTime.Equal(startTime) {
+		t.Errorf("start_time = %v, want %v", first.StartTime, startTime)
+	}
+	if first.UptimeSeconds < 60 {
+		t.Errorf("uptime_seconds = %v, want 60以上", first.UptimeSeconds)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	if second := getVersion(t); second.UptimeSeconds <= first.UptimeSeconds {
+		t.Errorf("uptime_seconds が増えていません: %v → %v", first.UptimeSeconds, second.UptimeSeconds)
+	}
+}
@@ -0,0 +1,209 @@
+// wstestはサーバーに接続してJSONメッセージをやり取りする、結合テスト用のクライアントを提供する
+//
+//	c := wstest.Dial(t, "ws://127.0.0.1:8080/ws", wstest.WithQuery("version", "1"))
+//	defer c.Close()
+//	welcome := c.Expect("welcome")
+//	c.SendJSON(map[string]any{"type": "chat", "text": "hello"})
+//	c.Expect("chat")
+package wstest
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// 応答を待つ時間の既定値
+const DefaultTimeout = 5 * time.Second
+
+// テスト用のWebSocketクライアント
+type Client struct {
+	t testing.TB
+	Conn *websocket.Conn
+
+	// 応答を待つ時間
+	Timeout time.Duration
+
+	// サーバーは溜まったメッセージを改行区切りで1つのフレームにまとめて送るため、
+	// 読み込んだがまだ返していないメッセージを保持する
+	pending [][]byte
+}
+
+// 接続時の設定
+type options struct {
+	header http.Header
+	query url.Values
+	subprotocols []string
+	compress bool
+	writeBufferSize int
+}
+
+// 接続時の設定を変更する
+type Option func(*options)
+
+// ハンドシェイクのリクエストにヘッダーを追加する
+func WithHeader(key, value string) Option {
+	return func(o *options) {
+		o.header.Add(key, value)
+	}
+}
+
+// 接続URLにクエリパラメータを追加する(例: mode=readonly, version=1)
+func WithQuery(key, value string) Option {
+	return func(o *options) {
+		o.query.Add(key, value)
+	}
+}
+
+// サブプロトコルを申し出る(例: matching.v1)
+func WithSubprotocol(protocols ...string) Option {
+	return func(o *options) {
+		o.subprotocols = append(o.subprotocols, protocols...)
+	}
+}
+
+// permessage-deflateによる圧縮を申し出る
+func WithCompression() Option {
+	return func(o *options) {
+		o.compress = true
+	}
+}
+
+// 送信バッファの大きさをnバイトにする
+// これより大きいメッセージは複数のフレームに分割して送られる
+func WithWriteBufferSize(n int) Option {
+	return func(o *options) {
+		o.writeBufferSize = n
+	}
+}
+
+// rawURLに接続する。失敗した場合はテストを終了する
+func Dial(t testing.TB, rawURL string, opts ...Option) *Client {
+	t.Helper()
+	c, resp, err := DialErr(t, rawURL, opts...)
+	if err != nil {
+		status := 0
+		if resp != nil {
+			status = resp.StatusCode
+		}
+		t.Fatalf("wstest: %s への接続に失敗しました(status=%d): %v", rawURL, status, err)
+	}
+	return c
+}
+
+// rawURLに接続する。接続が拒否されることを確かめるテストで使う
+func DialErr(t testing.TB, rawURL string, opts ...Option) (*Client, *http.Response, error) {
+	t.Helper()
+	o := options{header: http.Header{}, query: url.Values{}}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		t.Fatalf("wstest: URLが不正です: %v", err)
+	}
+	q := u.Query()
+	for key, values := range o.query {
+		for _, v := range values {
+			q.Add(key, v)
+		}
+	}
+	u.RawQuery = q.Encode()
+
+	dialer := *websocket.DefaultDialer
+	dialer.Subprotocols = o.subprotocols
+	dialer.EnableCompression = o.compress
+	if o.writeBufferSize > 0 {
+		dialer.WriteBufferSize = o.writeBufferSize
+	}
+	conn, resp, err := dialer.Dial(u.String(), o.header)
+	if err != nil {
+		return nil, resp, err
+	}
+	return &Client{t: t, Conn: conn, Timeout: DefaultTimeout}, resp, nil
+}
+
+// vをJSONにして送信する
+// サーバーは溜まったメッセージを改行区切りでまとめて送るため、WriteJSONと違い末尾に改行を付けない
+func (c *Client) SendJSON(v any) {
+	c.t.Helper()
+	b, err := json.Marshal(v)
+	if err != nil {
+		c.t.Fatalf("wstest: JSONにできませんでした: %v", err)
+	}
+	c.Conn.SetWriteDeadline(time.Now().Add(c.Timeout))
+	if err := c.Conn.WriteMessage(websocket.TextMessage, b); err != nil {
+		c.t.Fatalf("wstest: 送信に失敗しました: %v", err)
+	}
+}
+
+// 次のメッセージを1つ読み込む
+func (c *Client) ReadMessage() ([]byte, error) {
+	for len(c.pending) == 0 {
+		c.Conn.SetReadDeadline(time.Now().Add(c.Timeout))
+		_, frame, err := c.Conn.ReadMessage()
+		if err != nil {
+			return nil, err
+		}
+		c.pending = bytes.Split(frame, []byte("\n"))
+	}
+	m := c.pending[0]
+	c.pending = c.pending[1:]
+	return m, nil
+}
+
+// 次のメッセージを読み込んでvにデコードする
+func (c *Client) ReadJSON(v any) {
+	c.t.Helper()
+	m, err := c.ReadMessage()
+	if err != nil {
+		c.t.Fatalf("wstest: 受信に失敗しました: %v", err)
+	}
+	if err := json.Unmarshal(m, v); err != nil {
+		c.t.Fatalf("wstest: JSONではないメッセージを受信しました: %s", m)
+	}
+}
+
+// 次のメッセージの種類がtypであることを確かめ、内容を返す
+func (c *Client) Expect(typ string) map[string]any {
+	c.t.Helper()
+	var m map[string]any
+	c.ReadJSON(&m)
+	if m["type"] != typ {
+		c.t.Fatalf("wstest: 種類 %q のメッセージを待っていましたが、%v を受信しました", typ, m)
+	}
+	return m
+}
+
+// 種類typのメッセージが届くまで、他のメッセージを読み飛ばす
+func (c *Client) ExpectEventually(typ string) map[string]any {
+	c.t.Helper()
+	for {
+		var m map[string]any
+		c.ReadJSON(&m)
+		if m["type"] == typ {
+			return m
+		}
+	}
+}
+
+// Timeoutの間に何も届かないことを確かめる
+// 読み込みがタイムアウトした接続はそれ以降使えないため、確認の最後に呼ぶこと
+func (c *Client) ExpectNothing() {
+	c.t.Helper()
+	if m, err := c.ReadMessage(); err == nil {
+		c.t.Fatalf("wstest: メッセージが届かないはずが、%s を受信しました", m)
+	}
+}
+
+// クローズフレームを送って接続を閉じる
+func (c *Client) Close() {
+	c.Conn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+	c.Conn.Close()
+}